@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"math"
@@ -16,6 +19,7 @@ import (
 	"song-recognition/spotdl"
 	"song-recognition/utils"
 	"song-recognition/wav"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -35,7 +39,7 @@ const (
 
 var yellow = color.New(color.FgYellow)
 
-func find(filePath string) {
+func find(filePath string, speedTolerance float64, preprocess string, explain explainOptions) {
 	wavInfo, err := wav.ReadWavInfo(filePath)
 	if err != nil {
 		yellow.Println("Error reading wave info:", err)
@@ -48,15 +52,27 @@ func find(filePath string) {
 		return
 	}
 
-	matches, searchDuration, err := shazam.FindMatches(samples, wavInfo.Duration, wavInfo.SampleRate)
-	if err != nil {
-		yellow.Println("Error finding matches:", err)
-		return
+	opts := shazam.DefaultMatchOptions()
+	if speedTolerance > 0 {
+		opts.Transforms = shazam.SpeedGrid(speedTolerance)
+	}
+	if preprocess != "" {
+		opts.Preprocess, err = shazam.ParsePreprocessChain(preprocess)
+		if err != nil {
+			yellow.Println("Error parsing preprocessing chain:", err)
+			return
+		}
 	}
 
-	if len(matches) == 0 {
+	matches, explanation, searchDuration, err := shazam.FindMatchesExplained(context.Background(), samples, wavInfo.Duration, wavInfo.SampleRate, opts, explain.top)
+	if errors.Is(err, shazam.ErrNoMatch) {
 		fmt.Println("\nNo match found.")
 		fmt.Printf("\nSearch took: %s\n", searchDuration)
+		explainFind(explanation, explain)
+		return
+	}
+	if err != nil {
+		yellow.Println("Error finding matches:", err)
 		return
 	}
 
@@ -69,14 +85,206 @@ func find(filePath string) {
 
 	fmt.Println(msg)
 	for _, match := range topMatches {
-		fmt.Printf("\t- %s by %s, score: %.2f\n",
-			match.SongTitle, match.SongArtist, match.Score)
+		fmt.Printf("\t- %s by %s, score: %.2f, confidence: %.3f, aligned: %d (%.1f%%), at: %s%s\n",
+			match.SongTitle, match.SongArtist, match.Score, match.Confidence, match.AlignedHits,
+			match.AlignedRatio*100, time.Duration(match.Timestamp)*time.Millisecond, speedSuffix(match))
 	}
 
 	fmt.Printf("\nSearch took: %s\n", searchDuration)
 	topMatch := topMatches[0]
-	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f\n",
-		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score)
+	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f, confidence: %.3f%s\n",
+		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score, topMatch.Confidence, speedSuffix(topMatch))
+
+	explainFind(explanation, explain)
+}
+
+// findCovers lists the songs whose harmony follows that of the recording,
+// such as the studio versions of a live recording.
+func findCovers(filePath string) {
+	samples, sampleRate, err := readMonoSamples(filePath)
+	if err != nil {
+		yellow.Println("Error reading audio:", err)
+		return
+	}
+
+	startTime := time.Now()
+	covers, err := shazam.FindCovers(context.Background(), samples, sampleRate, shazam.DefaultCoverOptions())
+	searchDuration := time.Since(startTime)
+	if errors.Is(err, shazam.ErrNoMatch) {
+		fmt.Println("\nNo cover found.")
+		fmt.Printf("\nSearch took: %s\n", searchDuration)
+		return
+	}
+	if err != nil {
+		yellow.Println("Error finding covers:", err)
+		return
+	}
+
+	fmt.Println("Most similar songs:")
+	for _, cover := range covers {
+		fmt.Printf("\t- %s by %s, similarity: %.3f, transposed: %+d semitones, at: %s\n",
+			cover.SongTitle, cover.SongArtist, cover.Similarity, cover.Transpose,
+			time.Duration(cover.Position*float64(time.Second)))
+	}
+
+	fmt.Printf("\nSearch took: %s\n", searchDuration)
+}
+
+func similar(songID uint32, top int) {
+	similarSongs, err := shazam.FindSimilarSongs(context.Background(), songID, top)
+	if err != nil {
+		yellow.Println("Error finding similar songs:", err)
+		return
+	}
+	if len(similarSongs) == 0 {
+		fmt.Println("No other song has an embedding.")
+		return
+	}
+
+	fmt.Println("Most similar songs:")
+	for _, song := range similarSongs {
+		fmt.Printf("\t- %s by %s (ID %d), similarity: %.3f\n", song.SongTitle, song.SongArtist, song.SongID, song.Similarity)
+	}
+}
+
+// show prints the song with ID songID and its tempo and key, or every
+// indexed song when all is set.
+func show(songID uint32, all bool) {
+	ctx := context.Background()
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		yellow.Println("Error connecting to DB:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	if all {
+		songs, err := dbClient.GetAllSongs(ctx)
+		if err != nil {
+			yellow.Println("Error getting songs:", err)
+			return
+		}
+		for _, song := range songs {
+			fmt.Printf("%d\t%s by %s\t%s\t%s\n", song.ID, song.Title, song.Artist, formatBPM(song.BPM), formatKey(song.Key))
+		}
+		return
+	}
+
+	song, songExists, err := dbClient.GetSongByID(ctx, songID)
+	if err != nil {
+		yellow.Println("Error getting song:", err)
+		return
+	}
+	if !songExists {
+		yellow.Printf("Song %d not found\n", songID)
+		return
+	}
+
+	fmt.Printf("ID:\t\t%d\n", songID)
+	fmt.Printf("Title:\t\t%s\n", song.Title)
+	fmt.Printf("Artist:\t\t%s\n", song.Artist)
+	fmt.Printf("YouTube ID:\t%s\n", song.YouTubeID)
+	fmt.Printf("Tempo:\t\t%s\n", formatBPM(song.BPM))
+	fmt.Printf("Key:\t\t%s\n", formatKey(song.Key))
+	if song.Loudness != nil {
+		fmt.Printf("Loudness:\t%.1f LUFS, peak %.1f dBFS, %.1fs of silence muted\n", song.Loudness.Integrated, song.Loudness.Peak, song.Loudness.Silence)
+	}
+}
+
+func formatBPM(bpm float64) string {
+	if bpm <= 0 {
+		return "unknown tempo"
+	}
+	return fmt.Sprintf("%.1f BPM", bpm)
+}
+
+func formatKey(key string) string {
+	if key == "" {
+		return "unknown key"
+	}
+	return key
+}
+
+// explainOptions asks find to explain how its top candidates were scored.
+type explainOptions struct {
+	top      int    // candidates to explain, none when 0
+	jsonPath string // file the full explanation is written to, if any
+	plotPath string // scatter plot of each candidate, numbered by rank, if any
+}
+
+// explainFind prints the explanation of a search, if one was asked for,
+// and writes the files of explain.
+func explainFind(explanation *shazam.Explanation, explain explainOptions) {
+	if explanation == nil {
+		return
+	}
+
+	fmt.Printf("\nExplanation (%d peaks, %d transforms, %d ms offset bins):\n",
+		explanation.QueryPeaks, explanation.Transforms, explanation.BinMs)
+	for _, candidate := range explanation.Candidates {
+		status := "rejected"
+		if candidate.Matched {
+			status = "matched"
+		}
+		fmt.Printf("\n#%d %s by %s (%s), confidence: %.3f, aligned: %d/%d hashes, offset: %d ms, winning bin: %d ms, speed: x%.3f, pitch: x%.3f\n",
+			candidate.Rank, candidate.SongTitle, candidate.SongArtist, status, candidate.Confidence,
+			candidate.AlignedHits, candidate.QueryHashes, candidate.OffsetMs, candidate.WinningBinMs, candidate.Speed, candidate.Pitch)
+
+		// The busiest bins show how clearly the winning one stands out
+		bins := append([]shazam.HistogramBin(nil), candidate.Histogram...)
+		sort.SliceStable(bins, func(i, j int) bool { return bins[i].Count > bins[j].Count })
+		fmt.Print("\tbusiest offset bins:")
+		for _, bin := range bins[:min(5, len(bins))] {
+			fmt.Printf(" %d ms (%d)", bin.OffsetMs, bin.Count)
+		}
+		fmt.Println()
+
+		for _, hit := range candidate.Hits {
+			if hit.Aligned {
+				fmt.Printf("\taddress %08x, query: %d ms, reference: %d ms\n", hit.Address, hit.QueryTimeMs, hit.RefTimeMs)
+			}
+		}
+
+		if explain.plotPath != "" {
+			plotPath := numberedPath(explain.plotPath, candidate.Rank)
+			img, err := shazam.RenderHashScatter(candidate)
+			if err == nil {
+				err = shazam.SavePNG(img, plotPath)
+			}
+			if err != nil {
+				yellow.Println("Error rendering scatter plot:", err)
+				continue
+			}
+			fmt.Printf("\tscatter plot written to %s\n", plotPath)
+		}
+	}
+
+	if explain.jsonPath != "" {
+		jsonData, err := json.MarshalIndent(explanation, "", "  ")
+		if err == nil {
+			err = os.WriteFile(explain.jsonPath, jsonData, 0644)
+		}
+		if err != nil {
+			yellow.Println("Error writing explanation:", err)
+			return
+		}
+		fmt.Printf("\nFull explanation written to %s\n", explain.jsonPath)
+	}
+}
+
+// numberedPath inserts n before the extension of path: plot.png becomes plot-2.png.
+func numberedPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// speedSuffix describes the speed and pitch change of a match, if any.
+func speedSuffix(match shazam.Match) string {
+	if match.Speed == 1 && match.Pitch == 1 {
+		return ""
+	}
+	return fmt.Sprintf(", speed: x%.3f, pitch: x%.3f", match.Speed, match.Pitch)
 }
 
 func download(spotifyURL string) {
@@ -129,7 +337,7 @@ func serve(protocol, port string) {
 	})
 
 	server.OnConnect("/", func(socket socketio.Conn) error {
-		socket.SetContext("")
+		socket.SetContext(newConnection())
 		log.Println("CONNECTED: ", socket.ID())
 
 		return nil
@@ -138,8 +346,12 @@ func serve(protocol, port string) {
 	server.OnEvent("/", "totalSongs", handleTotalSongs)
 	server.OnEvent("/", "newDownload", handleSongDownload)
 	server.OnEvent("/", "newRecording", handleNewRecording)
+	server.OnEvent("/", "streamStart", handleStreamStart)
+	server.OnEvent("/", "streamChunk", handleStreamChunk)
+	server.OnEvent("/", "streamStop", handleStreamStop)
 	server.OnEvent("/", "startFingerprinting", handleFingerprinting)
 	server.OnEvent("/", "getAllSongs", handleGetAllSongs)
+	server.OnEvent("/", "getSimilarSongs", handleGetSimilarSongs)
 	server.OnEvent("/", "deleteSong", handleDeleteSong)
 	server.OnEvent("/", "deleteAllSongs", handleDeleteAllSongs)
 
@@ -148,6 +360,7 @@ func serve(protocol, port string) {
 	})
 
 	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
+		handleDisconnect(s)
 		log.Println("closed", reason)
 	})
 
@@ -216,13 +429,35 @@ func erase(songsDir string) {
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
 	}
 
-	err = dbClient.DeleteCollection("fingerprints")
+	err = dbClient.DeleteCollection(ctx, "fingerprints")
+	if err != nil {
+		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
+		logger.ErrorContext(ctx, msg, slog.Any("error", err))
+	}
+
+	err = dbClient.DeleteCollection(ctx, "songs")
 	if err != nil {
 		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
 	}
 
-	err = dbClient.DeleteCollection("songs")
+	err = dbClient.DeleteCollection(ctx, "fingerprint_config")
+	if err != nil {
+		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
+		logger.ErrorContext(ctx, msg, slog.Any("error", err))
+	}
+
+	err = dbClient.DeleteCollection(ctx, "chroma")
+	if err != nil {
+		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
+		logger.ErrorContext(ctx, msg, slog.Any("error", err))
+	}
+	err = dbClient.DeleteCollection(ctx, "embeddings")
+	if err != nil {
+		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
+		logger.ErrorContext(ctx, msg, slog.Any("error", err))
+	}
+	err = dbClient.DeleteCollection(ctx, "song_metadata")
 	if err != nil {
 		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
@@ -317,7 +552,7 @@ func saveSong(filePath string, force bool) error {
 		return fmt.Errorf("no artist found in metadata")
 	}
 
-	err = spotify.ProcessAndSaveSong(filePath, track.Title, track.Artist, ytID)
+	err = spotify.ProcessAndSaveSong(context.Background(), filePath, track.Title, track.Artist, ytID)
 	if err != nil {
 		return fmt.Errorf("failed to process or save song: %v", err)
 	}
@@ -334,3 +569,278 @@ func saveSong(filePath string, force bool) error {
 
 	return nil
 }
+
+// openMonoWav opens filePath for streaming as mono 16-bit PCM, converting
+// it to a temporary WAV file first if needed. The returned function closes
+// the reader and removes the temporary file.
+func openMonoWav(filePath string) (*wav.WavReader, func(), error) {
+	wavReader, err := wav.OpenWav(filePath)
+	if err == nil && wavReader.Channels == 1 {
+		return wavReader, func() { wavReader.Close() }, nil
+	}
+	if wavReader != nil {
+		wavReader.Close()
+	}
+
+	// Not a mono 16-bit WAV file: convert it first
+	wavFilePath, err := wav.ReformatWAV(filePath, 1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error converting to WAV: %v", err)
+	}
+
+	wavReader, err = wav.OpenWav(wavFilePath)
+	if err != nil {
+		os.Remove(wavFilePath)
+		return nil, nil, fmt.Errorf("error reading WAV file: %v", err)
+	}
+
+	return wavReader, func() {
+		wavReader.Close()
+		os.Remove(wavFilePath)
+	}, nil
+}
+
+func scan(filePath string, opts shazam.ScanOptions, format shazam.TimelineFormat, outputPath string) {
+	wavReader, closeWav, err := openMonoWav(filePath)
+	if err != nil {
+		yellow.Println(err)
+		return
+	}
+	defer closeWav()
+
+	// A first pass measures the loudness the recording is leveled with
+	startTime := time.Now()
+	loudness, err := shazam.MeasureLoudnessPCM(context.Background(), wavReader, wavReader.SampleRate)
+	if err != nil {
+		yellow.Println("Error measuring loudness:", err)
+		return
+	}
+	if err := wavReader.Rewind(); err != nil {
+		yellow.Println(err)
+		return
+	}
+
+	segments, err := shazam.ScanPCM(context.Background(), wavReader, wavReader.SampleRate, loudness.Leveler(), opts)
+	if err != nil {
+		yellow.Println("Error scanning recording:", err)
+		return
+	}
+
+	output := os.Stdout
+	if outputPath != "" {
+		output, err = os.Create(outputPath)
+		if err != nil {
+			yellow.Println("Error creating output file:", err)
+			return
+		}
+		defer output.Close()
+	}
+
+	if err := shazam.WriteTimeline(output, segments, format, filePath); err != nil {
+		yellow.Println("Error writing timeline:", err)
+		return
+	}
+
+	if outputPath != "" {
+		fmt.Printf("Found %d segments in %s, timeline written to %s\n", len(segments), time.Since(startTime), outputPath)
+	}
+}
+
+func dedupe(threshold float64, remove, merge bool) {
+	ctx := context.Background()
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		yellow.Println("Error connecting to DB:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	duplicates, err := shazam.FindDuplicates(ctx, dbClient, threshold, func(done, total int) {
+		fmt.Printf("\rChecked %d/%d songs", done, total)
+	})
+	fmt.Println()
+	if err != nil {
+		yellow.Println("Error finding duplicates:", err)
+		return
+	}
+
+	if len(duplicates) == 0 {
+		fmt.Println("No duplicates found.")
+		return
+	}
+
+	fmt.Printf("Found %d duplicate pairs:\n", len(duplicates))
+	removed := map[uint32]bool{}
+	for _, duplicate := range duplicates {
+		keep, drop, offsetMs := duplicate.Keeper()
+		fmt.Printf("\t- '%s' by %s (%d) <-> '%s' by %s (%d), aligned: %d (%.1f%%), offset: %s\n",
+			duplicate.Song.Title, duplicate.Song.Artist, duplicate.Song.ID,
+			duplicate.Other.Title, duplicate.Other.Artist, duplicate.Other.ID,
+			duplicate.AlignedHits, duplicate.AlignedRatio*100, time.Duration(duplicate.OffsetMs)*time.Millisecond)
+
+		if (!remove && !merge) || removed[keep.ID] || removed[drop.ID] {
+			continue
+		}
+
+		if merge {
+			err = shazam.MergeSongs(ctx, dbClient, keep.ID, drop.ID, offsetMs)
+		} else {
+			err = dbClient.DeleteSongByID(ctx, drop.ID)
+		}
+		if err != nil {
+			yellow.Printf("\t  Error removing '%s': %v\n", drop.Title, err)
+			continue
+		}
+
+		removed[drop.ID] = true
+		fmt.Printf("\t  Kept '%s', removed '%s'\n", keep.Title, drop.Title)
+	}
+}
+
+func visualize(filePath string, start, end float64, opts shazam.VisualizeOptions, preprocess string, outputPath string) {
+	samples, sampleRate, err := readMonoSamples(filePath)
+	if err != nil {
+		yellow.Println(err)
+		return
+	}
+
+	// Keep the requested time range only
+	from := min(int(start*float64(sampleRate)), len(samples))
+	to := len(samples)
+	if end > 0 {
+		to = min(int(end*float64(sampleRate)), len(samples))
+	}
+	if from >= to {
+		yellow.Println("Error: the time range contains no audio")
+		return
+	}
+	samples = samples[from:to]
+	opts.TimeOffset = float64(from) / float64(sampleRate)
+
+	chain, err := shazam.ParsePreprocessChain(preprocess)
+	if err != nil {
+		yellow.Println("Error parsing preprocessing chain:", err)
+		return
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		yellow.Println("Error connecting to DB:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	config, err := shazam.QueryConfig(context.Background(), dbClient)
+	if err != nil {
+		yellow.Println("Error loading fingerprint config:", err)
+		return
+	}
+
+	spectrogram, err := shazam.PreprocessedSpectrogram(samples, sampleRate, config, chain)
+	if err != nil {
+		yellow.Println("Error computing spectrogram:", err)
+		return
+	}
+
+	img, err := shazam.RenderSpectrogram(spectrogram, shazam.ExtractPeaks(spectrogram, config), config, opts)
+	if err != nil {
+		yellow.Println("Error rendering spectrogram:", err)
+		return
+	}
+
+	if err := shazam.SavePNG(img, outputPath); err != nil {
+		yellow.Println("Error saving image:", err)
+		return
+	}
+
+	fmt.Printf("Spectrogram written to %s\n", outputPath)
+}
+
+func bench(opts shazam.BenchOptions, jsonPath string) {
+	var tracks []shazam.BenchTrack
+	err := filepath.Walk(SONGS_DIR, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		metadata, err := wav.GetMetadata(filePath)
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", filePath, err)
+			return nil
+		}
+		tags := metadata.Format.Tags
+		if tags["title"] == "" || tags["artist"] == "" {
+			fmt.Printf("Skipping %s: no title or artist in metadata\n", filePath)
+			return nil
+		}
+
+		tracks = append(tracks, shazam.BenchTrack{
+			Title:  tags["title"],
+			Artist: tags["artist"],
+			Load:   func() ([]float64, int, error) { return readMonoSamples(filePath) },
+		})
+		return nil
+	})
+	if err != nil {
+		yellow.Println("Error listing songs:", err)
+		return
+	}
+	if len(tracks) == 0 {
+		yellow.Println("No songs found in", SONGS_DIR)
+		return
+	}
+
+	report, err := shazam.Bench(context.Background(), tracks, opts, func(done, total int) {
+		fmt.Printf("\rBenchmarked %d/%d songs", done, total)
+	})
+	fmt.Println()
+	if err != nil {
+		yellow.Println("Error running benchmark:", err)
+		return
+	}
+
+	for _, skipped := range report.Skipped {
+		fmt.Println("Skipped", skipped)
+	}
+	if err := shazam.WriteBenchTable(os.Stdout, report); err != nil {
+		yellow.Println("Error writing results:", err)
+		return
+	}
+
+	if jsonPath != "" {
+		file, err := os.Create(jsonPath)
+		if err != nil {
+			yellow.Println("Error creating output file:", err)
+			return
+		}
+		defer file.Close()
+
+		if err := shazam.WriteBenchJSON(file, report); err != nil {
+			yellow.Println("Error writing results:", err)
+			return
+		}
+		fmt.Printf("\nResults written to %s\n", jsonPath)
+	}
+}
+
+// readMonoSamples reads all the samples of an audio file, as mono.
+func readMonoSamples(filePath string) ([]float64, int, error) {
+	wavReader, closeWav, err := openMonoWav(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeWav()
+
+	data, err := io.ReadAll(wavReader)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading WAV file: %v", err)
+	}
+
+	samples, err := wav.WavBytesToSamples(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error converting to samples: %v", err)
+	}
+
+	return samples, wavReader.SampleRate, nil
+}
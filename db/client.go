@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"song-recognition/models"
 	"song-recognition/utils"
@@ -8,24 +9,34 @@ import (
 
 type DBClient interface {
 	Close() error
-	StoreFingerprints(fingerprints map[uint32]models.Couple) error
-	GetCouples(addresses []uint32) (map[uint32][]models.Couple, error)
-	TotalSongs() (int, error)
-	RegisterSong(songTitle, songArtist, ytID string) (uint32, error)
-	GetSong(filterKey string, value interface{}) (Song, bool, error)
-	GetSongByID(songID uint32) (Song, bool, error)
-	GetSongByYTID(ytID string) (Song, bool, error)
-	GetSongByKey(key string) (Song, bool, error)
-	GetAllSongs() ([]SongWithID, error)
-	DeleteSongByID(songID uint32) error
-	DeleteCollection(collectionName string) error
-	GetSongByTitle(title string) (Song, bool, error)
+	StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error
+	GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error)
+	GetSongFingerprints(ctx context.Context, songID uint32) (map[uint32][]models.Couple, error)
+	TotalSongs(ctx context.Context) (int, error)
+	HasFingerprints(ctx context.Context) (bool, error)
+	RegisterSong(ctx context.Context, songTitle, songArtist, ytID string) (uint32, error)
+	GetSong(ctx context.Context, filterKey string, value interface{}) (Song, bool, error)
+	GetSongByID(ctx context.Context, songID uint32) (Song, bool, error)
+	GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error)
+	GetSongByKey(ctx context.Context, key string) (Song, bool, error)
+	GetAllSongs(ctx context.Context) ([]SongWithID, error)
+	DeleteSongByID(ctx context.Context, songID uint32) error
+	DeleteCollection(ctx context.Context, collectionName string) error
+	GetSongByTitle(ctx context.Context, title string) (Song, bool, error)
+	GetFingerprintConfig(ctx context.Context) (models.FingerprintConfig, bool, error)
+	SetFingerprintConfig(ctx context.Context, config models.FingerprintConfig) error
+	StoreChroma(ctx context.Context, songID uint32, chroma models.Chroma) error
+	GetAllChroma(ctx context.Context) (map[uint32]models.Chroma, error)
+	StoreEmbedding(ctx context.Context, songID uint32, embedding models.Embedding) error
+	GetAllEmbeddings(ctx context.Context) (map[uint32]models.Embedding, error)
+	SetSongMetadata(ctx context.Context, songID uint32, metadata models.SongMetadata) error
 }
 
 type Song struct {
 	Title     string
 	Artist    string
 	YouTubeID string
+	models.SongMetadata
 }
 
 type SongWithID struct {
@@ -33,8 +44,14 @@ type SongWithID struct {
 	Title     string `json:"title"`
 	Artist    string `json:"artist"`
 	YouTubeID string `json:"youtubeId"`
+	models.SongMetadata
 }
 
+// couplesBatchSize is the number of addresses GetCouples looks up per
+// query, below the default limit of 999 bound parameters of older SQLite
+// builds.
+const couplesBatchSize = 500
+
 var DBtype = utils.GetEnv("DB_TYPE", "sqlite") // Can be "sqlite" or "mongo"
 
 func NewDBClient() (DBClient, error) {
@@ -34,22 +34,27 @@ func (db *MongoClient) Close() error {
 	return nil
 }
 
-func (db *MongoClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+func (db *MongoClient) StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
 	collection := db.client.Database("song-recognition").Collection("fingerprints")
 
-	for address, couple := range fingerprints {
+	for address, couples := range fingerprints {
+		docCouples := make(bson.A, 0, len(couples))
+		for _, couple := range couples {
+			docCouples = append(docCouples, bson.M{
+				"anchorTimeMs": couple.AnchorTimeMs,
+				"songID":       couple.SongID,
+			})
+		}
+
 		filter := bson.M{"_id": address}
 		update := bson.M{
 			"$push": bson.M{
-				"couples": bson.M{
-					"anchorTimeMs": couple.AnchorTimeMs,
-					"songID":       couple.SongID,
-				},
+				"couples": bson.M{"$each": docCouples},
 			},
 		}
 		opts := options.Update().SetUpsert(true)
 
-		_, err := collection.UpdateOne(context.Background(), filter, update, opts)
+		_, err := collection.UpdateOne(ctx, filter, update, opts)
 		if err != nil {
 			return fmt.Errorf("error upserting document: %s", err)
 		}
@@ -58,24 +63,94 @@ func (db *MongoClient) StoreFingerprints(fingerprints map[uint32]models.Couple)
 	return nil
 }
 
-func (db *MongoClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+// GetCouples looks the addresses up in batches of couplesBatchSize, so that
+// the many addresses of a speed-tolerant query cost a few round trips rather
+// than one each.
+func (db *MongoClient) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
 	collection := db.client.Database("song-recognition").Collection("fingerprints")
 
 	couples := make(map[uint32][]models.Couple)
 
-	for _, address := range addresses {
-		// Find the document corresponding to the address
-		var result bson.M
-		err := collection.FindOne(context.Background(), bson.M{"_id": address}).Decode(&result)
+	for start := 0; start < len(addresses); start += couplesBatchSize {
+		batch := addresses[start:min(start+couplesBatchSize, len(addresses))]
+
+		cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": batch}})
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				continue
+			return nil, fmt.Errorf("error retrieving documents for addresses: %s", err)
+		}
+
+		for cursor.Next(ctx) {
+			var result bson.M
+			if err := cursor.Decode(&result); err != nil {
+				cursor.Close(ctx)
+				return nil, fmt.Errorf("error decoding document: %s", err)
 			}
-			return nil, fmt.Errorf("error retrieving document for address %d: %s", address, err)
+
+			address, docCouples, err := decodeAddressCouples(result)
+			if err != nil {
+				cursor.Close(ctx)
+				return nil, err
+			}
+			couples[address] = docCouples
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error iterating documents: %s", err)
+		}
+	}
+
+	return couples, nil
+}
+
+// decodeAddressCouples extracts the address and the couples of a document of
+// the fingerprints collection.
+func decodeAddressCouples(result bson.M) (uint32, []models.Couple, error) {
+	address, ok := result["_id"].(int64)
+	if !ok {
+		return 0, nil, fmt.Errorf("invalid address in document: %v", result["_id"])
+	}
+
+	// Extract couples from the document
+	var docCouples []models.Couple
+	couplesList, ok := result["couples"].(primitive.A)
+	if !ok {
+		return 0, nil, fmt.Errorf("couples field in document for address %d is not valid", address)
+	}
+
+	for _, item := range couplesList {
+		itemMap, ok := item.(primitive.M)
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid couple format in document for address %d", address)
 		}
 
-		// Extract couples from the document and append them to the couples map
-		var docCouples []models.Couple
+		couple := models.Couple{
+			AnchorTimeMs: uint32(itemMap["anchorTimeMs"].(int64)),
+			SongID:       uint32(itemMap["songID"].(int64)),
+		}
+		docCouples = append(docCouples, couple)
+	}
+
+	return uint32(address), docCouples, nil
+}
+
+func (db *MongoClient) GetSongFingerprints(ctx context.Context, songID uint32) (map[uint32][]models.Couple, error) {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	cursor, err := collection.Find(ctx, bson.M{"couples.songID": songID})
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer cursor.Close(ctx)
+
+	fingerprints := make(map[uint32][]models.Couple)
+	for cursor.Next(ctx) {
+		var result bson.M
+		if err := cursor.Decode(&result); err != nil {
+			return nil, fmt.Errorf("error decoding document: %s", err)
+		}
+
+		address := uint32(result["_id"].(int64))
 		couplesList, ok := result["couples"].(primitive.A)
 		if !ok {
 			return nil, fmt.Errorf("couples field in document for address %d is not valid", address)
@@ -87,21 +162,26 @@ func (db *MongoClient) GetCouples(addresses []uint32) (map[uint32][]models.Coupl
 				return nil, fmt.Errorf("invalid couple format in document for address %d", address)
 			}
 
+			if uint32(itemMap["songID"].(int64)) != songID {
+				continue
+			}
 			couple := models.Couple{
 				AnchorTimeMs: uint32(itemMap["anchorTimeMs"].(int64)),
-				SongID:       uint32(itemMap["songID"].(int64)),
+				SongID:       songID,
 			}
-			docCouples = append(docCouples, couple)
+			fingerprints[address] = append(fingerprints[address], couple)
 		}
-		couples[address] = docCouples
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating fingerprints: %s", err)
 	}
 
-	return couples, nil
+	return fingerprints, nil
 }
 
-func (db *MongoClient) TotalSongs() (int, error) {
+func (db *MongoClient) TotalSongs(ctx context.Context) (int, error) {
 	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
-	total, err := existingSongsCollection.CountDocuments(context.Background(), bson.D{})
+	total, err := existingSongsCollection.CountDocuments(ctx, bson.D{})
 	if err != nil {
 		return 0, err
 	}
@@ -109,7 +189,18 @@ func (db *MongoClient) TotalSongs() (int, error) {
 	return int(total), nil
 }
 
-func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
+// HasFingerprints reports whether any fingerprint is stored
+func (db *MongoClient) HasFingerprints(ctx context.Context) (bool, error) {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	total, err := collection.CountDocuments(ctx, bson.D{}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("error checking fingerprints: %v", err)
+	}
+
+	return total > 0, nil
+}
+
+func (db *MongoClient) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string) (uint32, error) {
 	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
 
 	// Create a compound unique index on ytID and key, if it doesn't already exist
@@ -117,7 +208,7 @@ func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32,
 		Keys:    bson.D{{"ytID", 1}, {"key", 1}},
 		Options: options.Index().SetUnique(true),
 	}
-	_, err := existingSongsCollection.Indexes().CreateOne(context.Background(), indexModel)
+	_, err := existingSongsCollection.Indexes().CreateOne(ctx, indexModel)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create unique index: %v", err)
 	}
@@ -125,7 +216,7 @@ func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32,
 	// Attempt to insert the song with ytID and key
 	songID := utils.GenerateUniqueID()
 	key := utils.GenerateSongKey(songTitle, songArtist)
-	_, err = existingSongsCollection.InsertOne(context.Background(), bson.M{"_id": songID, "key": key, "ytID": ytID})
+	_, err = existingSongsCollection.InsertOne(ctx, bson.M{"_id": songID, "key": key, "ytID": ytID})
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
 			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
@@ -139,17 +230,21 @@ func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32,
 
 var mongofilterKeys = "_id | ytID | key"
 
-func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, songExists bool, e error) {
+func (db *MongoClient) GetSong(ctx context.Context, filterKey string, value interface{}) (s Song, songExists bool, e error) {
 	if !strings.Contains(mongofilterKeys, filterKey) {
 		return Song{}, false, errors.New("invalid filter key")
 	}
 
 	songsCollection := db.client.Database("song-recognition").Collection("songs")
-	var song bson.M
+	var song struct {
+		YtID     string              `bson:"ytID"`
+		Key      string              `bson:"key"`
+		Metadata models.SongMetadata `bson:"metadata"`
+	}
 
 	filter := bson.M{filterKey: value}
 
-	err := songsCollection.FindOne(context.Background(), filter).Decode(&song)
+	err := songsCollection.FindOne(ctx, filter).Decode(&song)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return Song{}, false, nil
@@ -157,45 +252,190 @@ func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, son
 		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
 	}
 
-	ytID := song["ytID"].(string)
-	title := strings.Split(song["key"].(string), "---")[0]
-	artist := strings.Split(song["key"].(string), "---")[1]
+	title := strings.Split(song.Key, "---")[0]
+	artist := strings.Split(song.Key, "---")[1]
 
-	songInstance := Song{title, artist, ytID}
+	songInstance := Song{Title: title, Artist: artist, YouTubeID: song.YtID, SongMetadata: song.Metadata}
 
 	return songInstance, true, nil
 }
 
-func (db *MongoClient) GetSongByID(songID uint32) (Song, bool, error) {
-	return db.GetSong("_id", songID)
+func (db *MongoClient) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, "_id", songID)
 }
 
-func (db *MongoClient) GetSongByYTID(ytID string) (Song, bool, error) {
-	return db.GetSong("ytID", ytID)
+func (db *MongoClient) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, "ytID", ytID)
 }
 
-func (db *MongoClient) GetSongByKey(key string) (Song, bool, error) {
-	return db.GetSong("key", key)
+func (db *MongoClient) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, "key", key)
 }
 
-func (db *MongoClient) DeleteSongByID(songID uint32) error {
+func (db *MongoClient) DeleteSongByID(ctx context.Context, songID uint32) error {
+	fingerprintsCollection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	pull := bson.M{"$pull": bson.M{"couples": bson.M{"songID": songID}}}
+	_, err := fingerprintsCollection.UpdateMany(ctx, bson.M{"couples.songID": songID}, pull)
+	if err != nil {
+		return fmt.Errorf("failed to delete song fingerprints: %v", err)
+	}
+
 	songsCollection := db.client.Database("song-recognition").Collection("songs")
 
 	filter := bson.M{"_id": songID}
 
-	_, err := songsCollection.DeleteOne(context.Background(), filter)
+	_, err = songsCollection.DeleteOne(ctx, filter)
 	if err != nil {
 		return fmt.Errorf("failed to delete song: %v", err)
 	}
 
+	chromaCollection := db.client.Database("song-recognition").Collection("chroma")
+	_, err = chromaCollection.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to delete song chroma: %v", err)
+	}
+
+	embeddingsCollection := db.client.Database("song-recognition").Collection("embeddings")
+	_, err = embeddingsCollection.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to delete song embedding: %v", err)
+	}
+
 	return nil
 }
 
-func (db *MongoClient) DeleteCollection(collectionName string) error {
+func (db *MongoClient) DeleteCollection(ctx context.Context, collectionName string) error {
 	collection := db.client.Database("song-recognition").Collection(collectionName)
-	err := collection.Drop(context.Background())
+	err := collection.Drop(ctx)
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
 	return nil
 }
+
+func (db *MongoClient) GetFingerprintConfig(ctx context.Context) (models.FingerprintConfig, bool, error) {
+	collection := db.client.Database("song-recognition").Collection("fingerprint_config")
+
+	var doc struct {
+		Config models.FingerprintConfig `bson:"config"`
+	}
+	err := collection.FindOne(ctx, bson.M{"_id": 1}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.FingerprintConfig{}, false, nil
+		}
+		return models.FingerprintConfig{}, false, fmt.Errorf("failed to retrieve fingerprint config: %v", err)
+	}
+
+	return doc.Config, true, nil
+}
+
+func (db *MongoClient) SetFingerprintConfig(ctx context.Context, config models.FingerprintConfig) error {
+	collection := db.client.Database("song-recognition").Collection("fingerprint_config")
+
+	filter := bson.M{"_id": 1}
+	update := bson.M{"$set": bson.M{"config": config}}
+	opts := options.Update().SetUpsert(true)
+
+	_, err := collection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store fingerprint config: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoClient) StoreChroma(ctx context.Context, songID uint32, chroma models.Chroma) error {
+	collection := db.client.Database("song-recognition").Collection("chroma")
+
+	filter := bson.M{"_id": songID}
+	update := bson.M{"$set": bson.M{"chroma": chroma}}
+	opts := options.Update().SetUpsert(true)
+
+	_, err := collection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store chroma: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoClient) GetAllChroma(ctx context.Context) (map[uint32]models.Chroma, error) {
+	collection := db.client.Database("song-recognition").Collection("chroma")
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chroma: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	summaries := make(map[uint32]models.Chroma)
+	for cursor.Next(ctx) {
+		var doc struct {
+			SongID uint32        `bson:"_id"`
+			Chroma models.Chroma `bson:"chroma"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode chroma: %v", err)
+		}
+		summaries[doc.SongID] = doc.Chroma
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %v", err)
+	}
+
+	return summaries, nil
+}
+
+func (db *MongoClient) StoreEmbedding(ctx context.Context, songID uint32, embedding models.Embedding) error {
+	collection := db.client.Database("song-recognition").Collection("embeddings")
+
+	filter := bson.M{"_id": songID}
+	update := bson.M{"$set": bson.M{"embedding": embedding}}
+	opts := options.Update().SetUpsert(true)
+
+	_, err := collection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store embedding: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoClient) GetAllEmbeddings(ctx context.Context) (map[uint32]models.Embedding, error) {
+	collection := db.client.Database("song-recognition").Collection("embeddings")
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query embeddings: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	embeddings := make(map[uint32]models.Embedding)
+	for cursor.Next(ctx) {
+		var doc struct {
+			SongID    uint32           `bson:"_id"`
+			Embedding models.Embedding `bson:"embedding"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode embedding: %v", err)
+		}
+		embeddings[doc.SongID] = doc.Embedding
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %v", err)
+	}
+
+	return embeddings, nil
+}
+
+func (db *MongoClient) SetSongMetadata(ctx context.Context, songID uint32, metadata models.SongMetadata) error {
+	collection := db.client.Database("song-recognition").Collection("songs")
+
+	filter := bson.M{"_id": songID}
+	update := bson.M{"$set": bson.M{"metadata": metadata}}
+
+	_, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to store song metadata: %v", err)
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"song-recognition/models"
 	"song-recognition/utils"
@@ -47,6 +49,38 @@ func createTables(db *sql.DB) error {
         songID INTEGER NOT NULL,
         PRIMARY KEY (address, anchorTimeMs, songID)
     );
+    `
+
+	createFingerprintsSongIndex := `
+    CREATE INDEX IF NOT EXISTS fingerprints_songID ON fingerprints (songID);
+    `
+
+	createFingerprintConfigTable := `
+    CREATE TABLE IF NOT EXISTS fingerprint_config (
+        id INTEGER PRIMARY KEY CHECK (id = 1),
+        config TEXT NOT NULL
+    );
+    `
+
+	createChromaTable := `
+    CREATE TABLE IF NOT EXISTS chroma (
+        songID INTEGER PRIMARY KEY,
+        chroma TEXT NOT NULL
+    );
+    `
+
+	createSongMetadataTable := `
+    CREATE TABLE IF NOT EXISTS song_metadata (
+        songID INTEGER PRIMARY KEY,
+        metadata TEXT NOT NULL
+    );
+    `
+
+	createEmbeddingsTable := `
+    CREATE TABLE IF NOT EXISTS embeddings (
+        songID INTEGER PRIMARY KEY,
+        embedding TEXT NOT NULL
+    );
     `
 
 	_, err := db.Exec(createSongsTable)
@@ -59,6 +93,31 @@ func createTables(db *sql.DB) error {
 		return fmt.Errorf("error creating fingerprints table: %s", err)
 	}
 
+	_, err = db.Exec(createFingerprintsSongIndex)
+	if err != nil {
+		return fmt.Errorf("error creating fingerprints index: %s", err)
+	}
+
+	_, err = db.Exec(createFingerprintConfigTable)
+	if err != nil {
+		return fmt.Errorf("error creating fingerprint_config table: %s", err)
+	}
+
+	_, err = db.Exec(createChromaTable)
+	if err != nil {
+		return fmt.Errorf("error creating chroma table: %s", err)
+	}
+
+	_, err = db.Exec(createEmbeddingsTable)
+	if err != nil {
+		return fmt.Errorf("error creating embeddings table: %s", err)
+	}
+
+	_, err = db.Exec(createSongMetadataTable)
+	if err != nil {
+		return fmt.Errorf("error creating song_metadata table: %s", err)
+	}
+
 	return nil
 }
 
@@ -69,69 +128,126 @@ func (db *SQLiteClient) Close() error {
 	return nil
 }
 
-func (db *SQLiteClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
-	tx, err := db.db.Begin()
+func (db *SQLiteClient) StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("error starting transaction: %s", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("error preparing statement: %s", err)
 	}
 	defer stmt.Close()
 
-	for address, couple := range fingerprints {
-		if _, err := stmt.Exec(address, couple.AnchorTimeMs, couple.SongID); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("error executing statement: %s", err)
+	for address, couples := range fingerprints {
+		for _, couple := range couples {
+			if _, err := stmt.ExecContext(ctx, address, couple.AnchorTimeMs, couple.SongID); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error executing statement: %s", err)
+			}
 		}
 	}
 
 	return tx.Commit()
 }
 
-func (db *SQLiteClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+// GetCouples looks the addresses up in batches of couplesBatchSize, so that
+// the many addresses of a speed-tolerant query cost a few queries rather
+// than one each.
+func (db *SQLiteClient) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
 	couples := make(map[uint32][]models.Couple)
 
-	for _, address := range addresses {
-		rows, err := db.db.Query("SELECT anchorTimeMs, songID FROM fingerprints WHERE address = ?", address)
-		if err != nil {
-			return nil, fmt.Errorf("error querying database: %s", err)
+	for start := 0; start < len(addresses); start += couplesBatchSize {
+		batch := addresses[start:min(start+couplesBatchSize, len(addresses))]
+
+		args := make([]interface{}, len(batch))
+		for i, address := range batch {
+			args[i] = address
 		}
-		defer rows.Close()
+		query := "SELECT address, anchorTimeMs, songID FROM fingerprints WHERE address IN (?" + strings.Repeat(", ?", len(batch)-1) + ")"
 
-		var docCouples []models.Couple
-		for rows.Next() {
-			var couple models.Couple
-			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID); err != nil {
-				return nil, fmt.Errorf("error scanning row: %s", err)
-			}
-			docCouples = append(docCouples, couple)
+		if err := db.queryCouples(ctx, couples, query, args...); err != nil {
+			return nil, err
 		}
-		couples[address] = docCouples
 	}
 
 	return couples, nil
 }
 
-func (db *SQLiteClient) TotalSongs() (int, error) {
+// queryCouples adds the couples selected by query, as address, anchor time
+// and song ID rows, to couples.
+func (db *SQLiteClient) queryCouples(ctx context.Context, couples map[uint32][]models.Couple, query string, args ...interface{}) error {
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var couple models.Couple
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		couples[address] = append(couples[address], couple)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %s", err)
+	}
+	return nil
+}
+
+func (db *SQLiteClient) GetSongFingerprints(ctx context.Context, songID uint32) (map[uint32][]models.Couple, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT address, anchorTimeMs FROM fingerprints WHERE songID = ?", songID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	fingerprints := make(map[uint32][]models.Couple)
+	for rows.Next() {
+		var address uint32
+		couple := models.Couple{SongID: songID}
+		if err := rows.Scan(&address, &couple.AnchorTimeMs); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		fingerprints[address] = append(fingerprints[address], couple)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %s", err)
+	}
+
+	return fingerprints, nil
+}
+
+func (db *SQLiteClient) TotalSongs(ctx context.Context) (int, error) {
 	var count int
-	err := db.db.QueryRow("SELECT COUNT(*) FROM songs").Scan(&count)
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("error counting songs: %s", err)
 	}
 	return count, nil
 }
 
-func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
-	tx, err := db.db.Begin()
+// HasFingerprints reports whether any fingerprint is stored
+func (db *SQLiteClient) HasFingerprints(ctx context.Context) (bool, error) {
+	var exists bool
+	err := db.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM fingerprints)").Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking fingerprints: %s", err)
+	}
+	return exists, nil
+}
+
+func (db *SQLiteClient) RegisterSong(ctx context.Context, songTitle, songArtist, ytID string) (uint32, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, fmt.Errorf("error starting transaction: %s", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO songs (id, title, artist, ytID, key) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO songs (id, title, artist, ytID, key) VALUES (?, ?, ?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return 0, fmt.Errorf("error preparing statement: %s", err)
@@ -140,7 +256,7 @@ func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32
 
 	songID := utils.GenerateUniqueID()
 	songKey := utils.GenerateSongKey(songTitle, songArtist)
-	if _, err := stmt.Exec(songID, songTitle, songArtist, ytID, songKey); err != nil {
+	if _, err := stmt.ExecContext(ctx, songID, songTitle, songArtist, ytID, songKey); err != nil {
 		tx.Rollback()
 		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
 			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
@@ -154,18 +270,19 @@ func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32
 var sqlitefilterKeys = "id | ytID | key"
 
 // GetSong retrieves a song by filter key
-func (s *SQLiteClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+func (s *SQLiteClient) GetSong(ctx context.Context, filterKey string, value interface{}) (Song, bool, error) {
 
 	if !strings.Contains(sqlitefilterKeys, filterKey) {
 		return Song{}, false, fmt.Errorf("invalid filter key")
 	}
 
-	query := fmt.Sprintf("SELECT title, artist, ytID FROM songs WHERE %s = ?", filterKey)
+	query := fmt.Sprintf("SELECT s.title, s.artist, s.ytID, m.metadata FROM songs s LEFT JOIN song_metadata m ON m.songID = s.id WHERE s.%s = ?", filterKey)
 
-	row := s.db.QueryRow(query, value)
+	row := s.db.QueryRowContext(ctx, query, value)
 
 	var song Song
-	err := row.Scan(&song.Title, &song.Artist, &song.YouTubeID)
+	var metadata sql.NullString
+	err := row.Scan(&song.Title, &song.Artist, &song.YouTubeID, &metadata)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Song{}, false, nil
@@ -173,24 +290,49 @@ func (s *SQLiteClient) GetSong(filterKey string, value interface{}) (Song, bool,
 		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
 	}
 
+	song.SongMetadata, err = decodeSongMetadata(metadata)
+	if err != nil {
+		return Song{}, false, err
+	}
+
 	return song, true, nil
 }
 
-func (db *SQLiteClient) GetSongByID(songID uint32) (Song, bool, error) {
-	return db.GetSong("id", songID)
+func (db *SQLiteClient) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, "id", songID)
 }
 
-func (db *SQLiteClient) GetSongByYTID(ytID string) (Song, bool, error) {
-	return db.GetSong("ytID", ytID)
+func (db *SQLiteClient) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	return db.GetSong(ctx, "ytID", ytID)
 }
 
-func (db *SQLiteClient) GetSongByKey(key string) (Song, bool, error) {
-	return db.GetSong("key", key)
+func (db *SQLiteClient) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, "key", key)
 }
 
-// DeleteSongByID deletes a song by ID
-func (db *SQLiteClient) DeleteSongByID(songID uint32) error {
-	_, err := db.db.Exec("DELETE FROM songs WHERE id = ?", songID)
+// DeleteSongByID deletes a song, its fingerprints, chroma, embedding and metadata by ID
+func (db *SQLiteClient) DeleteSongByID(ctx context.Context, songID uint32) error {
+	_, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE songID = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete song fingerprints: %v", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "DELETE FROM chroma WHERE songID = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete song chroma: %v", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "DELETE FROM embeddings WHERE songID = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete song embedding: %v", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "DELETE FROM song_metadata WHERE songID = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete song metadata: %v", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "DELETE FROM songs WHERE id = ?", songID)
 	if err != nil {
 		return fmt.Errorf("failed to delete song: %v", err)
 	}
@@ -198,20 +340,21 @@ func (db *SQLiteClient) DeleteSongByID(songID uint32) error {
 }
 
 // DeleteCollection deletes a collection (table) from the database
-func (db *SQLiteClient) DeleteCollection(collectionName string) error {
-	_, err := db.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", collectionName))
+func (db *SQLiteClient) DeleteCollection(ctx context.Context, collectionName string) error {
+	_, err := db.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", collectionName))
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
 	return nil
 }
 
-func (db *SQLiteClient) GetSongByTitle(title string) (Song, bool, error) {
-	query := "SELECT title, artist, ytID FROM songs WHERE title LIKE ?"
-	row := db.db.QueryRow(query, "%"+title+"%") // Use wildcards for partial match
+func (db *SQLiteClient) GetSongByTitle(ctx context.Context, title string) (Song, bool, error) {
+	query := "SELECT s.title, s.artist, s.ytID, m.metadata FROM songs s LEFT JOIN song_metadata m ON m.songID = s.id WHERE s.title LIKE ?"
+	row := db.db.QueryRowContext(ctx, query, "%"+title+"%") // Use wildcards for partial match
 
 	var song Song
-	err := row.Scan(&song.Title, &song.Artist, &song.YouTubeID)
+	var metadata sql.NullString
+	err := row.Scan(&song.Title, &song.Artist, &song.YouTubeID, &metadata)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Song{}, false, nil
@@ -219,13 +362,18 @@ func (db *SQLiteClient) GetSongByTitle(title string) (Song, bool, error) {
 		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
 	}
 
+	song.SongMetadata, err = decodeSongMetadata(metadata)
+	if err != nil {
+		return Song{}, false, err
+	}
+
 	return song, true, nil
 }
 
 // GetAllSongs retrieves all songs from the database
-func (db *SQLiteClient) GetAllSongs() ([]SongWithID, error) {
-	query := "SELECT id, title, artist, ytID FROM songs ORDER BY title ASC"
-	rows, err := db.db.Query(query)
+func (db *SQLiteClient) GetAllSongs(ctx context.Context) ([]SongWithID, error) {
+	query := "SELECT s.id, s.title, s.artist, s.ytID, m.metadata FROM songs s LEFT JOIN song_metadata m ON m.songID = s.id ORDER BY s.title ASC"
+	rows, err := db.db.QueryContext(ctx, query)
 	if err != nil {
 		return []SongWithID{}, fmt.Errorf("failed to query songs: %s", err)
 	}
@@ -234,10 +382,15 @@ func (db *SQLiteClient) GetAllSongs() ([]SongWithID, error) {
 	var songs []SongWithID
 	for rows.Next() {
 		var song SongWithID
-		err := rows.Scan(&song.ID, &song.Title, &song.Artist, &song.YouTubeID)
+		var metadata sql.NullString
+		err := rows.Scan(&song.ID, &song.Title, &song.Artist, &song.YouTubeID, &metadata)
 		if err != nil {
 			return []SongWithID{}, fmt.Errorf("failed to scan song: %s", err)
 		}
+		song.SongMetadata, err = decodeSongMetadata(metadata)
+		if err != nil {
+			return []SongWithID{}, err
+		}
 		songs = append(songs, song)
 	}
 
@@ -248,3 +401,149 @@ func (db *SQLiteClient) GetAllSongs() ([]SongWithID, error) {
 
 	return songs, nil
 }
+
+// SetSongMetadata records the musical metadata of a song
+func (db *SQLiteClient) SetSongMetadata(ctx context.Context, songID uint32, metadata models.SongMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode song metadata: %s", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "INSERT OR REPLACE INTO song_metadata (songID, metadata) VALUES (?, ?)", songID, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to store song metadata: %s", err)
+	}
+	return nil
+}
+
+// decodeSongMetadata decodes the metadata column of a song, which is NULL
+// for songs indexed before metadata was recorded
+func decodeSongMetadata(data sql.NullString) (models.SongMetadata, error) {
+	var metadata models.SongMetadata
+	if !data.Valid {
+		return metadata, nil
+	}
+	if err := json.Unmarshal([]byte(data.String), &metadata); err != nil {
+		return models.SongMetadata{}, fmt.Errorf("failed to decode song metadata: %s", err)
+	}
+	return metadata, nil
+}
+
+// GetFingerprintConfig retrieves the fingerprint config the index was built with
+func (db *SQLiteClient) GetFingerprintConfig(ctx context.Context) (models.FingerprintConfig, bool, error) {
+	var data string
+	err := db.db.QueryRowContext(ctx, "SELECT config FROM fingerprint_config WHERE id = 1").Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.FingerprintConfig{}, false, nil
+		}
+		return models.FingerprintConfig{}, false, fmt.Errorf("failed to retrieve fingerprint config: %s", err)
+	}
+
+	var config models.FingerprintConfig
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return models.FingerprintConfig{}, false, fmt.Errorf("failed to decode fingerprint config: %s", err)
+	}
+
+	return config, true, nil
+}
+
+// SetFingerprintConfig records the fingerprint config the index is built with
+func (db *SQLiteClient) SetFingerprintConfig(ctx context.Context, config models.FingerprintConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode fingerprint config: %s", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "INSERT OR REPLACE INTO fingerprint_config (id, config) VALUES (1, ?)", string(data))
+	if err != nil {
+		return fmt.Errorf("failed to store fingerprint config: %s", err)
+	}
+	return nil
+}
+
+// StoreChroma records the chroma summary of a song
+func (db *SQLiteClient) StoreChroma(ctx context.Context, songID uint32, chroma models.Chroma) error {
+	data, err := json.Marshal(chroma)
+	if err != nil {
+		return fmt.Errorf("failed to encode chroma: %s", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "INSERT OR REPLACE INTO chroma (songID, chroma) VALUES (?, ?)", songID, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to store chroma: %s", err)
+	}
+	return nil
+}
+
+// GetAllChroma retrieves the chroma summaries of all songs, by song ID
+func (db *SQLiteClient) GetAllChroma(ctx context.Context) (map[uint32]models.Chroma, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT songID, chroma FROM chroma")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chroma: %s", err)
+	}
+	defer rows.Close()
+
+	summaries := make(map[uint32]models.Chroma)
+	for rows.Next() {
+		var songID uint32
+		var data string
+		if err := rows.Scan(&songID, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan chroma: %s", err)
+		}
+
+		var chroma models.Chroma
+		if err := json.Unmarshal([]byte(data), &chroma); err != nil {
+			return nil, fmt.Errorf("failed to decode chroma of song %d: %s", songID, err)
+		}
+		summaries[songID] = chroma
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %s", err)
+	}
+
+	return summaries, nil
+}
+
+// StoreEmbedding records the embedding of a song
+func (db *SQLiteClient) StoreEmbedding(ctx context.Context, songID uint32, embedding models.Embedding) error {
+	data, err := json.Marshal(embedding)
+	if err != nil {
+		return fmt.Errorf("failed to encode embedding: %s", err)
+	}
+
+	_, err = db.db.ExecContext(ctx, "INSERT OR REPLACE INTO embeddings (songID, embedding) VALUES (?, ?)", songID, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to store embedding: %s", err)
+	}
+	return nil
+}
+
+// GetAllEmbeddings retrieves the embeddings of all songs, by song ID
+func (db *SQLiteClient) GetAllEmbeddings(ctx context.Context) (map[uint32]models.Embedding, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT songID, embedding FROM embeddings")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query embeddings: %s", err)
+	}
+	defer rows.Close()
+
+	embeddings := make(map[uint32]models.Embedding)
+	for rows.Next() {
+		var songID uint32
+		var data string
+		if err := rows.Scan(&songID, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan embedding: %s", err)
+		}
+
+		var embedding models.Embedding
+		if err := json.Unmarshal([]byte(data), &embedding); err != nil {
+			return nil, fmt.Errorf("failed to decode embedding of song %d: %s", songID, err)
+		}
+		embeddings[songID] = embedding
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %s", err)
+	}
+
+	return embeddings, nil
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"song-recognition/shazam"
 	"song-recognition/utils"
+	"strconv"
+	"strings"
 
 	"github.com/mdobak/go-xerrors"
 )
@@ -30,18 +33,166 @@ func main() {
 	}
 
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'find', 'download', 'erase', 'save', or 'serve' subcommands")
+		fmt.Println("Expected 'find', 'scan', 'similar', 'show', 'dedupe', 'visualize', 'bench', 'download', 'erase', 'save', or 'serve' subcommands")
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "find":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: main.go find <path_to_wav_file>")
+		findCmd := flag.NewFlagSet("find", flag.ExitOnError)
+		speed := findCmd.Float64("speed", 0, "also match speed, tempo and pitch changes up to this fraction (e.g. 0.25)")
+		preprocess := findCmd.String("preprocess", "", "preprocessing chain applied to the query (e.g. dc,subtract,whiten)")
+		explain := findCmd.Int("explain", 0, "explain how the top N candidates were scored")
+		explainJSON := findCmd.String("explain-json", "", "write the full explanation to this JSON file")
+		plot := findCmd.String("plot", "", "write a query/reference time scatter plot of each explained candidate (e.g. plot.png gives plot-1.png, ...)")
+		cover := findCmd.Bool("cover", false, "rank songs by harmonic similarity instead, to recognize live and cover versions")
+		findCmd.Parse(os.Args[2:])
+		if findCmd.NArg() < 1 {
+			fmt.Println("Usage: main.go find [--cover | [--speed <fraction>] [--preprocess <stages>] [--explain <n> [--explain-json <file>] [--plot <file.png>]]] <path_to_wav_file>")
+			os.Exit(1)
+		}
+		filePath := findCmd.Arg(0)
+		if *cover {
+			findCovers(filePath)
+			break
+		}
+		find(filePath, *speed, *preprocess, explainOptions{top: *explain, jsonPath: *explainJSON, plotPath: *plot})
+	case "scan":
+		scanCmd := flag.NewFlagSet("scan", flag.ExitOnError)
+		window := scanCmd.Float64("window", 10, "length of the recognized windows, in seconds")
+		hop := scanCmd.Float64("hop", 5, "time between the starts of two windows, in seconds")
+		format := scanCmd.String("format", "json", "output format: json, csv or cue")
+		output := scanCmd.String("o", "", "output file (default stdout)")
+		speed := scanCmd.Float64("speed", 0, "also match speed, tempo and pitch changes up to this fraction (e.g. 0.25)")
+		preprocess := scanCmd.String("preprocess", "", "preprocessing chain applied to the recording (e.g. dc,subtract,whiten)")
+		scanCmd.Parse(os.Args[2:])
+		if scanCmd.NArg() < 1 {
+			fmt.Println("Usage: main.go scan [--window <s>] [--hop <s>] [--format json|csv|cue] [-o <file>] [--speed <fraction>] [--preprocess <stages>] <path_to_audio_file>")
 			os.Exit(1)
 		}
-		filePath := os.Args[2]
-		find(filePath)
+
+		timelineFormat, err := shazam.ParseTimelineFormat(*format)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		opts := shazam.DefaultScanOptions()
+		opts.Window, opts.Hop = *window, *hop
+		if *speed > 0 {
+			opts.Match.Transforms = shazam.SpeedGrid(*speed)
+		}
+		if *preprocess != "" {
+			opts.Match.Preprocess, err = shazam.ParsePreprocessChain(*preprocess)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		scan(scanCmd.Arg(0), opts, timelineFormat, *output)
+	case "similar":
+		similarCmd := flag.NewFlagSet("similar", flag.ExitOnError)
+		top := similarCmd.Int("n", 10, "number of songs listed")
+		similarCmd.Parse(os.Args[2:])
+		if similarCmd.NArg() < 1 {
+			fmt.Println("Usage: main.go similar [-n <count>] <song_id>")
+			os.Exit(1)
+		}
+		songID, err := strconv.ParseUint(similarCmd.Arg(0), 10, 32)
+		if err != nil {
+			fmt.Printf("Invalid song ID %q\n", similarCmd.Arg(0))
+			os.Exit(1)
+		}
+		similar(uint32(songID), *top)
+	case "show":
+		showCmd := flag.NewFlagSet("show", flag.ExitOnError)
+		all := showCmd.Bool("all", false, "list every song with its tempo and key")
+		showCmd.Parse(os.Args[2:])
+		if showCmd.NArg() < 1 && !*all {
+			fmt.Println("Usage: main.go show [--all | <song_id>]")
+			os.Exit(1)
+		}
+		var songID uint64
+		if !*all {
+			var err error
+			songID, err = strconv.ParseUint(showCmd.Arg(0), 10, 32)
+			if err != nil {
+				fmt.Printf("Invalid song ID %q\n", showCmd.Arg(0))
+				os.Exit(1)
+			}
+		}
+		show(uint32(songID), *all)
+	case "dedupe":
+		dedupeCmd := flag.NewFlagSet("dedupe", flag.ExitOnError)
+		threshold := dedupeCmd.Float64("threshold", 0.3, "minimum fraction of aligned hashes for two songs to be reported")
+		remove := dedupeCmd.Bool("delete", false, "delete the shorter song of every pair")
+		merge := dedupeCmd.Bool("merge", false, "move the fingerprints of the shorter song of every pair to the other one, then delete it")
+		dedupeCmd.Parse(os.Args[2:])
+		if *remove && *merge {
+			fmt.Println("Usage: main.go dedupe [--threshold <ratio>] [--delete | --merge]")
+			os.Exit(1)
+		}
+		dedupe(*threshold, *remove, *merge)
+	case "visualize":
+		visualizeCmd := flag.NewFlagSet("visualize", flag.ExitOnError)
+		start := visualizeCmd.Float64("start", 0, "start of the rendered range, in seconds")
+		end := visualizeCmd.Float64("end", 0, "end of the rendered range, in seconds (default end of file)")
+		pairs := visualizeCmd.Bool("pairs", false, "draw the anchor to target pairs hashed into fingerprints")
+		noPeaks := visualizeCmd.Bool("no-peaks", false, "do not overlay the detected peaks")
+		dynamicRange := visualizeCmd.Float64("range", 80, "dynamic range of the colour map, in dB")
+		preprocess := visualizeCmd.String("preprocess", "", "preprocessing chain applied before analysis (e.g. dc,subtract,whiten)")
+		output := visualizeCmd.String("o", "spectrogram.png", "output PNG file")
+		visualizeCmd.Parse(os.Args[2:])
+		if visualizeCmd.NArg() < 1 || *dynamicRange <= 0 {
+			fmt.Println("Usage: main.go visualize [--start <s>] [--end <s>] [--pairs] [--no-peaks] [--range <dB>] [--preprocess <stages>] [-o <file.png>] <path_to_audio_file>")
+			os.Exit(1)
+		}
+
+		opts := shazam.DefaultVisualizeOptions()
+		opts.DynamicRangeDb = *dynamicRange
+		opts.ShowPeaks = !*noPeaks
+		opts.ShowPairs = *pairs
+		visualize(visualizeCmd.Arg(0), *start, *end, opts, *preprocess, *output)
+	case "bench":
+		benchCmd := flag.NewFlagSet("bench", flag.ExitOnError)
+		clips := benchCmd.Int("clips", 3, "clips of each length cut from every song")
+		lengths := benchCmd.String("lengths", "5,10", "comma-separated clip lengths, in seconds")
+		degrade := benchCmd.String("degrade", "clean", "semicolon-separated conditions, each a comma-separated chain of noise:<snr dB>, gain:<dB>, lowpass:<Hz> and resample:<Hz>")
+		seed := benchCmd.Int64("seed", 1, "seed of the clip positions and noise")
+		output := benchCmd.String("json", "", "also write the results to this JSON file")
+		speed := benchCmd.Float64("speed", 0, "also match speed, tempo and pitch changes up to this fraction (e.g. 0.25)")
+		preprocess := benchCmd.String("preprocess", "", "preprocessing chain applied to the clips (e.g. dc,subtract,whiten)")
+		benchCmd.Parse(os.Args[2:])
+
+		opts := shazam.DefaultBenchOptions()
+		opts.ClipsPerTrack, opts.Seed = *clips, *seed
+		opts.Lengths = nil
+		for _, value := range strings.Split(*lengths, ",") {
+			length, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || length <= 0 {
+				fmt.Printf("Invalid clip length %q\n", value)
+				os.Exit(1)
+			}
+			opts.Lengths = append(opts.Lengths, length)
+		}
+
+		var err error
+		opts.Conditions, err = shazam.ParseBenchConditions(*degrade)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *speed > 0 {
+			opts.Match.Transforms = shazam.SpeedGrid(*speed)
+		}
+		if *preprocess != "" {
+			opts.Match.Preprocess, err = shazam.ParsePreprocessChain(*preprocess)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		bench(opts, *output)
 	case "download":
 		if len(os.Args) < 3 {
 			fmt.Println("Usage: main.go download <spotify_url>")
@@ -69,7 +220,7 @@ func main() {
 		filePath := indexCmd.Arg(0)
 		save(filePath, *force)
 	default:
-		fmt.Println("Expected 'find', 'download', 'erase', 'save', or 'serve' subcommands")
+		fmt.Println("Expected 'find', 'scan', 'similar', 'show', 'dedupe', 'visualize', 'bench', 'download', 'erase', 'save', or 'serve' subcommands")
 		os.Exit(1)
 	}
 }
@@ -11,4 +11,86 @@ type RecordData struct {
 	Channels   int     `json:"channels"`
 	SampleRate int     `json:"sampleRate"`
 	SampleSize int     `json:"sampleSize"`
+
+	// SpeedTolerant asks for sped-up, slowed-down and pitch-shifted
+	// versions of the indexed songs to be recognized too.
+	SpeedTolerant bool `json:"speedTolerant,omitempty"`
+
+	// Explain asks for an "explanation" event detailing how the given
+	// number of top candidates were scored.
+	Explain int `json:"explain,omitempty"`
+
+	// Cover asks for the songs whose harmony follows that of the recording,
+	// such as the studio versions of a live recording, in a "coverMatches"
+	// event instead of the "matches" one.
+	Cover bool `json:"cover,omitempty"`
+}
+
+// StreamStart describes the PCM a client is about to send in "streamChunk"
+// events, as base64-encoded little-endian samples interleaved by channel.
+type StreamStart struct {
+	Channels   int `json:"channels"`
+	SampleRate int `json:"sampleRate"`
+	SampleSize int `json:"sampleSize"`
+
+	SpeedTolerant bool `json:"speedTolerant,omitempty"`
+}
+
+// FingerprintConfig holds the parameters that shape the fingerprints of an
+// index. Songs and queries can only be matched when they were fingerprinted
+// with the same configuration.
+type FingerprintConfig struct {
+	HashVersion  int     `json:"hashVersion"`
+	AnalysisRate int     `json:"analysisRate"`
+	FreqBinSize  int     `json:"freqBinSize"`
+	MaxFreq      float64 `json:"maxFreq"`
+	HopSize      int     `json:"hopSize"`
+	Window       string  `json:"window"`
+	Padding      string  `json:"padding"`
+
+	PeakNeighborhoodTime float64 `json:"peakNeighborhoodTime"`
+	PeakNeighborhoodFreq int     `json:"peakNeighborhoodFreq"`
+	PeakThresholdDb      float64 `json:"peakThresholdDb"`
+	PeaksPerSecond       int     `json:"peaksPerSecond"`
+
+	MaxFreqBits    int `json:"maxFreqBits"`
+	MaxDeltaBits   int `json:"maxDeltaBits"`
+	TargetZoneSize int `json:"targetZoneSize"`
+}
+
+// Chroma is the pitch-class profile of a song over time. Frames[i] holds
+// the relative energy of the 12 pitch classes, from C to B, scaled to 255,
+// over the i-th block of 1/FrameRate seconds.
+type Chroma struct {
+	FrameRate float64     `json:"frameRate"`
+	Frames    [][12]uint8 `json:"frames"`
+}
+
+// Embedding summarizes the timbre and spectral shape of a song as a vector
+// of feature statistics, so that songs that sound alike lie close together.
+// Embeddings can only be compared when they share a Version.
+type Embedding struct {
+	Version int       `json:"version"`
+	Values  []float64 `json:"values"`
+}
+
+// SongMetadata holds musical properties of a song estimated from its audio
+// at ingest. Zero values mean that a property could not be estimated.
+type SongMetadata struct {
+	// BPM is the tempo, in beats per minute.
+	BPM float64 `json:"bpm,omitempty"`
+	// Key is the tonic and mode of the song, such as "A minor".
+	Key string `json:"key,omitempty"`
+	// Loudness is the level of the song before it was normalized.
+	Loudness *Loudness `json:"loudness,omitempty"`
+}
+
+// Loudness describes the level of a recording.
+type Loudness struct {
+	// Integrated is the gated loudness of the whole recording, in LUFS.
+	Integrated float64 `json:"integrated"`
+	// Peak is the highest sample magnitude, in dB relative to full scale.
+	Peak float64 `json:"peak"`
+	// Silence is the time, in seconds, detected as silent and muted.
+	Silence float64 `json:"silence"`
 }
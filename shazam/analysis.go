@@ -0,0 +1,126 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"song-recognition/models"
+)
+
+// SongAnalysis holds the features of a song stored at ingest beside its
+// fingerprints.
+type SongAnalysis struct {
+	Chroma    models.Chroma
+	Embedding models.Embedding
+	Metadata  models.SongMetadata
+}
+
+// AnalyzePCM computes the SongAnalysis of 16-bit little-endian mono PCM read
+// from r until EOF, in one pass holding only the current chunk in memory.
+// The samples go through leveler first, unless it is nil, so that frames
+// are kept or dropped as silent whatever the level of the master. It stops
+// with the error of ctx once ctx is done.
+func AnalyzePCM(ctx context.Context, r io.Reader, sampleRate int, config FingerprintConfig, leveler *Leveler) (SongAnalysis, error) {
+	chroma, err := newChromaExtractor(config)
+	if err != nil {
+		return SongAnalysis{}, err
+	}
+	embedding, err := newEmbeddingExtractor(config)
+	if err != nil {
+		return SongAnalysis{}, err
+	}
+
+	tempo, err := newTempoExtractor(config)
+	if err != nil {
+		return SongAnalysis{}, err
+	}
+
+	analyzer, err := newAnalyzer(sampleRate, config, chroma, embedding, tempo)
+	if err != nil {
+		return SongAnalysis{}, err
+	}
+	analyzer.leveler = leveler
+	if err := analyzer.analyzePCM(ctx, r); err != nil {
+		return SongAnalysis{}, err
+	}
+
+	summary := chroma.acc.summary()
+	return SongAnalysis{
+		Chroma:    summary,
+		Embedding: embedding.embedding(),
+		Metadata:  models.SongMetadata{BPM: tempo.acc.bpm(), Key: estimateKey(summary)},
+	}, nil
+}
+
+// extractor computes a feature of audio at the analysis rate, delivered in
+// chunks.
+type extractor interface {
+	write(samples []float64) error
+	flush() error
+}
+
+// analyzer resamples audio delivered in chunks to the analysis rate of a
+// fingerprint config and hands it to extractors, so that several features
+// are computed in a single pass. The audio is leveled first when leveler is
+// set.
+type analyzer struct {
+	leveler    *Leveler
+	resampler  *Resampler
+	extractors []extractor
+}
+
+func newAnalyzer(sampleRate int, config FingerprintConfig, extractors ...extractor) (*analyzer, error) {
+	if err := ValidateConfig(config); err != nil {
+		return nil, err
+	}
+
+	resampler, err := NewResampler(sampleRate, config.AnalysisRate, config.MaxFreq)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create resampler: %v", err)
+	}
+
+	return &analyzer{resampler: resampler, extractors: extractors}, nil
+}
+
+func (a *analyzer) write(samples []float64) error {
+	return a.dispatch(a.resampler.Process(a.leveler.Process(samples)))
+}
+
+func (a *analyzer) flush() error {
+	if err := a.dispatch(a.resampler.Flush()); err != nil {
+		return err
+	}
+	for _, e := range a.extractors {
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *analyzer) dispatch(samples []float64) error {
+	for _, e := range a.extractors {
+		if err := e.write(samples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyzeSamples runs the analysis over a clip held in memory, until ctx
+// is done.
+func (a *analyzer) analyzeSamples(ctx context.Context, samples []float64) error {
+	if err := writeChunks(ctx, samples, a.write); err != nil {
+		return err
+	}
+	return a.flush()
+}
+
+// analyzePCM runs the analysis over 16-bit little-endian mono PCM read from
+// r until EOF, until ctx is done.
+func (a *analyzer) analyzePCM(ctx context.Context, r io.Reader) error {
+	if err := readPCM(ctx, r, a.write); err != nil {
+		return err
+	}
+	return a.flush()
+}
@@ -0,0 +1,53 @@
+package shazam
+
+import (
+	"context"
+	"song-recognition/synth"
+	"testing"
+)
+
+// testEmbedding runs the embedding extraction over samples, leveled by
+// leveler.
+func testEmbedding(t *testing.T, samples []float64, leveler *Leveler) *embeddingExtractor {
+	t.Helper()
+	embedding, err := newEmbeddingExtractor(DefaultFingerprintConfig())
+	if err != nil {
+		t.Fatalf("newEmbeddingExtractor: %v", err)
+	}
+	analyzer, err := newAnalyzer(testSampleRate, DefaultFingerprintConfig(), embedding)
+	if err != nil {
+		t.Fatalf("newAnalyzer: %v", err)
+	}
+	analyzer.leveler = leveler
+	if err := analyzer.analyzeSamples(context.Background(), samples); err != nil {
+		t.Fatalf("analyzeSamples: %v", err)
+	}
+	return embedding
+}
+
+// testEmbeddingFrames returns the number of frames the embedding of samples,
+// leveled by leveler, is computed from.
+func testEmbeddingFrames(t *testing.T, samples []float64, leveler *Leveler) int {
+	t.Helper()
+	return testEmbedding(t, samples, leveler).acc.stats[0].n
+}
+
+func TestAnalysisLevelsQuietMaster(t *testing.T) {
+	song := synth.Song(40, 30, testSampleRate)
+	quiet := make([]float64, len(song))
+	for i, x := range song {
+		quiet[i] = x * 0.005
+	}
+
+	// A master 46 dB quieter loses frames under the silence floor unless
+	// it is leveled first
+	want := testEmbeddingFrames(t, song, MeasureLoudness(song, testSampleRate).Leveler())
+	raw := testEmbeddingFrames(t, quiet, nil)
+	leveled := testEmbeddingFrames(t, quiet, MeasureLoudness(quiet, testSampleRate).Leveler())
+	if raw >= want {
+		t.Fatalf("the quiet master kept %d frames without leveling, want fewer than %d", raw, want)
+	}
+	if leveled != want {
+		t.Errorf("the leveled quiet master kept %d frames, want %d", leveled, want)
+	}
+}
@@ -0,0 +1,274 @@
+package shazam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// BenchTrack is a song file the benchmark cuts clips from. Title and Artist
+// identify the indexed song it is expected to match; Load reads its mono
+// samples and sample rate, and is called once per benchmark.
+type BenchTrack struct {
+	Title  string
+	Artist string
+	Load   func() ([]float64, int, error)
+}
+
+// BenchCondition is a named chain of degradations applied to every clip.
+type BenchCondition struct {
+	Name         string
+	Degradations []Degradation
+}
+
+// ParseBenchConditions parses conditions separated by semicolons, each a
+// chain for ParseDegradations, such as "clean;noise:10;noise:0,lowpass:3000".
+func ParseBenchConditions(spec string) ([]BenchCondition, error) {
+	var conditions []BenchCondition
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		degradations, err := ParseDegradations(item)
+		if err != nil {
+			return nil, err
+		}
+
+		name := item
+		if len(degradations) == 0 {
+			name = "clean"
+		}
+		conditions = append(conditions, BenchCondition{Name: name, Degradations: degradations})
+	}
+
+	return conditions, nil
+}
+
+// BenchOptions controls the clips a benchmark cuts and degrades.
+type BenchOptions struct {
+	// ClipsPerTrack is the number of clips of each length cut from a track.
+	ClipsPerTrack int
+	// Lengths are the clip lengths, in seconds.
+	Lengths []float64
+	// Conditions are the degradations every clip is tested under.
+	Conditions []BenchCondition
+	// Seed makes the clip positions and the noise reproducible.
+	Seed int64
+	// Match is used to recognize every clip.
+	Match MatchOptions
+}
+
+// DefaultBenchOptions returns three clean clips of 5 and 10 seconds per
+// track, with the default match options.
+func DefaultBenchOptions() BenchOptions {
+	return BenchOptions{
+		ClipsPerTrack: 3,
+		Lengths:       []float64{5, 10},
+		Conditions:    []BenchCondition{{Name: "clean"}},
+		Seed:          1,
+		Match:         DefaultMatchOptions(),
+	}
+}
+
+// BenchResult sums up the clips of one length under one condition. Clips of
+// tracks missing from the index can only be wrong or unmatched; a wrong
+// top match on any clip is a false positive.
+type BenchResult struct {
+	Condition         string  `json:"condition"`
+	Length            float64 `json:"length"`
+	Clips             int     `json:"clips"`
+	Indexed           int     `json:"indexed"`
+	Correct           int     `json:"correct"`
+	Wrong             int     `json:"wrong"`
+	Unmatched         int     `json:"unmatched"`
+	Accuracy          float64 `json:"top1Accuracy"`
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+	LatencyMeanMs     float64 `json:"latencyMeanMs"`
+	LatencyP50Ms      float64 `json:"latencyP50Ms"`
+	LatencyP90Ms      float64 `json:"latencyP90Ms"`
+	LatencyP99Ms      float64 `json:"latencyP99Ms"`
+
+	latencies []time.Duration
+}
+
+// BenchReport is the outcome of a benchmark, one result per condition and
+// clip length. Skipped lists the tracks that could not be loaded.
+type BenchReport struct {
+	Tracks  int           `json:"tracks"`
+	Skipped []string      `json:"skipped"`
+	Results []BenchResult `json:"results"`
+}
+
+// Bench cuts random clips from every track, degrades them under each
+// condition and recognizes them against the index. Latency covers peak
+// extraction and matching. progress, when not nil, is called after each
+// track.
+func Bench(ctx context.Context, tracks []BenchTrack, opts BenchOptions, progress func(done, total int)) (*BenchReport, error) {
+	if opts.ClipsPerTrack < 1 || len(opts.Lengths) == 0 || len(opts.Conditions) == 0 {
+		return nil, errors.New("benchmark needs clips, lengths and conditions")
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	config, err := QueryConfig(ctx, dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &BenchReport{Tracks: len(tracks), Skipped: []string{}}
+	results := make([]BenchResult, 0, len(opts.Conditions)*len(opts.Lengths))
+	for _, condition := range opts.Conditions {
+		for _, length := range opts.Lengths {
+			results = append(results, BenchResult{Condition: condition.Name, Length: length})
+		}
+	}
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	for i, track := range tracks {
+		name := utils.GenerateSongKey(track.Title, track.Artist)
+
+		samples, sampleRate, err := track.Load()
+		if err != nil {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+
+		_, indexed, err := dbClient.GetSongByKey(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up %s: %v", name, err)
+		}
+
+		for l, length := range opts.Lengths {
+			clipLen := int(length * float64(sampleRate))
+			if clipLen <= 0 || clipLen > len(samples) {
+				continue
+			}
+
+			for c := 0; c < opts.ClipsPerTrack; c++ {
+				start := rng.Intn(len(samples) - clipLen + 1)
+				clip := samples[start : start+clipLen]
+
+				for k, condition := range opts.Conditions {
+					result := &results[k*len(opts.Lengths)+l]
+					if err := benchClip(ctx, dbClient, config, clip, sampleRate, track, indexed, condition, opts.Match, rng, result); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		if progress != nil {
+			progress(i+1, len(tracks))
+		}
+	}
+
+	for i := range results {
+		results[i].summarize()
+	}
+	report.Results = results
+
+	return report, nil
+}
+
+// benchClip degrades one clip, recognizes it and records the outcome.
+func benchClip(ctx context.Context, dbClient db.DBClient, config FingerprintConfig, clip []float64, sampleRate int, track BenchTrack, indexed bool, condition BenchCondition, matchOpts MatchOptions, rng *rand.Rand, result *BenchResult) error {
+	var err error
+	for _, degradation := range condition.Degradations {
+		clip, sampleRate, err = degradation.Apply(clip, sampleRate, rng)
+		if err != nil {
+			return fmt.Errorf("error applying %s: %v", degradation.Name, err)
+		}
+	}
+
+	startTime := time.Now()
+	peaks, err := queryPeaks(ctx, clip, sampleRate, config, matchOpts)
+	if err != nil {
+		return fmt.Errorf("failed to extract peaks: %v", err)
+	}
+	matches, err := matchPeaks(ctx, dbClient, config, peaks, matchOpts)
+	if err != nil && !errors.Is(err, ErrNoMatch) {
+		return err
+	}
+	result.latencies = append(result.latencies, time.Since(startTime))
+
+	result.Clips++
+	if indexed {
+		result.Indexed++
+	}
+
+	switch {
+	case len(matches) == 0:
+		result.Unmatched++
+	case matches[0].SongTitle == track.Title && matches[0].SongArtist == track.Artist:
+		result.Correct++
+	default:
+		result.Wrong++
+	}
+
+	return nil
+}
+
+// summarize computes the rates and latency statistics of the result.
+func (r *BenchResult) summarize() {
+	if r.Indexed > 0 {
+		r.Accuracy = float64(r.Correct) / float64(r.Indexed)
+	}
+	if r.Clips > 0 {
+		r.FalsePositiveRate = float64(r.Wrong) / float64(r.Clips)
+	}
+	if len(r.latencies) == 0 {
+		return
+	}
+
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	var total time.Duration
+	for _, latency := range r.latencies {
+		total += latency
+	}
+	r.LatencyMeanMs = milliseconds(total / time.Duration(len(r.latencies)))
+	r.LatencyP50Ms = milliseconds(percentile(r.latencies, 50))
+	r.LatencyP90Ms = milliseconds(percentile(r.latencies, 90))
+	r.LatencyP99Ms = milliseconds(percentile(r.latencies, 99))
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// WriteBenchTable writes the results of report as an aligned text table.
+func WriteBenchTable(w io.Writer, report *BenchReport) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "condition\tlength\tclips\tcorrect\twrong\tunmatched\ttop-1\tfalse pos.\tp50 ms\tp90 ms\tp99 ms\t")
+	for _, r := range report.Results {
+		fmt.Fprintf(table, "%s\t%gs\t%d\t%d\t%d\t%d\t%.1f%%\t%.1f%%\t%.0f\t%.0f\t%.0f\t\n",
+			r.Condition, r.Length, r.Clips, r.Correct, r.Wrong, r.Unmatched,
+			r.Accuracy*100, r.FalsePositiveRate*100, r.LatencyP50Ms, r.LatencyP90Ms, r.LatencyP99Ms)
+	}
+	return table.Flush()
+}
+
+// WriteBenchJSON writes report to w as indented JSON.
+func WriteBenchJSON(w io.Writer, report *BenchReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,181 @@
+package shazam
+
+import (
+	"context"
+	"math"
+	"math/cmplx"
+	"song-recognition/models"
+)
+
+const (
+	// ChromaFrameRate is the number of chroma frames per second of audio.
+	ChromaFrameRate = 4.0
+
+	// chromaFrameSeconds is the approximate length of the STFT frames chroma
+	// is computed from, long enough to tell semitones apart from
+	// chromaMinFreq up.
+	chromaFrameSeconds = 0.37
+
+	// chromaMinFreq and chromaMaxFreq bound the frequencies, in Hz, that
+	// contribute to the pitch classes: below, bins are wider than a
+	// semitone; above, harmonics dominate the fundamentals.
+	chromaMinFreq = 100.0
+	chromaMaxFreq = 4000.0
+
+	// chromaCompression shapes the logarithmic compression of the pitch
+	// class energies, so that the accompaniment is not drowned out by the
+	// loudest note.
+	chromaCompression = 10.0
+)
+
+// chromaSTFTOptions returns the framing chroma is computed with at the
+// analysis rate of config. Frames are longer than the fingerprinting ones,
+// as pitch needs a finer frequency resolution than landmarks do.
+func chromaSTFTOptions(config FingerprintConfig) STFTOptions {
+	frameSize := 1 << int(math.Round(math.Log2(float64(config.AnalysisRate)*chromaFrameSeconds)))
+	return STFTOptions{
+		Window:    WindowType(config.Window),
+		FrameSize: frameSize,
+		HopSize:   frameSize / 2,
+		Padding:   PadEnd,
+	}
+}
+
+// chromaAccumulator sums the energy of STFT frames into pitch classes,
+// over blocks of 1/ChromaFrameRate seconds.
+type chromaAccumulator struct {
+	classes   []int   // pitch class of each bin, -1 outside the analysed range
+	scale     float64 // turns bin magnitudes into sinusoid amplitudes
+	frameTime float64 // half a frame, from the start of a frame to its centre
+
+	blocks [][12]float64
+	frames []int // STFT frames summed into each block
+}
+
+func newChromaAccumulator(sampleRate int, opts STFTOptions, maxFreq float64) *chromaAccumulator {
+	maxFreq = math.Min(maxFreq, chromaMaxFreq)
+
+	classes := make([]int, opts.FrameSize/2+1)
+	for bin := range classes {
+		freq := float64(bin) * float64(sampleRate) / float64(opts.FrameSize)
+		if freq < chromaMinFreq || freq > maxFreq {
+			classes[bin] = -1
+			continue
+		}
+		// MIDI note 60 is a C
+		note := int(math.Round(69 + 12*math.Log2(freq/440)))
+		classes[bin] = note % 12
+	}
+
+	return &chromaAccumulator{
+		classes:   classes,
+		scale:     2 / float64(opts.FrameSize),
+		frameTime: float64(opts.FrameSize) / 2 / float64(sampleRate),
+	}
+}
+
+// push adds the energy of one STFT frame to the block its centre falls in.
+func (c *chromaAccumulator) push(spectrum []complex128, frameTime float64) {
+	block := int((frameTime + c.frameTime) * ChromaFrameRate)
+	for len(c.blocks) <= block {
+		c.blocks = append(c.blocks, [12]float64{})
+		c.frames = append(c.frames, 0)
+	}
+
+	for bin, class := range c.classes {
+		if class < 0 || bin >= len(spectrum) {
+			continue
+		}
+		magnitude := cmplx.Abs(spectrum[bin]) * c.scale
+		c.blocks[block][class] += magnitude * magnitude
+	}
+	c.frames[block]++
+}
+
+// summary returns the chroma of the blocks pushed so far. Each block is
+// scaled to its strongest pitch class and compressed; silent blocks are
+// left at zero.
+func (c *chromaAccumulator) summary() models.Chroma {
+	silence := math.Pow(10, silenceFloorDb/10)
+
+	chroma := models.Chroma{FrameRate: ChromaFrameRate, Frames: make([][12]uint8, len(c.blocks))}
+	for i, block := range c.blocks {
+		if c.frames[i] == 0 {
+			continue
+		}
+
+		var total, strongest float64
+		for _, energy := range block {
+			total += energy
+			strongest = math.Max(strongest, energy)
+		}
+		if total/float64(c.frames[i]) < silence {
+			continue
+		}
+
+		for class, energy := range block {
+			value := math.Log1p(chromaCompression*energy/strongest) / math.Log1p(chromaCompression)
+			chroma.Frames[i][class] = uint8(math.Round(255 * value))
+		}
+	}
+
+	return chroma
+}
+
+// ChromaFromSTFT computes the chroma of a short-time Fourier transform,
+// such as the output of Spectrogram, from its bins up to maxFreq. The
+// pitch resolution is that of the frames: the frequency bins must be
+// narrower than a semitone for the lowest notes to be told apart.
+func ChromaFromSTFT(stft *STFT, maxFreq float64) models.Chroma {
+	acc := newChromaAccumulator(stft.SampleRate, stft.Options, maxFreq)
+	for i, frame := range stft.Frames {
+		acc.push(frame, stft.FrameTimes[i])
+	}
+	return acc.summary()
+}
+
+// chromaExtractor computes the chroma of audio at the analysis rate of a
+// fingerprint config.
+type chromaExtractor struct {
+	framer *stftFramer
+	acc    *chromaAccumulator
+}
+
+func newChromaExtractor(config FingerprintConfig) (*chromaExtractor, error) {
+	opts := chromaSTFTOptions(config)
+	framer, err := newSTFTFramer(config.AnalysisRate, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chromaExtractor{
+		framer: framer,
+		acc:    newChromaAccumulator(config.AnalysisRate, opts, config.MaxFreq),
+	}, nil
+}
+
+func (c *chromaExtractor) write(samples []float64) error {
+	return c.framer.write(samples, c.acc.push)
+}
+
+func (c *chromaExtractor) flush() error {
+	return c.framer.flush(c.acc.push)
+}
+
+// ChromaSamples computes the chroma of a clip held in memory, analysed at
+// the rate of config. It stops with the error of ctx once ctx is done.
+func ChromaSamples(ctx context.Context, samples []float64, sampleRate int, config FingerprintConfig) (models.Chroma, error) {
+	chroma, err := newChromaExtractor(config)
+	if err != nil {
+		return models.Chroma{}, err
+	}
+
+	analyzer, err := newAnalyzer(sampleRate, config, chroma)
+	if err != nil {
+		return models.Chroma{}, err
+	}
+	if err := analyzer.analyzeSamples(ctx, samples); err != nil {
+		return models.Chroma{}, err
+	}
+	return chroma.acc.summary(), nil
+}
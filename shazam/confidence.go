@@ -0,0 +1,113 @@
+package shazam
+
+import (
+	"errors"
+	"math"
+	"song-recognition/utils"
+	"strconv"
+)
+
+const (
+	// defaultMinConfidence is used when MIN_MATCH_CONFIDENCE is not set.
+	defaultMinConfidence = 0.95
+
+	// backgroundHitRate is the expected fraction of query hashes that land in
+	// the best offset bin of a song that does not actually match. It bounds
+	// the background rate from below when there is no runner-up candidate.
+	backgroundHitRate = 0.002
+
+	// minBackgroundHits is the smallest background rate ever assumed, so that
+	// a handful of aligned hashes on a near-empty query is never conclusive.
+	minBackgroundHits = 2.0
+
+	// DefaultSpeedTolerance is the largest speed, tempo or pitch change
+	// searched when the speed-tolerant mode is requested without a limit.
+	DefaultSpeedTolerance = 0.25
+)
+
+// ErrNoMatch is returned by FindMatches when no candidate reaches the
+// minimum confidence. It is not a failure of the recognition itself.
+var ErrNoMatch = errors.New("no match found")
+
+// MatchOptions controls how FindMatches selects its results.
+type MatchOptions struct {
+	// MinConfidence is the confidence, between 0 and 1, a candidate needs to
+	// be reported as a match.
+	MinConfidence float64
+
+	// Transforms lists the speed, tempo and pitch changes the query is tried
+	// under, typically built with SpeedGrid. When empty the query is only
+	// matched as is. The cost of a query grows with the number of
+	// transforms, as described by SpeedGrid.
+	Transforms []Transform
+
+	// Preprocess is applied to the query before peak extraction,
+	// independently of the chain songs were ingested with.
+	Preprocess PreprocessChain
+}
+
+// DefaultMatchOptions returns the options used by the server and the CLI.
+// The minimum confidence can be overridden with MIN_MATCH_CONFIDENCE, and
+// SPEED_TOLERANCE enables the speed-tolerant mode for changes up to the
+// given fraction. QUERY_PREPROCESS sets the preprocessing chain, as parsed
+// by ParsePreprocessChain.
+func DefaultMatchOptions() MatchOptions {
+	opts := MatchOptions{MinConfidence: defaultMinConfidence}
+
+	if value := utils.GetEnv("MIN_MATCH_CONFIDENCE"); value != "" {
+		minConfidence, err := strconv.ParseFloat(value, 64)
+		if err == nil && minConfidence >= 0 && minConfidence <= 1 {
+			opts.MinConfidence = minConfidence
+		}
+	}
+
+	if value := utils.GetEnv("SPEED_TOLERANCE"); value != "" {
+		tolerance, err := strconv.ParseFloat(value, 64)
+		if err == nil && tolerance > 0 && tolerance < 1 {
+			opts.Transforms = SpeedGrid(tolerance)
+		}
+	}
+
+	if chain, err := ParsePreprocessChain(utils.GetEnv("QUERY_PREPROCESS")); err == nil {
+		opts.Preprocess = chain
+	}
+
+	return opts
+}
+
+// matchConfidence estimates how unlikely it is that hits aligned hashes are
+// produced by chance. The background rate is taken from the strongest
+// competing candidate, bounded below by what a query of queryHashes hashes
+// is expected to produce against an unrelated song. The confidence is the
+// probability that a Poisson variable with that rate stays below hits.
+func matchConfidence(hits, competitorHits, queryHashes int) float64 {
+	background := math.Max(float64(competitorHits), float64(queryHashes)*backgroundHitRate)
+	background = math.Max(background, minBackgroundHits)
+
+	return 1 - poissonTail(hits, background)
+}
+
+// correctForTrials lowers a confidence computed for one alignment search to
+// account for trials independent searches, such as the transforms of the
+// speed-tolerant mode, any of which could have produced a chance match.
+func correctForTrials(confidence float64, trials int) float64 {
+	return math.Max(0, 1-(1-confidence)*float64(max(trials, 1)))
+}
+
+// poissonTail returns P(X >= k) for X ~ Poisson(lambda).
+func poissonTail(k int, lambda float64) float64 {
+	if k <= 0 {
+		return 1
+	}
+
+	// Sum P(X = i) for i < k. Terms are computed in log space so that large
+	// rates do not underflow exp(-lambda).
+	logLambda := math.Log(lambda)
+	var cdf float64
+	for i := 0; i < k; i++ {
+		logFactorial, _ := math.Lgamma(float64(i + 1))
+		cdf += math.Exp(-lambda + float64(i)*logLambda - logFactorial)
+	}
+
+	return math.Max(0, 1-cdf)
+}
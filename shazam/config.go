@@ -0,0 +1,179 @@
+package shazam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+)
+
+// FingerprintHashVersion identifies the hashing scheme implemented by this
+// package. It must be bumped whenever a change makes new fingerprints
+// incompatible with the ones already stored, whatever the parameters.
+const FingerprintHashVersion = 5
+
+// FingerprintConfig holds the parameters of the fingerprinting pipeline.
+type FingerprintConfig = models.FingerprintConfig
+
+// ErrConfigMismatch is returned when the fingerprint configuration of the
+// index differs from the one requested for indexing new songs.
+var ErrConfigMismatch = errors.New("fingerprint config does not match the index")
+
+// ErrHashVersion is returned when the index was built with another hashing
+// scheme and has to be rebuilt.
+var ErrHashVersion = errors.New("index was built with an incompatible fingerprint hash version")
+
+// DefaultFingerprintConfig returns the parameters tuned for music.
+func DefaultFingerprintConfig() FingerprintConfig {
+	return FingerprintConfig{
+		HashVersion:  FingerprintHashVersion,
+		AnalysisRate: 11025,
+		FreqBinSize:  1024,
+		MaxFreq:      5000.0, // 5kHz
+		HopSize:      1024 / 8,
+		Window:       string(HammingWindow),
+		Padding:      string(PadEnd),
+
+		PeakNeighborhoodTime: 0.1,
+		PeakNeighborhoodFreq: 20,
+		PeakThresholdDb:      10,
+		PeaksPerSecond:       30,
+
+		MaxFreqBits:    9,
+		MaxDeltaBits:   14,
+		TargetZoneSize: 5,
+	}
+}
+
+// LoadFingerprintConfig returns the configuration of this deployment: the
+// defaults, overridden by the JSON file named by FINGERPRINT_CONFIG if set.
+// Fields missing from the file keep their default value.
+func LoadFingerprintConfig() (FingerprintConfig, error) {
+	config := DefaultFingerprintConfig()
+
+	path := utils.GetEnv("FINGERPRINT_CONFIG")
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return FingerprintConfig{}, fmt.Errorf("failed to read fingerprint config: %v", err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return FingerprintConfig{}, fmt.Errorf("failed to parse fingerprint config: %v", err)
+		}
+		config.HashVersion = FingerprintHashVersion
+	}
+
+	if err := ValidateConfig(config); err != nil {
+		return FingerprintConfig{}, err
+	}
+
+	return config, nil
+}
+
+// ValidateConfig checks that config describes a usable pipeline.
+func ValidateConfig(config FingerprintConfig) error {
+	switch {
+	case config.AnalysisRate < 1:
+		return fmt.Errorf("invalid fingerprint config: analysisRate must be positive")
+	case config.MaxFreq <= 0:
+		return fmt.Errorf("invalid fingerprint config: maxFreq must be positive")
+	case config.PeakNeighborhoodTime <= 0 || config.PeakNeighborhoodFreq < 1:
+		return fmt.Errorf("invalid fingerprint config: peak neighborhood must be positive")
+	case config.PeaksPerSecond < 1:
+		return fmt.Errorf("invalid fingerprint config: peaksPerSecond must be at least 1")
+	case config.MaxFreqBits < 1 || config.MaxDeltaBits < 1 || 2*config.MaxFreqBits+config.MaxDeltaBits > 32:
+		return fmt.Errorf("invalid fingerprint config: address bits must fit in 32 bits")
+	case config.TargetZoneSize < 1:
+		return fmt.Errorf("invalid fingerprint config: targetZoneSize must be at least 1")
+	}
+
+	if err := STFTOptionsFromConfig(config).Validate(); err != nil {
+		return fmt.Errorf("invalid fingerprint config: %v", err)
+	}
+	return nil
+}
+
+// IngestConfig returns the configuration new songs must be indexed with.
+// The first song indexed in an empty database records this deployment's
+// configuration; afterwards the deployment's configuration must match the
+// stored one, otherwise ErrConfigMismatch is returned.
+func IngestConfig(ctx context.Context, dbClient db.DBClient) (FingerprintConfig, error) {
+	config, err := LoadFingerprintConfig()
+	if err != nil {
+		return FingerprintConfig{}, err
+	}
+
+	stored, found, err := dbClient.GetFingerprintConfig(ctx)
+	if err != nil {
+		return FingerprintConfig{}, err
+	}
+
+	if !found {
+		if err := checkUnversionedIndex(ctx, dbClient); err != nil {
+			return FingerprintConfig{}, err
+		}
+		if err := dbClient.SetFingerprintConfig(ctx, config); err != nil {
+			return FingerprintConfig{}, err
+		}
+		return config, nil
+	}
+
+	if stored.HashVersion != FingerprintHashVersion {
+		return FingerprintConfig{}, fmt.Errorf("%w (index: %d, current: %d)", ErrHashVersion, stored.HashVersion, FingerprintHashVersion)
+	}
+	if stored != config {
+		return FingerprintConfig{}, fmt.Errorf("%w (index: %+v, requested: %+v)", ErrConfigMismatch, stored, config)
+	}
+
+	return config, nil
+}
+
+// QueryConfig returns the configuration queries must be fingerprinted with.
+// Queries adapt to the configuration recorded in the database so that they
+// can be matched against the index; without one, this deployment's
+// configuration is used.
+func QueryConfig(ctx context.Context, dbClient db.DBClient) (FingerprintConfig, error) {
+	stored, found, err := dbClient.GetFingerprintConfig(ctx)
+	if err != nil {
+		return FingerprintConfig{}, err
+	}
+
+	if !found {
+		if err := checkUnversionedIndex(ctx, dbClient); err != nil {
+			return FingerprintConfig{}, err
+		}
+		return LoadFingerprintConfig()
+	}
+
+	if stored.HashVersion != FingerprintHashVersion {
+		return FingerprintConfig{}, fmt.Errorf("%w (index: %d, current: %d)", ErrHashVersion, stored.HashVersion, FingerprintHashVersion)
+	}
+	if err := ValidateConfig(stored); err != nil {
+		return FingerprintConfig{}, err
+	}
+
+	return stored, nil
+}
+
+// checkUnversionedIndex returns ErrHashVersion when the database holds songs
+// or fingerprints but no fingerprint config: they were indexed before the
+// config was recorded, with hashes that can't be told apart from new ones.
+func checkUnversionedIndex(ctx context.Context, dbClient db.DBClient) error {
+	songs, err := dbClient.TotalSongs(ctx)
+	if err != nil {
+		return err
+	}
+	hasFingerprints, err := dbClient.HasFingerprints(ctx)
+	if err != nil {
+		return err
+	}
+
+	if songs > 0 || hasFingerprints {
+		return fmt.Errorf("%w (index has no recorded version, current: %d); erase the database and index the songs again", ErrHashVersion, FingerprintHashVersion)
+	}
+	return nil
+}
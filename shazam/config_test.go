@@ -0,0 +1,52 @@
+package shazam
+
+import (
+	"context"
+	"errors"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestIngestConfigRecordsConfigOfEmptyIndex(t *testing.T) {
+	ctx := context.Background()
+	client := testDB(t)
+
+	config, err := IngestConfig(ctx, client)
+	if err != nil {
+		t.Fatalf("IngestConfig: %v", err)
+	}
+	stored, found, err := client.GetFingerprintConfig(ctx)
+	if err != nil || !found || stored != config {
+		t.Fatalf("stored config = %+v, %v, %v, want %+v", stored, found, err, config)
+	}
+	if _, err := IngestConfig(ctx, client); err != nil {
+		t.Errorf("IngestConfig of an index with the same config: %v", err)
+	}
+}
+
+func TestUnversionedIndexIsRefused(t *testing.T) {
+	ctx := context.Background()
+
+	// Indexes holding fingerprints or songs but no recorded config
+	fingerprintsOnly := testDB(t)
+	if err := fingerprintsOnly.StoreFingerprints(ctx, map[uint32][]models.Couple{1: {{AnchorTimeMs: 10, SongID: 1}}}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	songsOnly := testDB(t)
+	if _, err := songsOnly.RegisterSong(ctx, "Song", "Synth", "yt"); err != nil {
+		t.Fatalf("RegisterSong: %v", err)
+	}
+
+	for name, client := range map[string]db.DBClient{"fingerprints": fingerprintsOnly, "songs": songsOnly} {
+		if _, err := IngestConfig(ctx, client); !errors.Is(err, ErrHashVersion) {
+			t.Errorf("IngestConfig of an index with %s: err = %v, want ErrHashVersion", name, err)
+		}
+		if _, err := QueryConfig(ctx, client); !errors.Is(err, ErrHashVersion) {
+			t.Errorf("QueryConfig of an index with %s: err = %v, want ErrHashVersion", name, err)
+		}
+		if _, found, _ := client.GetFingerprintConfig(ctx); found {
+			t.Errorf("a config was recorded over the %s of an unversioned index", name)
+		}
+	}
+}
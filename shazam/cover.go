@@ -0,0 +1,365 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"song-recognition/db"
+	"song-recognition/models"
+	"sort"
+)
+
+const (
+	// coverSmoothing is the number of chroma frames averaged into each
+	// compared frame, which evens out differences of arrangement and timing.
+	coverSmoothing = 3
+
+	// coverMinQuerySeconds is the length of recording needed for its
+	// harmony to be compared.
+	coverMinQuerySeconds = 5.0
+
+	// coverMaxTempo is the largest factor the tempo of a recording may
+	// differ from that of the song by, either way, and coverTempoStep the
+	// ratio between two tempos tried. Over a query, half a step of tempo
+	// error shifts the last frames by less than the smoothing.
+	coverMaxTempo  = 1.4
+	coverTempoStep = 1.03
+
+	// coverCoarseFrames is the number of chroma frames averaged into each
+	// frame of the first pass of a cover search, and coverCoarseTempoStep
+	// the ratio between two tempos it tries. The first pass only ranks the
+	// songs, for which a rougher alignment is enough.
+	coverCoarseFrames    = 2
+	coverCoarseTempoStep = 1.12
+)
+
+// CoverOptions controls a cover search.
+type CoverOptions struct {
+	// Top is the number of songs returned, at most.
+	Top int
+	// MinSimilarity is the similarity a song needs to be returned.
+	MinSimilarity float64
+	// Transpositions is the number of keys, the most likely from the overall
+	// pitch class profiles, a recording is compared in with each song.
+	Transpositions int
+	// Candidates is the number of songs, the closest to the recording in a
+	// coarse first pass, that are aligned with it in full. Every song is
+	// aligned in full when 0.
+	Candidates int
+}
+
+// DefaultCoverOptions returns the ten most similar songs among the 20
+// closest in the first pass, each compared in its three most likely
+// transpositions.
+func DefaultCoverOptions() CoverOptions {
+	return CoverOptions{Top: 10, Transpositions: 3, Candidates: 20}
+}
+
+// CoverMatch is a song whose harmony follows that of a recording, such as
+// a live or cover version of it. Similarity, at most 1, is the mean
+// correlation of the pitch class profiles of the aligned chroma frames.
+// Transpose is the number of semitones, between -5 and 6, the recording is
+// shifted from the song by, Speed the factor of its tempo to the song's and
+// Position the time of the song, in seconds, the recording starts at.
+type CoverMatch struct {
+	SongID     uint32  `json:"songId"`
+	SongTitle  string  `json:"title"`
+	SongArtist string  `json:"artist"`
+	YouTubeID  string  `json:"youtubeId"`
+	Similarity float64 `json:"similarity"`
+	Transpose  int     `json:"transpose"`
+	Speed      float64 `json:"speed"`
+	Position   float64 `json:"position"`
+}
+
+// FindCovers ranks the indexed songs by how closely their chroma sequence
+// follows that of the recording, in any key and at a tempo up to
+// coverMaxTempo times faster or slower. Unlike FindMatches, it recognizes other performances of a song,
+// at the cost of precision. A first pass aligns every song at a coarser
+// resolution, over ten times faster, and only the opts.Candidates best are
+// aligned in full. When no song reaches opts.MinSimilarity the error is
+// ErrNoMatch. The search stops with the error of ctx once ctx is done.
+func FindCovers(ctx context.Context, samples []float64, sampleRate int, opts CoverOptions) ([]CoverMatch, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	config, err := QueryConfig(ctx, dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	// The recording is leveled as the songs were at ingest, so that its
+	// quiet frames aren't dropped as silent
+	chroma, err := ChromaSamples(ctx, LevelSamples(samples, sampleRate), sampleRate, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract chroma: %v", err)
+	}
+	query := chromaFeatures(chroma)
+	if float64(len(query)) < coverMinQuerySeconds*chroma.FrameRate {
+		return nil, fmt.Errorf("recording too short for a cover search, at least %g seconds are needed", coverMinQuerySeconds)
+	}
+
+	library, err := dbClient.GetAllChroma(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := coverCandidates(ctx, query, library, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var covers []CoverMatch
+	for _, candidate := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		similarity, shift, tempo, start := coverSimilarity(query, candidate.features, opts.Transpositions, coverTempos(coverTempoStep))
+		if similarity < opts.MinSimilarity || math.IsInf(similarity, -1) {
+			continue
+		}
+		covers = append(covers, CoverMatch{
+			SongID:     candidate.songID,
+			Similarity: similarity,
+			Transpose:  transposition(shift),
+			Speed:      tempo,
+			Position:   float64(start) / library[candidate.songID].FrameRate,
+		})
+	}
+
+	sort.Slice(covers, func(i, j int) bool {
+		return covers[i].Similarity > covers[j].Similarity
+	})
+	if opts.Top > 0 && len(covers) > opts.Top {
+		covers = covers[:opts.Top]
+	}
+
+	for i := range covers {
+		song, songExists, err := dbClient.GetSongByID(ctx, covers[i].SongID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get song by ID (%v): %v", covers[i].SongID, err)
+		}
+		if songExists {
+			covers[i].SongTitle, covers[i].SongArtist, covers[i].YouTubeID = song.Title, song.Artist, song.YouTubeID
+		}
+	}
+
+	if len(covers) == 0 {
+		return nil, ErrNoMatch
+	}
+	return covers, nil
+}
+
+// coverCandidate is a song considered by a cover search, with its chroma
+// features and its similarity in the first pass.
+type coverCandidate struct {
+	songID     uint32
+	features   [][12]float64
+	similarity float64
+}
+
+// coverCandidates returns the opts.Candidates songs of library closest to
+// query when aligned at coverCoarseFrames times fewer frames and at tempos
+// coverCoarseTempoStep apart, best first. Every song is returned when
+// opts.Candidates is 0 or the library is not larger.
+func coverCandidates(ctx context.Context, query [][12]float64, library map[uint32]models.Chroma, opts CoverOptions) ([]coverCandidate, error) {
+	candidates := make([]coverCandidate, 0, len(library))
+	for songID, songChroma := range library {
+		candidates = append(candidates, coverCandidate{songID: songID, features: chromaFeatures(songChroma)})
+	}
+	if opts.Candidates <= 0 || len(candidates) <= opts.Candidates {
+		return candidates, nil
+	}
+
+	coarseQuery := coarseFeatures(query)
+	tempos := coverTempos(coverCoarseTempoStep)
+	for i := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		candidates[i].similarity, _, _, _ = coverSimilarity(coarseQuery, coarseFeatures(candidates[i].features), opts.Transpositions, tempos)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].similarity != candidates[j].similarity {
+			return candidates[i].similarity > candidates[j].similarity
+		}
+		return candidates[i].songID < candidates[j].songID
+	})
+	return candidates[:opts.Candidates], nil
+}
+
+// coarseFeatures averages features over coverCoarseFrames frames and
+// scales the result back to unit length.
+func coarseFeatures(features [][12]float64) [][12]float64 {
+	coarse := make([][12]float64, (len(features)+coverCoarseFrames-1)/coverCoarseFrames)
+	for i := range coarse {
+		for _, frame := range features[i*coverCoarseFrames : min((i+1)*coverCoarseFrames, len(features))] {
+			for class, value := range frame {
+				coarse[i][class] += value
+			}
+		}
+		normalizeFrame(&coarse[i])
+	}
+	return coarse
+}
+
+// chromaFeatures smooths the frames of chroma over coverSmoothing frames,
+// centres them on their mean and scales them to unit length, so that the
+// dot product of two frames is the correlation of their pitch class
+// profiles. Silent frames stay at zero.
+func chromaFeatures(chroma models.Chroma) [][12]float64 {
+	features := make([][12]float64, len(chroma.Frames))
+	for i := range features {
+		from := max(0, i-coverSmoothing/2)
+		to := min(len(chroma.Frames), from+coverSmoothing)
+		for _, frame := range chroma.Frames[from:to] {
+			for class, value := range frame {
+				features[i][class] += float64(value)
+			}
+		}
+
+		var mean float64
+		for _, value := range features[i] {
+			mean += value / 12
+		}
+
+		for class := range features[i] {
+			features[i][class] -= mean
+		}
+		normalizeFrame(&features[i])
+	}
+	return features
+}
+
+// normalizeFrame scales frame to unit length, unless it is zero.
+func normalizeFrame(frame *[12]float64) {
+	var norm float64
+	for _, value := range frame {
+		norm += value * value
+	}
+	if norm == 0 {
+		return
+	}
+	norm = math.Sqrt(norm)
+	for class := range frame {
+		frame[class] /= norm
+	}
+}
+
+// coverSimilarity aligns query with the best matching part of song under
+// the transpositions most likely from their pitch class profiles and each
+// of tempos. It returns the best similarity, the shift of the
+// pitch classes of the query and the tempo factor giving it, and the song
+// frame the alignment starts at. The similarity is -Inf when the song is
+// too short for the query.
+func coverSimilarity(query, song [][12]float64, transpositions int, tempos []float64) (float64, int, float64, int) {
+	shifts := likelyShifts(query, song, max(1, transpositions))
+
+	best, bestShift, bestTempo, bestStart := math.Inf(-1), 0, 1.0, 0
+	for _, tempo := range tempos {
+		stretched := stretchFeatures(query, tempo)
+		for _, shift := range shifts {
+			if similarity, start := alignFeatures(stretched, song, shift); similarity > best {
+				best, bestShift, bestTempo, bestStart = similarity, shift, tempo, start
+			}
+		}
+	}
+	return best, bestShift, bestTempo, bestStart
+}
+
+// likelyShifts returns the n shifts of the pitch classes of query that
+// best match the overall profile of song, best first: pitch class k of the
+// query is compared with class k+shift of the song.
+func likelyShifts(query, song [][12]float64, n int) []int {
+	queryProfile, songProfile := chromaProfile(query), chromaProfile(song)
+
+	var scores [12]float64
+	shifts := make([]int, 12)
+	for shift := range shifts {
+		shifts[shift] = shift
+		for class := 0; class < 12; class++ {
+			scores[shift] += queryProfile[class] * songProfile[(class+shift)%12]
+		}
+	}
+
+	sort.SliceStable(shifts, func(i, j int) bool { return scores[shifts[i]] > scores[shifts[j]] })
+	return shifts[:min(n, 12)]
+}
+
+// chromaProfile returns the sum of the frames of features.
+func chromaProfile(features [][12]float64) [12]float64 {
+	var profile [12]float64
+	for _, frame := range features {
+		for class, value := range frame {
+			profile[class] += value
+		}
+	}
+	return profile
+}
+
+// coverTempos returns the tempo factors a recording is compared at, from
+// 1/coverMaxTempo to coverMaxTempo in steps of step.
+func coverTempos(step float64) []float64 {
+	steps := int(math.Round(math.Log(coverMaxTempo) / math.Log(step)))
+	tempos := make([]float64, 0, 2*steps+1)
+	for k := -steps; k <= steps; k++ {
+		tempos = append(tempos, math.Pow(step, float64(k)))
+	}
+	return tempos
+}
+
+// stretchFeatures resamples features to tempo times as many frames: tempo
+// 2 doubles their number, which brings a recording played twice as fast as
+// the song back to the song's tempo. The tempo aligning a recording best is
+// thus the Speed of a CoverMatch. Frames are interpolated linearly and
+// scaled back to unit length.
+func stretchFeatures(features [][12]float64, tempo float64) [][12]float64 {
+	stretched := make([][12]float64, max(1, int(math.Round(float64(len(features))*tempo))))
+	for i := range stretched {
+		position := math.Min(float64(i)/tempo, float64(len(features)-1))
+		low := int(position)
+		high := min(low+1, len(features)-1)
+		fraction := position - float64(low)
+
+		for class := range stretched[i] {
+			stretched[i][class] = (1-fraction)*features[low][class] + fraction*features[high][class]
+		}
+		normalizeFrame(&stretched[i])
+	}
+	return stretched
+}
+
+// alignFeatures slides query, shifted by shift pitch classes, along song
+// and returns the best mean similarity of aligned frames and the song
+// frame it starts at. The similarity is -Inf when the song is shorter
+// than the query.
+func alignFeatures(query, song [][12]float64, shift int) (float64, int) {
+	best, bestStart := math.Inf(-1), 0
+	for start := 0; start+len(query) <= len(song); start++ {
+		var sum float64
+		for i, frame := range query {
+			for class, value := range frame {
+				sum += value * song[start+i][(class+shift)%12]
+			}
+		}
+		if similarity := sum / float64(len(query)); similarity > best {
+			best, bestStart = similarity, start
+		}
+	}
+	return best, bestStart
+}
+
+// transposition converts a shift of the pitch classes of a recording into
+// the number of semitones, between -5 and 6, it is transposed from the song.
+func transposition(shift int) int {
+	semitones := (12 - shift) % 12
+	if semitones > 6 {
+		semitones -= 12
+	}
+	return semitones
+}
@@ -0,0 +1,99 @@
+package shazam
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"song-recognition/models"
+	"song-recognition/synth"
+	"testing"
+)
+
+// testChroma extracts the chroma of samples with the default config.
+func testChroma(t *testing.T, samples []float64) models.Chroma {
+	t.Helper()
+	chroma, err := ChromaSamples(context.Background(), samples, testSampleRate, DefaultFingerprintConfig())
+	if err != nil {
+		t.Fatalf("ChromaSamples: %v", err)
+	}
+	return chroma
+}
+
+func TestCoverCandidatesKeepCover(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	library := map[uint32]models.Chroma{}
+	songs := map[uint32]synth.SongOptions{}
+	for songID := uint32(1); songID <= 16; songID++ {
+		opts := synth.SongOptions{Tempo: 90 + 50*rng.Float64(), Root: 48 + rng.Intn(12), Minor: rng.Intn(2) == 1}
+		songs[songID] = opts
+		library[songID] = testChroma(t, synth.SongWithOptions(int64(songID), 35, testSampleRate, opts))
+	}
+
+	opts := DefaultCoverOptions()
+	opts.Candidates = 2
+	for _, songID := range []uint32{4, 11, 15} {
+		// The same song, 20% faster and three semitones higher
+		cover := songs[songID]
+		cover.Tempo *= 1.2
+		cover.Root += 3
+		recording := synth.SongWithOptions(int64(songID), 35, testSampleRate, cover)[10*testSampleRate : 25*testSampleRate]
+		query := chromaFeatures(testChroma(t, recording))
+
+		candidates, err := coverCandidates(context.Background(), query, library, opts)
+		if err != nil {
+			t.Fatalf("coverCandidates: %v", err)
+		}
+		var found *coverCandidate
+		for i := range candidates {
+			if candidates[i].songID == songID {
+				found = &candidates[i]
+			}
+		}
+		if found == nil {
+			t.Errorf("song %d is not among the %d first pass candidates", songID, len(candidates))
+			continue
+		}
+
+		_, shift, tempo, _ := coverSimilarity(query, found.features, opts.Transpositions, coverTempos(coverTempoStep))
+		if transpose := transposition(shift); transpose != 3 {
+			t.Errorf("song %d: transpose = %d, want 3", songID, transpose)
+		}
+		if math.Abs(tempo-1.2) > coverTempoStep-1 {
+			t.Errorf("song %d: speed = %.3f, want about 1.2", songID, tempo)
+		}
+	}
+}
+
+func TestCoverSimilarityRecoversTransposeAndSpeed(t *testing.T) {
+	song := synth.SongOptions{Tempo: 110, Root: 52}
+	features := chromaFeatures(testChroma(t, synth.SongWithOptions(80, 45, testSampleRate, song)))
+
+	for _, test := range []struct {
+		transpose int
+		speed     float64
+	}{
+		{0, 1},
+		{3, 1.2},
+		{-2, 0.85},
+		{5, 1.1},
+		{-4, 1.3},
+	} {
+		// The song played transposed and at another tempo, recorded from 8 s
+		cover := song
+		cover.Root += test.transpose
+		cover.Tempo *= test.speed
+		recording := synth.SongWithOptions(80, 45, testSampleRate, cover)[8*testSampleRate : 23*testSampleRate]
+		query := chromaFeatures(testChroma(t, recording))
+
+		_, shift, tempo, start := coverSimilarity(query, features, DefaultCoverOptions().Transpositions, coverTempos(coverTempoStep))
+		if transpose := transposition(shift); transpose != test.transpose {
+			t.Errorf("transposed by %d at speed %.2f: transpose = %d", test.transpose, test.speed, transpose)
+		}
+		if math.Abs(tempo/test.speed-1) > coverTempoStep-1 {
+			t.Errorf("transposed by %d at speed %.2f: speed = %.3f", test.transpose, test.speed, tempo)
+		}
+		if position, want := float64(start)/ChromaFrameRate, 8*test.speed; math.Abs(position-want) > 1 {
+			t.Errorf("transposed by %d at speed %.2f: position = %.2f s, want %.2f s", test.transpose, test.speed, position, want)
+		}
+	}
+}
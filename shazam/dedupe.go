@@ -0,0 +1,156 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/models"
+	"sort"
+)
+
+// Duplicate is a pair of indexed songs sharing the same recording, at least
+// in part. OffsetMs is the position in Other matching the start of Song;
+// AlignedRatio is the fraction of the hashes of the shorter of the two
+// that align at that offset.
+type Duplicate struct {
+	Song         db.SongWithID
+	Other        db.SongWithID
+	SongHashes   int
+	OtherHashes  int
+	AlignedHits  int
+	AlignedRatio float64
+	OffsetMs     int64
+}
+
+// FindDuplicates queries the fingerprints of every indexed song against the
+// index and returns the pairs whose aligned ratio reaches minRatio, best
+// first. progress, when not nil, is called after each song.
+func FindDuplicates(ctx context.Context, dbClient db.DBClient, minRatio float64, progress func(done, total int)) ([]Duplicate, error) {
+	songs, err := dbClient.GetAllSongs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting songs: %v", err)
+	}
+
+	songsByID := make(map[uint32]db.SongWithID, len(songs))
+	for _, song := range songs {
+		songsByID[song.ID] = song
+	}
+
+	// Hash counts are only known once a song has been queried, so pairs are
+	// kept by ordered IDs until the end.
+	type pairKey struct{ low, high uint32 }
+	type pairScore struct {
+		hits     int
+		offsetMs int64 // position in high at the start of low
+	}
+	pairs := map[pairKey]pairScore{}
+	hashCounts := map[uint32]int{}
+
+	for i, song := range songs {
+		fingerprints, err := dbClient.GetSongFingerprints(ctx, song.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error getting fingerprints of song %d: %v", song.ID, err)
+		}
+		hashCounts[song.ID] = countCouples(fingerprints)
+
+		addresses := make([]uint32, 0, len(fingerprints))
+		for address := range fingerprints {
+			addresses = append(addresses, address)
+		}
+
+		couples, err := dbClient.GetCouples(ctx, addresses)
+		if err != nil {
+			return nil, fmt.Errorf("error getting couples of song %d: %v", song.ID, err)
+		}
+
+		for otherID, score := range scoreOffsets(fingerprints, couples) {
+			if otherID == song.ID {
+				continue
+			}
+			if _, ok := songsByID[otherID]; !ok {
+				continue
+			}
+
+			key, offsetMs := pairKey{song.ID, otherID}, score.OffsetMs
+			if otherID < song.ID {
+				key, offsetMs = pairKey{otherID, song.ID}, -score.OffsetMs
+			}
+			if best, ok := pairs[key]; !ok || score.Hits > best.hits {
+				pairs[key] = pairScore{hits: score.Hits, offsetMs: offsetMs}
+			}
+		}
+
+		if progress != nil {
+			progress(i+1, len(songs))
+		}
+	}
+
+	var duplicates []Duplicate
+	for key, score := range pairs {
+		shorter := min(hashCounts[key.low], hashCounts[key.high])
+		if shorter == 0 {
+			continue
+		}
+
+		ratio := min(float64(score.hits)/float64(shorter), 1)
+		if ratio < minRatio {
+			continue
+		}
+
+		duplicates = append(duplicates, Duplicate{
+			Song:         songsByID[key.low],
+			Other:        songsByID[key.high],
+			SongHashes:   hashCounts[key.low],
+			OtherHashes:  hashCounts[key.high],
+			AlignedHits:  score.hits,
+			AlignedRatio: ratio,
+			OffsetMs:     score.offsetMs,
+		})
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].AlignedRatio != duplicates[j].AlignedRatio {
+			return duplicates[i].AlignedRatio > duplicates[j].AlignedRatio
+		}
+		return duplicates[i].Song.ID < duplicates[j].Song.ID
+	})
+
+	return duplicates, nil
+}
+
+// Keeper returns the song of the pair to keep, the one with the most
+// hashes (the longest or fullest version), and the one to remove, with the
+// offset to add to times of the removed song to get times of the kept one.
+func (d Duplicate) Keeper() (keep, remove db.SongWithID, offsetMs int64) {
+	if d.OtherHashes >= d.SongHashes {
+		return d.Other, d.Song, d.OffsetMs
+	}
+	return d.Song, d.Other, -d.OffsetMs
+}
+
+// MergeSongs moves the fingerprints of the song remove onto the song keep,
+// shifting them by offsetMs so that they line up, then deletes remove.
+// Queries matching either recording are then reported as keep.
+func MergeSongs(ctx context.Context, dbClient db.DBClient, keep, remove uint32, offsetMs int64) error {
+	fingerprints, err := dbClient.GetSongFingerprints(ctx, remove)
+	if err != nil {
+		return fmt.Errorf("error getting fingerprints of song %d: %v", remove, err)
+	}
+
+	moved := map[uint32][]models.Couple{}
+	for address, couples := range fingerprints {
+		for _, couple := range couples {
+			anchorTimeMs := int64(couple.AnchorTimeMs) + offsetMs
+			if anchorTimeMs < 0 {
+				continue
+			}
+			moved[address] = append(moved[address], models.Couple{AnchorTimeMs: uint32(anchorTimeMs), SongID: keep})
+		}
+	}
+
+	if err := dbClient.StoreFingerprints(ctx, moved); err != nil {
+		return fmt.Errorf("error storing fingerprints of song %d: %v", keep, err)
+	}
+
+	return dbClient.DeleteSongByID(ctx, remove)
+}
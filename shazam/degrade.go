@@ -0,0 +1,129 @@
+package shazam
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Degradation alters a clip the way a poor recording would, for the
+// benchmark. It may change the sample rate of the clip; rng provides the
+// randomness, so that a seeded run is reproducible.
+type Degradation struct {
+	Name  string
+	Apply func(samples []float64, sampleRate int, rng *rand.Rand) ([]float64, int, error)
+}
+
+// AddNoise adds white noise at snrDb below the level of the clip.
+func AddNoise(snrDb float64) Degradation {
+	return Degradation{
+		Name: fmt.Sprintf("noise:%g", snrDb),
+		Apply: func(samples []float64, sampleRate int, rng *rand.Rand) ([]float64, int, error) {
+			noiseRMS := rms(samples) / math.Pow(10, snrDb/20)
+
+			noisy := make([]float64, len(samples))
+			for i, x := range samples {
+				noisy[i] = x + noiseRMS*rng.NormFloat64()
+			}
+			return noisy, sampleRate, nil
+		},
+	}
+}
+
+// Gain scales the clip by gainDb, clipping it to full scale as a 16-bit
+// recording would.
+func Gain(gainDb float64) Degradation {
+	return Degradation{
+		Name: fmt.Sprintf("gain:%g", gainDb),
+		Apply: func(samples []float64, sampleRate int, rng *rand.Rand) ([]float64, int, error) {
+			factor := math.Pow(10, gainDb/20)
+
+			scaled := make([]float64, len(samples))
+			for i, x := range samples {
+				scaled[i] = math.Max(-1, math.Min(1, x*factor))
+			}
+			return scaled, sampleRate, nil
+		},
+	}
+}
+
+// LowPass removes the content of the clip above cutoffHz.
+func LowPass(cutoffHz float64) Degradation {
+	return Degradation{
+		Name: fmt.Sprintf("lowpass:%g", cutoffHz),
+		Apply: func(samples []float64, sampleRate int, rng *rand.Rand) ([]float64, int, error) {
+			filtered, err := Resample(samples, sampleRate, sampleRate, cutoffHz)
+			return filtered, sampleRate, err
+		},
+	}
+}
+
+// ResampleTo converts the clip to sampleRate, as a recording made at that
+// rate would be received.
+func ResampleTo(rate int) Degradation {
+	return Degradation{
+		Name: fmt.Sprintf("resample:%d", rate),
+		Apply: func(samples []float64, sampleRate int, rng *rand.Rand) ([]float64, int, error) {
+			resampled, err := Resample(samples, sampleRate, rate, float64(min(rate, sampleRate))/2)
+			return resampled, rate, err
+		},
+	}
+}
+
+// ParseDegradations builds a chain of degradations from a comma-separated
+// list such as "noise:10,gain:-6,lowpass:4000,resample:8000", applied in
+// order. An empty spec, or "clean", gives no degradation.
+func ParseDegradations(spec string) ([]Degradation, error) {
+	var degradations []Degradation
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || item == "clean" {
+			continue
+		}
+
+		name, value, found := strings.Cut(item, ":")
+		if !found {
+			return nil, fmt.Errorf("degradation %q has no value", item)
+		}
+		parameter, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for degradation %q: %v", item, err)
+		}
+
+		switch name {
+		case "noise":
+			degradations = append(degradations, AddNoise(parameter))
+		case "gain":
+			degradations = append(degradations, Gain(parameter))
+		case "lowpass":
+			if parameter <= 0 {
+				return nil, fmt.Errorf("low-pass cutoff must be positive, got %g", parameter)
+			}
+			degradations = append(degradations, LowPass(parameter))
+		case "resample":
+			if parameter < 1 || parameter != math.Trunc(parameter) {
+				return nil, fmt.Errorf("resampling rate must be a positive integer, got %g", parameter)
+			}
+			degradations = append(degradations, ResampleTo(int(parameter)))
+		default:
+			return nil, fmt.Errorf("unknown degradation %q", name)
+		}
+	}
+
+	return degradations, nil
+}
+
+// rms returns the root mean square level of samples.
+func rms(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, x := range samples {
+		sum += x * x
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
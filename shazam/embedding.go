@@ -0,0 +1,220 @@
+package shazam
+
+import (
+	"math"
+	"math/cmplx"
+	"song-recognition/models"
+)
+
+const (
+	// EmbeddingVersion identifies the features of an embedding. It changes
+	// whenever they do, so that embeddings computed differently are never
+	// compared.
+	EmbeddingVersion = 1
+
+	// embeddingMelBands is the number of mel bands the spectrum is summed
+	// into, and embeddingCoefficients the number of cepstral coefficients
+	// kept from them, the first, overall loudness, excluded.
+	embeddingMelBands     = 26
+	embeddingCoefficients = 12
+
+	// embeddingRolloff is the share of the energy of a frame below its
+	// rolloff frequency.
+	embeddingRolloff = 0.85
+)
+
+// Features of each frame, after the cepstral coefficients.
+const (
+	featureCentroid = embeddingCoefficients + iota
+	featureSpread
+	featureRolloff
+	featureFlatness
+	featureFlux
+	numFrameFeatures
+)
+
+// featureStats accumulates the mean and standard deviation of a feature.
+type featureStats struct {
+	n          int
+	sum, sumSq float64
+}
+
+func (s *featureStats) add(value float64) {
+	s.n++
+	s.sum += value
+	s.sumSq += value * value
+}
+
+func (s featureStats) meanStd() (float64, float64) {
+	if s.n == 0 {
+		return 0, 0
+	}
+	mean := s.sum / float64(s.n)
+	return mean, math.Sqrt(math.Max(s.sumSq/float64(s.n)-mean*mean, 0))
+}
+
+// embeddingAccumulator computes the cepstral coefficients and spectral shape
+// of STFT frames, and the statistics of each over the frames that are not
+// silent.
+type embeddingAccumulator struct {
+	freqs   []float64   // centre frequency of each analysed bin
+	filters [][]float64 // weight of each analysed bin in each mel band
+	maxFreq float64
+	scale   float64 // turns bin magnitudes into sinusoid amplitudes
+
+	previous []float64 // unit-length magnitudes of the last frame, for the flux
+	stats    [numFrameFeatures]featureStats
+}
+
+func newEmbeddingAccumulator(sampleRate int, opts STFTOptions, maxFreq float64) *embeddingAccumulator {
+	maxFreq = math.Min(maxFreq, float64(sampleRate)/2)
+	bins := min(int(maxFreq*float64(opts.FrameSize)/float64(sampleRate)), opts.FrameSize/2) + 1
+
+	freqs := make([]float64, bins)
+	for bin := range freqs {
+		freqs[bin] = float64(bin) * float64(sampleRate) / float64(opts.FrameSize)
+	}
+
+	return &embeddingAccumulator{
+		freqs:   freqs,
+		filters: melFilters(freqs, maxFreq),
+		maxFreq: maxFreq,
+		scale:   2 / float64(opts.FrameSize),
+	}
+}
+
+// melFilters returns triangular filters over the bins at freqs, spaced
+// evenly on the mel scale up to maxFreq.
+func melFilters(freqs []float64, maxFreq float64) [][]float64 {
+	mel := func(freq float64) float64 { return 2595 * math.Log10(1+freq/700) }
+	hz := func(mel float64) float64 { return 700 * (math.Pow(10, mel/2595) - 1) }
+
+	edges := make([]float64, embeddingMelBands+2)
+	for i := range edges {
+		edges[i] = hz(mel(maxFreq) * float64(i) / float64(len(edges)-1))
+	}
+
+	filters := make([][]float64, embeddingMelBands)
+	for band := range filters {
+		low, centre, high := edges[band], edges[band+1], edges[band+2]
+		filters[band] = make([]float64, len(freqs))
+		for bin, freq := range freqs {
+			switch {
+			case freq > low && freq <= centre:
+				filters[band][bin] = (freq - low) / (centre - low)
+			case freq > centre && freq < high:
+				filters[band][bin] = (high - freq) / (high - centre)
+			}
+		}
+	}
+	return filters
+}
+
+// push adds the features of one STFT frame, unless it is silent.
+func (e *embeddingAccumulator) push(spectrum []complex128, _ float64) {
+	magnitudes := make([]float64, len(e.freqs))
+	powers := make([]float64, len(e.freqs))
+	var total float64
+	for bin := range powers {
+		if bin < len(spectrum) {
+			magnitudes[bin] = cmplx.Abs(spectrum[bin]) * e.scale
+		}
+		powers[bin] = magnitudes[bin] * magnitudes[bin]
+		total += powers[bin]
+	}
+	if total < math.Pow(10, silenceFloorDb/10) {
+		e.previous = nil
+		return
+	}
+
+	bands := make([]float64, embeddingMelBands)
+	for band, filter := range e.filters {
+		var energy float64
+		for bin, weight := range filter {
+			energy += weight * powers[bin]
+		}
+		bands[band] = math.Log(energy + 1e-12)
+	}
+	for k := 1; k <= embeddingCoefficients; k++ {
+		var coefficient float64
+		for band, energy := range bands {
+			coefficient += energy * math.Cos(math.Pi*float64(k)*(float64(band)+0.5)/embeddingMelBands)
+		}
+		e.stats[k-1].add(coefficient * math.Sqrt(2.0/embeddingMelBands))
+	}
+
+	var centroid, logSum float64
+	for bin, power := range powers {
+		centroid += e.freqs[bin] * power / total
+		logSum += math.Log(power + 1e-12)
+	}
+	var spread, cumulative float64
+	rolloff := e.maxFreq
+	for bin, power := range powers {
+		spread += (e.freqs[bin] - centroid) * (e.freqs[bin] - centroid) * power / total
+		cumulative += power
+		if cumulative >= embeddingRolloff*total && rolloff == e.maxFreq {
+			rolloff = e.freqs[bin]
+		}
+	}
+	e.stats[featureCentroid].add(centroid / e.maxFreq)
+	e.stats[featureSpread].add(math.Sqrt(spread) / e.maxFreq)
+	e.stats[featureRolloff].add(rolloff / e.maxFreq)
+	e.stats[featureFlatness].add(math.Exp(logSum/float64(len(powers))) / (total / float64(len(powers))))
+
+	norm := math.Sqrt(total)
+	for bin := range magnitudes {
+		magnitudes[bin] /= norm
+	}
+	if e.previous != nil {
+		var flux float64
+		for bin, magnitude := range magnitudes {
+			flux += (magnitude - e.previous[bin]) * (magnitude - e.previous[bin])
+		}
+		e.stats[featureFlux].add(math.Sqrt(flux))
+	}
+	e.previous = magnitudes
+}
+
+// summary returns the mean and standard deviation of each feature over the
+// frames pushed so far.
+func (e *embeddingAccumulator) summary() models.Embedding {
+	values := make([]float64, 0, 2*numFrameFeatures)
+	for _, stats := range e.stats {
+		mean, std := stats.meanStd()
+		values = append(values, mean, std)
+	}
+	return models.Embedding{Version: EmbeddingVersion, Values: values}
+}
+
+// embeddingExtractor computes the embedding of audio at the analysis rate
+// of a fingerprint config, over the frames of its spectrogram.
+type embeddingExtractor struct {
+	framer *stftFramer
+	acc    *embeddingAccumulator
+}
+
+func newEmbeddingExtractor(config FingerprintConfig) (*embeddingExtractor, error) {
+	opts := STFTOptionsFromConfig(config)
+	framer, err := newSTFTFramer(config.AnalysisRate, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &embeddingExtractor{
+		framer: framer,
+		acc:    newEmbeddingAccumulator(config.AnalysisRate, opts, config.MaxFreq),
+	}, nil
+}
+
+func (e *embeddingExtractor) write(samples []float64) error {
+	return e.framer.write(samples, e.acc.push)
+}
+
+func (e *embeddingExtractor) flush() error {
+	return e.framer.flush(e.acc.push)
+}
+
+func (e *embeddingExtractor) embedding() models.Embedding {
+	return e.acc.summary()
+}
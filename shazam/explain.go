@@ -0,0 +1,147 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/db"
+	"sort"
+)
+
+// Explanation details how a query was scored against its strongest
+// candidates, whether or not they were reported as matches.
+type Explanation struct {
+	QueryPeaks int                    `json:"queryPeaks"`
+	Transforms int                    `json:"transforms"`
+	BinMs      int                    `json:"binMs"`
+	Candidates []CandidateExplanation `json:"candidates"`
+}
+
+// CandidateExplanation is the evidence for one candidate song. Query times
+// are those of the query under the transform the song was scored with.
+// WinningBinMs is the start of the histogram bin which, merged with the
+// next one, gave the offset of the song; the hashes in either are Aligned.
+type CandidateExplanation struct {
+	Rank         int            `json:"rank"`
+	SongID       uint32         `json:"songId"`
+	SongTitle    string         `json:"title"`
+	SongArtist   string         `json:"artist"`
+	Matched      bool           `json:"matched"`
+	Confidence   float64        `json:"confidence"`
+	QueryHashes  int            `json:"queryHashes"`
+	AlignedHits  int            `json:"alignedHits"`
+	AlignedRatio float64        `json:"alignedRatio"`
+	OffsetMs     int64          `json:"offsetMs"`
+	Speed        float64        `json:"speed"`
+	Pitch        float64        `json:"pitch"`
+	WinningBinMs int64          `json:"winningBinMs"`
+	Histogram    []HistogramBin `json:"histogram"`
+	Hits         []HashHit      `json:"hits"`
+}
+
+// HistogramBin is one bin of the offset histogram of a candidate.
+type HistogramBin struct {
+	OffsetMs int64 `json:"offsetMs"` // start of the bin
+	Count    int   `json:"count"`
+}
+
+// HashHit is a query hash found under the same address in a candidate song.
+type HashHit struct {
+	Address     uint32 `json:"address"`
+	QueryTimeMs uint32 `json:"queryTimeMs"`
+	RefTimeMs   uint32 `json:"refTimeMs"`
+	Aligned     bool   `json:"aligned"`
+}
+
+// explain explains how the top candidates of the query, by aligned hashes,
+// were scored, whether or not they reach the minimum confidence of opts.
+func (q *queryScores) explain(ctx context.Context, dbClient db.DBClient, queryPeaks int, opts MatchOptions, top int) (*Explanation, error) {
+	ranked := q.ranked
+	if top > 0 && len(ranked) > top {
+		ranked = ranked[:top]
+	}
+
+	explanation := &Explanation{
+		QueryPeaks: queryPeaks,
+		Transforms: len(q.transforms),
+		BinMs:      offsetBinMs,
+		Candidates: make([]CandidateExplanation, 0, len(ranked)),
+	}
+
+	for i, c := range ranked {
+		confidence := q.confidence(c)
+
+		candidate := CandidateExplanation{
+			Rank:         i + 1,
+			SongID:       c.songID,
+			Matched:      confidence >= opts.MinConfidence,
+			Confidence:   confidence,
+			QueryHashes:  c.hashes,
+			AlignedHits:  c.score.Hits,
+			AlignedRatio: c.score.AlignedRatio,
+			OffsetMs:     c.score.OffsetMs,
+			Speed:        c.transform.Tempo,
+			Pitch:        c.transform.Pitch,
+		}
+
+		song, songExists, err := dbClient.GetSongByID(ctx, c.songID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get song by ID (%v): %v", c.songID, err)
+		}
+		if songExists {
+			candidate.SongTitle, candidate.SongArtist = song.Title, song.Artist
+		}
+
+		q.explainHits(&candidate, c.variant)
+		explanation.Candidates = append(explanation.Candidates, candidate)
+	}
+
+	return explanation, nil
+}
+
+// explainHits fills in the hits and offset histogram of a candidate from
+// the fingerprints of the query variant it was scored with, binned as
+// scoreOffsets bins them.
+func (q *queryScores) explainHits(candidate *CandidateExplanation, variant int) {
+	histogram := offsetHistogram{}
+	var bins []int64 // bin of each hit
+	for address, queryCouples := range q.variants[variant] {
+		for _, queryCouple := range queryCouples {
+			for _, couple := range q.couples[address] {
+				if couple.SongID != candidate.SongID {
+					continue
+				}
+
+				bins = append(bins, histogram.add(int64(couple.AnchorTimeMs)-int64(queryCouple.AnchorTimeMs)))
+				candidate.Hits = append(candidate.Hits, HashHit{
+					Address:     address,
+					QueryTimeMs: queryCouple.AnchorTimeMs,
+					RefTimeMs:   couple.AnchorTimeMs,
+				})
+			}
+		}
+	}
+
+	best, _ := histogram.winner()
+	candidate.WinningBinMs = best * offsetBinMs
+
+	for i, bin := range bins {
+		candidate.Hits[i].Aligned = aligned(bin, best)
+	}
+	sort.Slice(candidate.Hits, func(i, j int) bool {
+		a, b := candidate.Hits[i], candidate.Hits[j]
+		if a.QueryTimeMs != b.QueryTimeMs {
+			return a.QueryTimeMs < b.QueryTimeMs
+		}
+		if a.RefTimeMs != b.RefTimeMs {
+			return a.RefTimeMs < b.RefTimeMs
+		}
+		return a.Address < b.Address
+	})
+
+	for bin, b := range histogram {
+		candidate.Histogram = append(candidate.Histogram, HistogramBin{OffsetMs: bin * offsetBinMs, Count: b.count})
+	}
+	sort.Slice(candidate.Histogram, func(i, j int) bool {
+		return candidate.Histogram[i].OffsetMs < candidate.Histogram[j].OffsetMs
+	})
+}
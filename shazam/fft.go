@@ -1,45 +1,127 @@
 package shazam
 
 import (
+	"fmt"
 	"math"
+	"math/cmplx"
+	"sync"
 )
 
-// Fft performs the Fast Fourier Transform on the input signal.
-func FFT(input []float64) []complex128 {
-	// Convert input to complex128
-	complexArray := make([]complex128, len(input))
+// twiddleCache maps an FFT size n to its twiddle factors exp(-2πik/n), k < n/2.
+var twiddleCache sync.Map
+
+// twiddles returns the (shared, read-only) twiddle factors for an FFT of size n.
+func twiddles(n int) []complex128 {
+	if cached, ok := twiddleCache.Load(n); ok {
+		return cached.([]complex128)
+	}
+
+	factors := make([]complex128, n/2)
+	for k := range factors {
+		angle := -2 * math.Pi * float64(k) / float64(n)
+		factors[k] = complex(math.Cos(angle), math.Sin(angle))
+	}
+
+	cached, _ := twiddleCache.LoadOrStore(n, factors)
+	return cached.([]complex128)
+}
+
+// checkFFTSize returns an error unless n is a positive power of two.
+func checkFFTSize(n int) error {
+	if n <= 0 || n&(n-1) != 0 {
+		return fmt.Errorf("unsupported FFT size %d: input length must be a power of two", n)
+	}
+	return nil
+}
+
+// FFT performs the Fast Fourier Transform on the input signal and returns
+// all len(input) frequency bins. The input length must be a power of two.
+func FFT(input []float64) ([]complex128, error) {
+	if err := checkFFTSize(len(input)); err != nil {
+		return nil, err
+	}
+
+	fftResult := make([]complex128, len(input))
 	for i, v := range input {
-		complexArray[i] = complex(v, 0)
+		fftResult[i] = complex(v, 0)
 	}
 
-	fftResult := make([]complex128, len(complexArray))
-	copy(fftResult, complexArray) // Copy input to result buffer
-	return recursiveFFT(fftResult)
+	fftInPlace(fftResult)
+	return fftResult, nil
 }
 
-// recursiveFFT performs the recursive FFT algorithm.
-func recursiveFFT(complexArray []complex128) []complex128 {
-	N := len(complexArray)
-	if N <= 1 {
-		return complexArray
+// RealFFT performs the Fast Fourier Transform on a real input signal and
+// returns only the len(input)/2+1 non-redundant bins, from DC to Nyquist.
+// The input length must be a power of two.
+//
+// The even and odd samples are packed into a complex signal of half the
+// length, transformed, and the two interleaved spectra are then separated.
+func RealFFT(input []float64) ([]complex128, error) {
+	n := len(input)
+	if err := checkFFTSize(n); err != nil {
+		return nil, err
+	}
+	if n == 1 {
+		return []complex128{complex(input[0], 0)}, nil
 	}
 
-	even := make([]complex128, N/2)
-	odd := make([]complex128, N/2)
-	for i := 0; i < N/2; i++ {
-		even[i] = complexArray[2*i]
-		odd[i] = complexArray[2*i+1]
+	m := n / 2
+	packed := make([]complex128, m)
+	for i := range packed {
+		packed[i] = complex(input[2*i], input[2*i+1])
 	}
+	fftInPlace(packed)
+
+	tw := twiddles(n)
+	fftResult := make([]complex128, m+1)
+	for k := 0; k <= m; k++ {
+		zk := packed[k%m]
+		zc := cmplx.Conj(packed[(m-k)%m])
 
-	even = recursiveFFT(even)
-	odd = recursiveFFT(odd)
+		even := (zk + zc) / 2
+		odd := (zk - zc) / complex(0, 2)
 
-	fftResult := make([]complex128, N)
-	for k := 0; k < N/2; k++ {
-		t := complex(math.Cos(-2*math.Pi*float64(k)/float64(N)), math.Sin(-2*math.Pi*float64(k)/float64(N)))
-		fftResult[k] = even[k] + t*odd[k]
-		fftResult[k+N/2] = even[k] - t*odd[k]
+		if k == m {
+			fftResult[k] = even - odd
+		} else {
+			fftResult[k] = even + tw[k]*odd
+		}
 	}
 
-	return fftResult
+	return fftResult, nil
+}
+
+// fftInPlace runs an iterative radix-2 decimation-in-time FFT over x,
+// whose length must be a power of two.
+func fftInPlace(x []complex128) {
+	n := len(x)
+	if n <= 1 {
+		return
+	}
+
+	// Reorder the input in bit-reversed index order
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	tw := twiddles(n)
+	for size := 2; size <= n; size <<= 1 {
+		half := size / 2
+		step := n / size
+		for start := 0; start < n; start += size {
+			for k := 0; k < half; k++ {
+				t := tw[k*step] * x[start+k+half]
+				x[start+k+half] = x[start+k] - t
+				x[start+k] += t
+			}
+		}
+	}
 }
@@ -0,0 +1,79 @@
+package shazam
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// naiveDFT returns the discrete Fourier transform of input, computed from
+// its definition.
+func naiveDFT(input []float64) []complex128 {
+	n := len(input)
+	output := make([]complex128, n)
+	for k := range output {
+		for t, x := range input {
+			angle := -2 * math.Pi * float64(k*t) / float64(n)
+			output[k] += complex(x*math.Cos(angle), x*math.Sin(angle))
+		}
+	}
+	return output
+}
+
+func TestFFTMatchesNaiveDFT(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 4, 8, 16, 64, 256, 1024} {
+		input := make([]float64, n)
+		for i := range input {
+			input[i] = rng.Float64()*2 - 1
+		}
+		want := naiveDFT(input)
+		tolerance := 1e-9 * float64(n)
+
+		full, err := FFT(input)
+		if err != nil {
+			t.Fatalf("FFT of %d samples: %v", n, err)
+		}
+		if len(full) != n {
+			t.Fatalf("FFT of %d samples returned %d bins", n, len(full))
+		}
+		for k := range want {
+			if cmplx.Abs(full[k]-want[k]) > tolerance {
+				t.Fatalf("FFT of %d samples: bin %d = %v, want %v", n, k, full[k], want[k])
+			}
+		}
+
+		bins, err := RealFFT(input)
+		if err != nil {
+			t.Fatalf("RealFFT of %d samples: %v", n, err)
+		}
+		if len(bins) != n/2+1 {
+			t.Fatalf("RealFFT of %d samples returned %d bins, want %d", n, len(bins), n/2+1)
+		}
+		for k := range bins {
+			if cmplx.Abs(bins[k]-want[k]) > tolerance {
+				t.Fatalf("RealFFT of %d samples: bin %d = %v, want %v", n, k, bins[k], want[k])
+			}
+		}
+	}
+}
+
+func TestFFTRejectsOtherSizes(t *testing.T) {
+	for _, n := range []int{0, 3, 6, 100, 1000} {
+		if err := checkFFTSize(n); err == nil {
+			t.Errorf("checkFFTSize(%d) accepted a size that isn't a power of two", n)
+		}
+		if _, err := FFT(make([]float64, n)); err == nil {
+			t.Errorf("FFT of %d samples succeeded", n)
+		}
+		if _, err := RealFFT(make([]float64, n)); err == nil {
+			t.Errorf("RealFFT of %d samples succeeded", n)
+		}
+	}
+	for _, n := range []int{1, 2, 1024} {
+		if err := checkFFTSize(n); err != nil {
+			t.Errorf("checkFFTSize(%d): %v", n, err)
+		}
+	}
+}
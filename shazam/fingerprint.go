@@ -1,30 +1,25 @@
 package shazam
 
 import (
+	"math"
 	"song-recognition/models"
 )
 
-const (
-	maxFreqBits    = 9
-	maxDeltaBits   = 14
-	targetZoneSize = 5
-)
-
-// Fingerprint generates fingerprints from a list of peaks and stores them in an array.
-// The fingerprints are encoded using a 32-bit integer format and stored in an array.
-// Each fingerprint consists of an address and a couple.
-// The address is a hash. The couple contains the anchor time and the song ID.
-func Fingerprint(peaks []Peak, songID uint32) map[uint32]models.Couple {
-	fingerprints := map[uint32]models.Couple{}
+// Fingerprint generates fingerprints from a list of peaks.
+// The fingerprints are keyed by their address, a 32-bit hash of an anchor/target pair.
+// Each address maps to every couple that produced it, so that repeated pairs
+// (sustained notes, loops) are all kept. A couple contains the anchor time and the song ID.
+func Fingerprint(peaks []Peak, songID uint32, config FingerprintConfig) map[uint32][]models.Couple {
+	fingerprints := map[uint32][]models.Couple{}
 
 	for i, anchor := range peaks {
-		for j := i + 1; j < len(peaks) && j <= i+targetZoneSize; j++ {
+		for j := i + 1; j < len(peaks) && j <= i+config.TargetZoneSize; j++ {
 			target := peaks[j]
 
-			address := createAddress(anchor, target)
-			anchorTimeMs := uint32(anchor.Time * 1000)
+			address := createAddress(anchor, target, config)
+			anchorTimeMs := uint32(math.Round(anchor.Time * 1000))
 
-			fingerprints[address] = models.Couple{anchorTimeMs, songID}
+			fingerprints[address] = append(fingerprints[address], models.Couple{AnchorTimeMs: anchorTimeMs, SongID: songID})
 		}
 	}
 
@@ -34,14 +29,25 @@ func Fingerprint(peaks []Peak, songID uint32) map[uint32]models.Couple {
 // createAddress generates a unique address for a pair of anchor and target points.
 // The address is a 32-bit integer where certain bits represent the frequency of
 // the anchor and target points, and other bits represent the time difference (delta time)
-// between them. This function combines these components into a single address (a hash).
-func createAddress(anchor, target Peak) uint32 {
-	anchorFreq := int(real(anchor.Freq))
-	targetFreq := int(real(target.Freq))
-	deltaMs := uint32((target.Time - anchor.Time) * 1000)
+// between them. This function combines these components into a single address (a hash),
+// using config.MaxFreqBits bits per frequency and config.MaxDeltaBits bits for the delta.
+func createAddress(anchor, target Peak, config FingerprintConfig) uint32 {
+	deltaMask := uint32(1)<<config.MaxDeltaBits - 1
+
+	anchorFreq := freqIndex(anchor.FreqBin, config)
+	targetFreq := freqIndex(target.FreqBin, config)
+	deltaMs := uint32(math.Round((target.Time-anchor.Time)*1000)) & deltaMask
 
 	// Combine the frequency of the anchor, target, and delta time into a 32-bit address
-	address := uint32(anchorFreq<<23) | uint32(targetFreq<<14) | deltaMs
+	address := anchorFreq<<(config.MaxFreqBits+config.MaxDeltaBits) | targetFreq<<config.MaxDeltaBits | deltaMs
 
 	return address
 }
+
+// freqIndex scales a frequency bin, from 0 up to the bin of config.MaxFreq,
+// to the config.MaxFreqBits bits available in an address.
+func freqIndex(bin int, config FingerprintConfig) uint32 {
+	numBins := maxFreqBin(config) + 1
+	index := bin * (1 << config.MaxFreqBits) / numBins
+	return uint32(min(index, 1<<config.MaxFreqBits-1))
+}
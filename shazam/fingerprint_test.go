@@ -0,0 +1,144 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/synth"
+	"sort"
+	"testing"
+)
+
+// testDB opens an empty SQLite index, removed at the end of the test.
+func testDB(t *testing.T) *db.SQLiteClient {
+	t.Helper()
+	client, err := db.NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatalf("NewSQLiteClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// testLibrary indexes in client a song of the given length for each seed,
+// leveled as at ingest with the default config recorded, and returns their
+// IDs by seed.
+func testLibrary(t *testing.T, client db.DBClient, seconds float64, seeds ...int64) map[int64]uint32 {
+	t.Helper()
+	ctx := context.Background()
+	if err := client.SetFingerprintConfig(ctx, DefaultFingerprintConfig()); err != nil {
+		t.Fatalf("SetFingerprintConfig: %v", err)
+	}
+	songs := map[int64]uint32{}
+	for _, seed := range seeds {
+		songID, err := client.RegisterSong(ctx, fmt.Sprintf("Song %d", seed), "Synth", fmt.Sprintf("yt%d", seed))
+		if err != nil {
+			t.Fatalf("RegisterSong: %v", err)
+		}
+		song := LevelSamples(synth.Song(seed, seconds, testSampleRate), testSampleRate)
+		if err := client.StoreFingerprints(ctx, testFingerprints(t, song, songID)); err != nil {
+			t.Fatalf("StoreFingerprints: %v", err)
+		}
+		songs[seed] = songID
+	}
+	return songs
+}
+
+// sortCouples orders the couples of each address, which the index does
+// not keep.
+func sortCouples(fingerprints map[uint32][]models.Couple) {
+	for _, couples := range fingerprints {
+		sort.Slice(couples, func(i, j int) bool {
+			if couples[i].AnchorTimeMs != couples[j].AnchorTimeMs {
+				return couples[i].AnchorTimeMs < couples[j].AnchorTimeMs
+			}
+			return couples[i].SongID < couples[j].SongID
+		})
+	}
+}
+
+func TestFingerprintAddresses(t *testing.T) {
+	config := DefaultFingerprintConfig()
+	spectrogram, err := Spectrogram(synth.Song(7, 10, testSampleRate), testSampleRate, config)
+	if err != nil {
+		t.Fatalf("Spectrogram: %v", err)
+	}
+	peaks := ExtractPeaks(spectrogram, config)
+	fingerprints := Fingerprint(peaks, 7, config)
+
+	// Each peak anchors the TargetZoneSize peaks that follow it, fewer at the end
+	zone := config.TargetZoneSize
+	if got, want := countCouples(fingerprints), len(peaks)*zone-zone*(zone+1)/2; got != want {
+		t.Errorf("%d couples for %d peaks, want %d", got, len(peaks), want)
+	}
+
+	// Every address decodes back to the frequencies and distance of its pair
+	freqMask := uint32(1)<<config.MaxFreqBits - 1
+	deltaMask := uint32(1)<<config.MaxDeltaBits - 1
+	for i, anchor := range peaks {
+		for _, target := range peaks[i+1 : min(len(peaks), i+1+config.TargetZoneSize)] {
+			address := createAddress(anchor, target, config)
+			if got := address >> (config.MaxFreqBits + config.MaxDeltaBits) & freqMask; got != freqIndex(anchor.FreqBin, config) {
+				t.Fatalf("anchor frequency of %08x = %d, want %d", address, got, freqIndex(anchor.FreqBin, config))
+			}
+			if got := address >> config.MaxDeltaBits & freqMask; got != freqIndex(target.FreqBin, config) {
+				t.Fatalf("target frequency of %08x = %d, want %d", address, got, freqIndex(target.FreqBin, config))
+			}
+			if got, want := int(address&deltaMask), int(math.Round((target.Time-anchor.Time)*1000)); got != want {
+				t.Fatalf("delta of %08x = %d ms, want %d ms", address, got, want)
+			}
+
+			found := false
+			for _, couple := range fingerprints[address] {
+				found = found || couple == models.Couple{AnchorTimeMs: uint32(math.Round(anchor.Time * 1000)), SongID: 7}
+			}
+			if !found {
+				t.Fatalf("pair at %.3f s is missing under %08x", anchor.Time, address)
+			}
+		}
+	}
+}
+
+func TestFingerprintRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client := testDB(t)
+
+	song := synth.Song(8, 20, testSampleRate)
+	fingerprints := testFingerprints(t, song, 8)
+	if again := testFingerprints(t, song, 8); !reflect.DeepEqual(again, fingerprints) {
+		t.Fatal("fingerprinting the same song twice gave different fingerprints")
+	}
+	if err := client.StoreFingerprints(ctx, fingerprints); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+
+	stored, err := client.GetSongFingerprints(ctx, 8)
+	if err != nil {
+		t.Fatalf("GetSongFingerprints: %v", err)
+	}
+	sortCouples(stored)
+	sortCouples(fingerprints)
+	if !reflect.DeepEqual(stored, fingerprints) {
+		t.Errorf("stored fingerprints differ: %d addresses stored, %d fingerprinted", len(stored), len(fingerprints))
+	}
+
+	// More addresses than fit in one lookup, some of them unknown
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address := range fingerprints {
+		addresses = append(addresses, address, address^0xffffffff)
+	}
+	couples, err := client.GetCouples(ctx, addresses)
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	sortCouples(couples)
+	for address, want := range fingerprints {
+		if !reflect.DeepEqual(couples[address], want) {
+			t.Fatalf("couples of %08x = %v, want %v", address, couples[address], want)
+		}
+	}
+}
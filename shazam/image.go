@@ -1,12 +1,15 @@
 package shazam
 
 import (
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/png"
 	"math"
 	"math/cmplx"
 	"os"
+	"strconv"
 )
 
 // ConvertSpectrogramToImage converts a spectrogram to a heat map image
@@ -52,3 +55,395 @@ func SpectrogramToImage(spectrogram [][]complex128, outputPath string) error {
 
 	return nil
 }
+
+const (
+	// visualizeMaxColumns caps the width of a visualization; longer
+	// spectrograms have several frames merged into each column.
+	visualizeMaxColumns = 3000
+
+	visualizeMarginLeft   = 64
+	visualizeMarginBottom = 32
+	visualizeMarginTop    = 28
+	visualizeMarginRight  = 12
+)
+
+// VisualizeOptions controls what RenderSpectrogram draws.
+type VisualizeOptions struct {
+	// DynamicRangeDb is the range of levels, below the loudest cell, spread
+	// over the colour map. Quieter cells are drawn with its darkest colour.
+	DynamicRangeDb float64
+	// ShowPeaks overlays the constellation peaks.
+	ShowPeaks bool
+	// ShowPairs draws a line from every anchor peak to each of its targets.
+	ShowPairs bool
+	// TimeOffset is added to the times on the time axis, for spectrograms
+	// of a range starting later in a file.
+	TimeOffset float64
+}
+
+// DefaultVisualizeOptions returns an 80 dB range with peaks shown.
+func DefaultVisualizeOptions() VisualizeOptions {
+	return VisualizeOptions{DynamicRangeDb: 80, ShowPeaks: true}
+}
+
+// viridis holds evenly spaced stops of the viridis colour map.
+var viridis = []color.RGBA{
+	{68, 1, 84, 255},
+	{72, 40, 120, 255},
+	{62, 74, 137, 255},
+	{49, 104, 142, 255},
+	{38, 130, 142, 255},
+	{31, 158, 137, 255},
+	{53, 183, 121, 255},
+	{110, 206, 88, 255},
+	{181, 222, 43, 255},
+	{253, 231, 37, 255},
+}
+
+// colormap returns the colour of x, between 0 and 1, in the viridis map.
+func colormap(x float64) color.RGBA {
+	x = math.Max(0, math.Min(1, x)) * float64(len(viridis)-1)
+	i := min(int(x), len(viridis)-2)
+	t := x - float64(i)
+
+	lerp := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + t*(float64(b)-float64(a))))
+	}
+	a, b := viridis[i], viridis[i+1]
+	return color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 255}
+}
+
+// RenderSpectrogram draws the log-magnitude spectrogram of stft up to
+// config.MaxFreq, time running left to right and frequency bottom to top,
+// with time and frequency axes. peaks, which may be nil, are overlaid as
+// opts requires.
+func RenderSpectrogram(stft *STFT, peaks []Peak, config FingerprintConfig, opts VisualizeOptions) (*image.RGBA, error) {
+	if len(stft.Frames) == 0 {
+		return nil, fmt.Errorf("spectrogram is empty")
+	}
+
+	maxBin := min(maxFreqBin(config), len(stft.Frames[0])-1)
+	framesPerColumn := (len(stft.Frames) + visualizeMaxColumns - 1) / visualizeMaxColumns
+	columns := (len(stft.Frames) + framesPerColumn - 1) / framesPerColumn
+	rows := maxBin + 1
+
+	// Levels in dB relative to a full-scale sine, the loudest frame of each column kept
+	scale := 2 / float64(stft.Options.FrameSize)
+	levels := make([][]float64, columns)
+	loudest := math.Inf(-1)
+	for column := range levels {
+		levels[column] = make([]float64, rows)
+		for bin := range levels[column] {
+			levels[column][bin] = math.Inf(-1)
+		}
+
+		for f := column * framesPerColumn; f < min((column+1)*framesPerColumn, len(stft.Frames)); f++ {
+			for bin := 0; bin < rows; bin++ {
+				level := 20 * math.Log10(cmplx.Abs(stft.Frames[f][bin])*scale+1e-12)
+				levels[column][bin] = math.Max(levels[column][bin], level)
+				loudest = math.Max(loudest, level)
+			}
+		}
+	}
+
+	width := visualizeMarginLeft + columns + visualizeMarginRight
+	height := visualizeMarginTop + rows + visualizeMarginBottom
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{255, 255, 255, 255}), image.Point{}, draw.Src)
+
+	for column, columnLevels := range levels {
+		for bin, level := range columnLevels {
+			x := (level - loudest + opts.DynamicRangeDb) / opts.DynamicRangeDb
+			img.SetRGBA(visualizeMarginLeft+column, visualizeMarginTop+rows-1-bin, colormap(x))
+		}
+	}
+
+	frameDuration := float64(stft.Options.HopSize) / float64(stft.SampleRate)
+	toPoint := func(peak Peak) image.Point {
+		column := int(math.Round(peak.Time/frameDuration)) / framesPerColumn
+		return image.Point{X: visualizeMarginLeft + column, Y: visualizeMarginTop + rows - 1 - peak.FreqBin}
+	}
+
+	if opts.ShowPairs {
+		pairColor := color.RGBA{255, 255, 255, 255}
+		for i, anchor := range peaks {
+			for j := i + 1; j < len(peaks) && j <= i+config.TargetZoneSize; j++ {
+				drawLine(img, toPoint(anchor), toPoint(peaks[j]), pairColor, 0.35)
+			}
+		}
+	}
+
+	if opts.ShowPeaks {
+		peakColor := color.RGBA{255, 40, 40, 255}
+		for _, peak := range peaks {
+			p := toPoint(peak)
+			for d := -2; d <= 2; d++ {
+				blend(img, p.X+d, p.Y, peakColor, 1)
+				blend(img, p.X, p.Y+d, peakColor, 1)
+			}
+		}
+	}
+
+	binHz := float64(stft.SampleRate) / float64(stft.Options.FrameSize)
+	duration := float64(columns*framesPerColumn) * frameDuration
+	drawAxes(img,
+		axis{from: opts.TimeOffset, to: opts.TimeOffset + duration, pixels: columns, unit: "s"},
+		axis{from: 0, to: float64(rows) * binHz, pixels: rows},
+		"Hz")
+
+	return img, nil
+}
+
+// axis maps a range of values onto a run of pixels of a plot.
+type axis struct {
+	from, to float64 // values at the start and end of the axis
+	pixels   int
+	unit     string // appended to tick labels
+}
+
+// position returns the offset, in pixels, of value along the axis.
+func (a axis) position(value float64) int {
+	return int(math.Round((value - a.from) / (a.to - a.from) * float64(a.pixels)))
+}
+
+// ticks returns the values of the ticks of the axis, a round step apart
+// with about spacing pixels between them, and the decimals their labels need.
+func (a axis) ticks(spacing int) ([]float64, int) {
+	step := niceStep((a.to - a.from) * float64(spacing) / float64(a.pixels))
+	first := math.Ceil(a.from / step)
+
+	var values []float64
+	for k := first; k*step <= a.to; k++ {
+		values = append(values, k*step)
+	}
+	return values, max(0, -int(math.Floor(math.Log10(step))))
+}
+
+// drawAxes draws the frame of a plot whose area starts at the top-left
+// margins, with ticks about every 80 pixels along x and 50 along y. The
+// y axis runs upwards and title is written above it.
+func drawAxes(img *image.RGBA, x, y axis, title string) {
+	black := color.RGBA{0, 0, 0, 255}
+	left, top := visualizeMarginLeft, visualizeMarginTop
+	bottom := top + y.pixels
+
+	for px := left - 1; px <= left+x.pixels; px++ {
+		img.SetRGBA(px, top-1, black)
+		img.SetRGBA(px, bottom, black)
+	}
+	for py := top - 1; py <= bottom; py++ {
+		img.SetRGBA(left-1, py, black)
+		img.SetRGBA(left+x.pixels, py, black)
+	}
+
+	yTicks, yDecimals := y.ticks(50)
+	for _, value := range yTicks {
+		py := bottom - 1 - min(y.position(value), y.pixels-1)
+		for px := left - 5; px < left-1; px++ {
+			img.SetRGBA(px, py, black)
+		}
+		label := strconv.FormatFloat(value, 'f', yDecimals, 64) + y.unit
+		drawText(img, left-7-textWidth(label), py-glyphHeight, label, black)
+	}
+	drawText(img, left-7-textWidth(title), 2, title, black)
+
+	xTicks, xDecimals := x.ticks(80)
+	for _, value := range xTicks {
+		px := left + x.position(value)
+		for py := bottom + 1; py < bottom+5; py++ {
+			img.SetRGBA(px, py, black)
+		}
+		label := strconv.FormatFloat(value, 'f', xDecimals, 64) + x.unit
+		drawText(img, px-textWidth(label)/2, bottom+8, label, black)
+	}
+}
+
+// niceStep rounds step up to 1, 2 or 5 times a power of ten.
+func niceStep(step float64) float64 {
+	if step <= 0 {
+		return 1
+	}
+
+	magnitude := math.Pow(10, math.Floor(math.Log10(step)))
+	for _, factor := range []float64{1, 2, 5, 10} {
+		if factor*magnitude >= step {
+			return factor * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// blend mixes c into the pixel at (x, y) with the given opacity.
+func blend(img *image.RGBA, x, y int, c color.RGBA, opacity float64) {
+	if !(image.Point{X: x, Y: y}.In(img.Bounds())) {
+		return
+	}
+
+	old := img.RGBAAt(x, y)
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a)*(1-opacity) + float64(b)*opacity))
+	}
+	img.SetRGBA(x, y, color.RGBA{mix(old.R, c.R), mix(old.G, c.G), mix(old.B, c.B), 255})
+}
+
+// drawLine draws a segment from a to b with Bresenham's algorithm.
+func drawLine(img *image.RGBA, a, b image.Point, c color.RGBA, opacity float64) {
+	dx, dy := abs(b.X-a.X), -abs(b.Y-a.Y)
+	sx, sy := 1, 1
+	if a.X > b.X {
+		sx = -1
+	}
+	if a.Y > b.Y {
+		sy = -1
+	}
+
+	err := dx + dy
+	for x, y := a.X, a.Y; ; {
+		blend(img, x, y, c, opacity)
+		if x == b.X && y == b.Y {
+			return
+		}
+		if e2 := 2 * err; e2 >= dy {
+			err += dy
+			x += sx
+		} else {
+			err += dx
+			y += sy
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+const (
+	glyphWidth  = 3
+	glyphHeight = 5
+	glyphScale  = 2
+)
+
+// glyphs is a 3x5 bitmap font for axis labels, one string per row.
+var glyphs = map[rune][glyphHeight]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", ".##", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", ".#.", ".#.", ".#."},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'.': {"...", "...", "...", "...", ".#."},
+	'-': {"...", "...", "###", "...", "..."},
+	's': {"...", ".##", ".#.", "..#", "##."},
+	'H': {"#.#", "#.#", "###", "#.#", "#.#"},
+	'z': {"...", "###", ".#.", "#..", "###"},
+}
+
+// textWidth returns the width, in pixels, of text drawn by drawText.
+func textWidth(text string) int {
+	return len(text) * (glyphWidth + 1) * glyphScale
+}
+
+// drawText draws text with its top-left corner at (x, y).
+func drawText(img *image.RGBA, x, y int, text string, c color.RGBA) {
+	for _, r := range text {
+		glyph := glyphs[r]
+		for row, line := range glyph {
+			for col, pixel := range line {
+				if pixel != '#' {
+					continue
+				}
+				for dy := 0; dy < glyphScale; dy++ {
+					for dx := 0; dx < glyphScale; dx++ {
+						blend(img, x+col*glyphScale+dx, y+row*glyphScale+dy, c, 1)
+					}
+				}
+			}
+		}
+		x += (glyphWidth + 1) * glyphScale
+	}
+}
+
+const (
+	scatterWidth  = 800
+	scatterHeight = 500
+)
+
+// RenderHashScatter plots the hits of an explained candidate, query time
+// against reference time. Hashes of a true match line up on a diagonal,
+// drawn at the candidate offset; aligned hits are red, the others grey.
+func RenderHashScatter(candidate CandidateExplanation) (*image.RGBA, error) {
+	if len(candidate.Hits) == 0 {
+		return nil, fmt.Errorf("candidate %d has no hits", candidate.SongID)
+	}
+
+	x := axis{from: 0, pixels: scatterWidth, unit: "s"}
+	y := axis{from: math.Inf(1), to: math.Inf(-1), pixels: scatterHeight, unit: "s"}
+	for _, hit := range candidate.Hits {
+		x.to = math.Max(x.to, float64(hit.QueryTimeMs)/1000)
+		y.from = math.Min(y.from, float64(hit.RefTimeMs)/1000)
+		y.to = math.Max(y.to, float64(hit.RefTimeMs)/1000)
+	}
+	x.to = math.Max(x.to, 1)
+	y.from = math.Max(math.Floor(y.from)-1, 0)
+	y.to = math.Max(math.Ceil(y.to)+1, y.from+1)
+
+	width := visualizeMarginLeft + scatterWidth + visualizeMarginRight
+	height := visualizeMarginTop + scatterHeight + visualizeMarginBottom
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{255, 255, 255, 255}), image.Point{}, draw.Src)
+
+	toPoint := func(queryTime, refTime float64) image.Point {
+		return image.Point{
+			X: visualizeMarginLeft + x.position(queryTime),
+			Y: visualizeMarginTop + scatterHeight - 1 - y.position(refTime),
+		}
+	}
+
+	// The diagonal of the winning offset, within the plotted range
+	offset := float64(candidate.OffsetMs) / 1000
+	from, to := math.Max(x.from, y.from-offset), math.Min(x.to, y.to-offset)
+	if from < to {
+		drawLine(img, toPoint(from, from+offset), toPoint(to, to+offset), color.RGBA{40, 90, 220, 255}, 0.5)
+	}
+
+	// Aligned hits last, so that they are drawn on top
+	for _, aligned := range []bool{false, true} {
+		c := color.RGBA{160, 160, 160, 255}
+		if aligned {
+			c = color.RGBA{220, 30, 30, 255}
+		}
+
+		for _, hit := range candidate.Hits {
+			if hit.Aligned != aligned {
+				continue
+			}
+			p := toPoint(float64(hit.QueryTimeMs)/1000, float64(hit.RefTimeMs)/1000)
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					blend(img, p.X+dx, p.Y+dy, c, 1)
+				}
+			}
+		}
+	}
+
+	drawAxes(img, x, y, "")
+	return img, nil
+}
+
+// SavePNG writes img to outputPath as a PNG file.
+func SavePNG(img image.Image, outputPath string) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return png.Encode(file, img)
+}
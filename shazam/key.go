@@ -0,0 +1,65 @@
+package shazam
+
+import (
+	"math"
+	"song-recognition/models"
+)
+
+// keyProfiles are the Krumhansl-Kessler probe tone ratings of the pitch
+// classes in a major and a minor key, from the tonic up.
+var keyProfiles = [2][12]float64{
+	{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88},
+	{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17},
+}
+
+var (
+	keyModes  = [2]string{"major", "minor"}
+	noteNames = [12]string{"C", "C#", "D", "Eb", "E", "F", "F#", "G", "Ab", "A", "Bb", "B"}
+)
+
+// estimateKey returns the key whose profile correlates best with the
+// overall pitch class profile of chroma, such as "A minor", or "" when the
+// chroma is silent or flat.
+func estimateKey(chroma models.Chroma) string {
+	var profile [12]float64
+	for _, frame := range chroma.Frames {
+		for class, value := range frame {
+			profile[class] += float64(value)
+		}
+	}
+
+	best, bestKey := 0.0, ""
+	for mode, template := range keyProfiles {
+		for tonic := 0; tonic < 12; tonic++ {
+			var rotated [12]float64
+			for class := range rotated {
+				rotated[class] = template[(class-tonic+12)%12]
+			}
+			if r := correlation(profile, rotated); r > best {
+				best, bestKey = r, noteNames[tonic]+" "+keyModes[mode]
+			}
+		}
+	}
+	return bestKey
+}
+
+// correlation returns the Pearson correlation of a and b, 0 when either is
+// constant.
+func correlation(a, b [12]float64) float64 {
+	var meanA, meanB float64
+	for i := range a {
+		meanA += a[i] / 12
+		meanB += b[i] / 12
+	}
+
+	var cov, varA, varB float64
+	for i := range a {
+		cov += (a[i] - meanA) * (b[i] - meanB)
+		varA += (a[i] - meanA) * (a[i] - meanA)
+		varB += (b[i] - meanB) * (b[i] - meanB)
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varA*varB)
+}
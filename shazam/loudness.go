@@ -0,0 +1,356 @@
+package shazam
+
+import (
+	"context"
+	"io"
+	"math"
+	"song-recognition/models"
+)
+
+const (
+	// loudnessStepSeconds is the resolution of the loudness measurement and
+	// of silence detection, and loudnessBlockSteps the number of steps in
+	// each overlapping block the integrated loudness is gated on.
+	loudnessStepSeconds = 0.1
+	loudnessBlockSteps  = 4
+
+	// loudnessAbsoluteGate, in LUFS, and loudnessRelativeGate, in LU below
+	// the loudness of the blocks above the absolute gate, exclude the quiet
+	// blocks from the integrated loudness, as in ITU-R BS.1770.
+	loudnessAbsoluteGate = -70.0
+	loudnessRelativeGate = -10.0
+
+	// loudnessSilenceRelative is the level, in LU relative to the integrated
+	// loudness, below which a step is silent. Steps below the absolute gate
+	// are always silent.
+	loudnessSilenceRelative = -40.0
+
+	// loudnessMinSilenceSeconds is the length of a silent stretch within a
+	// recording for it to be muted. Silence at the start and the end is
+	// muted whatever its length.
+	loudnessMinSilenceSeconds = 1.0
+
+	// loudnessTarget is the loudness, in LUFS, recordings are normalized to,
+	// and loudnessMaxGain the largest boost, in dB, given to quiet ones, so
+	// that a recording of noise is not blown up.
+	loudnessTarget  = -20.0
+	loudnessMaxGain = 30.0
+
+	// loudnessFadeSeconds is the length of the fades into and out of
+	// muted silence, which keep the edges from adding clicks, and with
+	// them peaks, to the spectrogram.
+	loudnessFadeSeconds = 0.01
+
+	// loudnessPeakFloor is the peak level, in dBFS, reported for digital
+	// silence.
+	loudnessPeakFloor = -120.0
+)
+
+// SilentRegion is a stretch of a recording, in seconds, detected as silent.
+type SilentRegion struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// Loudness is the level of a recording and its silent regions, measured by
+// MeasureLoudness.
+type Loudness struct {
+	// Integrated is the K-weighted, gated loudness of the recording, in
+	// LUFS. It is loudnessAbsoluteGate for recordings that are silent
+	// throughout.
+	Integrated float64 `json:"integrated"`
+	// Peak is the highest sample magnitude, in dBFS.
+	Peak float64 `json:"peak"`
+	// Silences lists the silent regions muted by a Leveler, in order.
+	Silences []SilentRegion `json:"silences"`
+
+	sampleRate int
+	numSamples int
+}
+
+// Silent reports whether no part of the recording reaches the absolute
+// gate.
+func (l Loudness) Silent() bool {
+	return l.Integrated <= loudnessAbsoluteGate
+}
+
+// Gain returns the gain, in dB, that brings the recording to
+// loudnessTarget, or 0 for a silent recording.
+func (l Loudness) Gain() float64 {
+	if l.Silent() {
+		return 0
+	}
+	return math.Min(loudnessTarget-l.Integrated, loudnessMaxGain)
+}
+
+// Summary returns the measurement as stored with a song.
+func (l Loudness) Summary() models.Loudness {
+	var silence float64
+	for _, region := range l.Silences {
+		silence += region.End - region.Start
+	}
+	return models.Loudness{
+		Integrated: math.Round(l.Integrated*10) / 10,
+		Peak:       math.Round(l.Peak*10) / 10,
+		Silence:    math.Round(silence*10) / 10,
+	}
+}
+
+// MeasureLoudness measures a recording held in memory.
+func MeasureLoudness(samples []float64, sampleRate int) Loudness {
+	meter := newLoudnessMeter(sampleRate)
+	meter.write(samples)
+	return meter.summary()
+}
+
+// MeasureLoudnessPCM measures 16-bit little-endian mono PCM read from r
+// until EOF, holding only the current chunk in memory. It stops with the
+// error of ctx once ctx is done.
+func MeasureLoudnessPCM(ctx context.Context, r io.Reader, sampleRate int) (Loudness, error) {
+	meter := newLoudnessMeter(sampleRate)
+	err := readPCM(ctx, r, func(samples []float64) error {
+		meter.write(samples)
+		return nil
+	})
+	if err != nil {
+		return Loudness{}, err
+	}
+	return meter.summary(), nil
+}
+
+// LevelSamples normalizes a recording held in memory and mutes its silent
+// regions, as its Leveler does.
+func LevelSamples(samples []float64, sampleRate int) []float64 {
+	return MeasureLoudness(samples, sampleRate).Leveler().Process(samples)
+}
+
+// biquad is a second-order IIR filter in direct form I.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x1, f.x2 = x, f.x1
+	f.y1, f.y2 = y, f.y1
+	return y
+}
+
+// kWeighting returns the two stages of the K-weighting filter of ITU-R
+// BS.1770, a high shelf modelling the head followed by a high-pass,
+// designed for sampleRate.
+func kWeighting(sampleRate int) [2]biquad {
+	fs := float64(sampleRate)
+
+	// High shelf, +4 dB above about 1.5 kHz
+	k := math.Tan(math.Pi * 1681.974450955533 / fs)
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// High-pass around 38 Hz
+	k = math.Tan(math.Pi * 38.13547087602444 / fs)
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	return [2]biquad{shelf, highPass}
+}
+
+// loudnessMeter accumulates the K-weighted energy of audio delivered in
+// chunks, step by step, and its peak.
+type loudnessMeter struct {
+	sampleRate int
+	stepSize   int
+	filters    [2]biquad
+
+	steps      []float64 // mean square of each complete step
+	stepEnergy float64   // sum of squares of the current step
+	stepCount  int       // samples in the current step
+	peak       float64
+	numSamples int
+}
+
+func newLoudnessMeter(sampleRate int) *loudnessMeter {
+	return &loudnessMeter{
+		sampleRate: sampleRate,
+		stepSize:   max(1, int(math.Round(loudnessStepSeconds*float64(sampleRate)))),
+		filters:    kWeighting(sampleRate),
+	}
+}
+
+func (m *loudnessMeter) write(samples []float64) {
+	for _, x := range samples {
+		m.peak = math.Max(m.peak, math.Abs(x))
+
+		y := m.filters[1].process(m.filters[0].process(x))
+		m.stepEnergy += y * y
+		m.stepCount++
+		if m.stepCount == m.stepSize {
+			m.steps = append(m.steps, m.stepEnergy/float64(m.stepSize))
+			m.stepEnergy, m.stepCount = 0, 0
+		}
+	}
+	m.numSamples += len(samples)
+}
+
+// summary gates the blocks of steps into the integrated loudness and finds
+// the silent regions. A trailing partial step counts as a step of its own.
+func (m *loudnessMeter) summary() Loudness {
+	steps := m.steps
+	if m.stepCount > 0 {
+		steps = append(steps, m.stepEnergy/float64(m.stepCount))
+	}
+
+	var blocks []float64
+	for start := 0; start+loudnessBlockSteps <= len(steps) || (start == 0 && len(steps) > 0); start++ {
+		end := min(start+loudnessBlockSteps, len(steps))
+		var energy float64
+		for _, step := range steps[start:end] {
+			energy += step
+		}
+		blocks = append(blocks, energy/float64(end-start))
+	}
+
+	integrated := loudnessAbsoluteGate
+	if relative, ok := gatedLoudness(blocks, loudnessAbsoluteGate); ok {
+		if gated, ok := gatedLoudness(blocks, math.Max(relative+loudnessRelativeGate, loudnessAbsoluteGate)); ok {
+			integrated = gated
+		}
+	}
+
+	loudness := Loudness{
+		Integrated: integrated,
+		Peak:       math.Max(20*math.Log10(m.peak), loudnessPeakFloor),
+		sampleRate: m.sampleRate,
+		numSamples: m.numSamples,
+	}
+
+	// Silent steps, in runs, up to the end of the recording
+	threshold := math.Max(integrated+loudnessSilenceRelative, loudnessAbsoluteGate)
+	duration := float64(m.numSamples) / float64(m.sampleRate)
+	minSteps := int(math.Ceil(loudnessMinSilenceSeconds / loudnessStepSeconds))
+	for start := 0; start < len(steps); {
+		if energyLoudness(steps[start]) >= threshold {
+			start++
+			continue
+		}
+		end := start
+		for end < len(steps) && energyLoudness(steps[end]) < threshold {
+			end++
+		}
+		if start == 0 || end == len(steps) || end-start >= minSteps {
+			loudness.Silences = append(loudness.Silences, SilentRegion{
+				Start: float64(start*m.stepSize) / float64(m.sampleRate),
+				End:   math.Min(float64(end*m.stepSize)/float64(m.sampleRate), duration),
+			})
+		}
+		start = end
+	}
+
+	return loudness
+}
+
+// gatedLoudness returns the loudness of the mean energy of the blocks
+// louder than gate, and false when there is none.
+func gatedLoudness(blocks []float64, gate float64) (float64, bool) {
+	var energy float64
+	var count int
+	for _, block := range blocks {
+		if energyLoudness(block) > gate {
+			energy += block
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return energyLoudness(energy / float64(count)), true
+}
+
+// energyLoudness converts the mean square of K-weighted samples to LUFS.
+func energyLoudness(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy+1e-20)
+}
+
+// Leveler applies the normalization gain of a Loudness measurement to the
+// recording it was measured on, delivered in chunks, and mutes its silent
+// regions. The timeline is kept, so that times found in the leveled audio
+// hold for the original.
+type Leveler struct {
+	gain     float64
+	silences [][2]int // silent regions, in samples
+	total    int      // samples of the recording
+	fade     int      // samples of each fade
+
+	position int // samples processed so far
+	next     int // first silent region not yet passed
+}
+
+// Leveler returns a Leveler for the recording l was measured on.
+func (l Loudness) Leveler() *Leveler {
+	leveler := &Leveler{
+		gain:  math.Pow(10, l.Gain()/20),
+		total: l.numSamples,
+		fade:  max(1, int(loudnessFadeSeconds*float64(l.sampleRate))),
+	}
+	for _, region := range l.Silences {
+		leveler.silences = append(leveler.silences, [2]int{
+			int(math.Round(region.Start * float64(l.sampleRate))),
+			int(math.Round(region.End * float64(l.sampleRate))),
+		})
+	}
+	return leveler
+}
+
+// Process returns the next chunk of the recording, leveled. A nil Leveler
+// returns the samples unchanged.
+func (l *Leveler) Process(samples []float64) []float64 {
+	if l == nil {
+		return samples
+	}
+
+	leveled := make([]float64, len(samples))
+	for i, x := range samples {
+		leveled[i] = x * l.gain * l.envelope(l.position+i)
+	}
+	l.position += len(samples)
+	return leveled
+}
+
+// envelope returns the factor the silence muting applies at position: 0
+// within a silent region, fading back to 1 towards its edges that border
+// sound.
+func (l *Leveler) envelope(position int) float64 {
+	for l.next < len(l.silences) && l.silences[l.next][1] <= position {
+		l.next++
+	}
+	if l.next == len(l.silences) || position < l.silences[l.next][0] {
+		return 1
+	}
+
+	start, end := l.silences[l.next][0], l.silences[l.next][1]
+	distance := math.MaxInt
+	if start > 0 {
+		distance = position - start
+	}
+	if end < l.total {
+		distance = min(distance, end-1-position)
+	}
+	return 1 - math.Min(float64(distance)/float64(l.fade), 1)
+}
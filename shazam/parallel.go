@@ -0,0 +1,245 @@
+package shazam
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"song-recognition/utils"
+	"strconv"
+)
+
+// parallelSegmentSeconds is the approximate length of the segments long
+// inputs are split into for concurrent peak extraction.
+const parallelSegmentSeconds = 30.0
+
+// FingerprintWorkers returns the number of segments of a song fingerprinted
+// concurrently: FINGERPRINT_WORKERS if set, the number of CPUs otherwise.
+func FingerprintWorkers() int {
+	if value := utils.GetEnv("FINGERPRINT_WORKERS"); value != "" {
+		if workers, err := strconv.Atoi(value); err == nil && workers > 0 {
+			return workers
+		}
+	}
+	return runtime.NumCPU()
+}
+
+// peakSource extracts the peaks of audio delivered in chunks, in time order.
+type peakSource interface {
+	Write(samples []float64) ([]Peak, error)
+	Flush() ([]Peak, error)
+}
+
+// segmentResult is the outcome of the peak extraction of one segment.
+type segmentResult struct {
+	peaks []Peak
+	err   error
+}
+
+// parallelPeakStream is a PeakStream without preprocessing that splits its
+// input into segments of whole density blocks and extracts their peaks on
+// up to workers goroutines. Every segment is computed from enough
+// surrounding input for the resampler, the framing and the peak
+// neighbourhoods to see exactly what they see in a serial run, and results
+// are returned in segment order, so the peaks are identical to PeakStream's.
+type parallelPeakStream struct {
+	config    FingerprintConfig
+	opts      STFTOptions
+	resampler *Resampler
+	workers   int
+
+	radius        int // peak neighbourhood half-width, in frames
+	segmentFrames int // frames owned by each segment, whole density blocks
+
+	input    []float64 // input samples from inputPos on
+	inputPos int
+	received int // input samples received so far
+
+	next    int                  // index of the next segment to dispatch
+	pending []chan segmentResult // dispatched segments, in order
+}
+
+func newParallelPeakStream(sampleRate int, config FingerprintConfig, workers int) (*parallelPeakStream, error) {
+	if err := ValidateConfig(config); err != nil {
+		return nil, err
+	}
+
+	resampler, err := NewResampler(sampleRate, config.AnalysisRate, config.MaxFreq)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create resampler: %v", err)
+	}
+
+	picker := newPeakPicker(config)
+	frameDuration := float64(config.HopSize) / float64(config.AnalysisRate)
+	blocks := max(1, int(math.Round(parallelSegmentSeconds/(frameDuration*float64(picker.blockFrames)))))
+
+	return &parallelPeakStream{
+		config:        config,
+		opts:          STFTOptionsFromConfig(config),
+		resampler:     resampler,
+		workers:       max(1, workers),
+		radius:        picker.radiusTime,
+		segmentFrames: blocks * picker.blockFrames,
+	}, nil
+}
+
+// Write consumes the next chunk of samples, dispatches the segments whose
+// input is now complete and returns the peaks of those finished so far.
+func (p *parallelPeakStream) Write(samples []float64) ([]Peak, error) {
+	p.input = append(p.input, samples...)
+	p.received += len(samples)
+
+	var peaks []Peak
+	for {
+		// The last frame the segment looks at must be made of samples the
+		// resampler can already compute, which also makes it a full frame.
+		end := (p.next+1)*p.segmentFrames + p.radius
+		lastSample := (end-1)*p.opts.HopSize + p.opts.FrameSize - 1
+		if lastSample*p.resampler.down/p.resampler.up+p.resampler.halfTaps >= p.received {
+			break
+		}
+
+		ready, err := p.dispatch(-1)
+		peaks = append(peaks, ready...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ready, err := p.collect(false)
+	return append(peaks, ready...), err
+}
+
+// Flush dispatches the segments left at the end of the stream and returns
+// the remaining peaks, once every segment is finished.
+func (p *parallelPeakStream) Flush() ([]Peak, error) {
+	totalFrames := p.opts.NumFrames(p.resampler.OutputLen(p.received))
+
+	var peaks []Peak
+	for p.next*p.segmentFrames < totalFrames {
+		ready, err := p.dispatch(totalFrames)
+		peaks = append(peaks, ready...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ready, err := p.collect(true)
+	return append(peaks, ready...), err
+}
+
+// dispatch starts the extraction of the next segment, waiting first for a
+// worker to be free. totalFrames is the number of frames of the whole
+// input, or -1 when it is not known yet. The peaks of the segments waited
+// for are returned.
+func (p *parallelPeakStream) dispatch(totalFrames int) ([]Peak, error) {
+	var peaks []Peak
+	for len(p.pending) >= p.workers {
+		result := <-p.pending[0]
+		p.pending = p.pending[1:]
+		if result.err != nil {
+			return nil, result.err
+		}
+		peaks = append(peaks, result.peaks...)
+	}
+
+	owned := p.next * p.segmentFrames
+	ownedEnd := owned + p.segmentFrames
+	first := max(owned-p.radius, 0)
+	end := ownedEnd + p.radius
+	numSamples := -1
+	if totalFrames >= 0 {
+		ownedEnd = min(ownedEnd, totalFrames)
+		end = min(end, totalFrames)
+		numSamples = p.resampler.OutputLen(p.received)
+	}
+
+	// The input of the segment is copied, the buffer being reused
+	input := append([]float64(nil), p.input...)
+	inputPos := p.inputPos
+
+	done := make(chan segmentResult, 1)
+	p.pending = append(p.pending, done)
+	go func() {
+		peaks, err := p.segmentPeaks(input, inputPos, first, owned, ownedEnd, end, numSamples)
+		done <- segmentResult{peaks: peaks, err: err}
+	}()
+	p.next++
+
+	// Drop the input no later segment depends on
+	nextFirst := max(p.next*p.segmentFrames-p.radius, 0)
+	needed := (nextFirst*p.opts.HopSize)*p.resampler.down/p.resampler.up - p.resampler.halfTaps + 1
+	if drop := min(needed-p.inputPos, len(p.input)); drop > 0 {
+		p.input = append(p.input[:0], p.input[drop:]...)
+		p.inputPos += drop
+	}
+
+	return peaks, nil
+}
+
+// collect returns the peaks of the segments finished, in order, stopping at
+// the first one still running unless wait is set.
+func (p *parallelPeakStream) collect(wait bool) ([]Peak, error) {
+	var peaks []Peak
+	for len(p.pending) > 0 {
+		var result segmentResult
+		if wait {
+			result = <-p.pending[0]
+		} else {
+			select {
+			case result = <-p.pending[0]:
+			default:
+				return peaks, nil
+			}
+		}
+
+		p.pending = p.pending[1:]
+		if result.err != nil {
+			return nil, result.err
+		}
+		peaks = append(peaks, result.peaks...)
+	}
+	return peaks, nil
+}
+
+// segmentPeaks returns the peaks of frames [owned, ownedEnd), computed from
+// frames [first, end) of the input held in input, which starts at input
+// sample inputPos. numSamples is the number of analysis samples of the
+// whole input, beyond which frames are zero-padded, or -1 when the segment
+// does not reach the end.
+func (p *parallelPeakStream) segmentPeaks(input []float64, inputPos, first, owned, ownedEnd, end, numSamples int) ([]Peak, error) {
+	from := first * p.opts.HopSize
+	to := (end-1)*p.opts.HopSize + p.opts.FrameSize
+	computed := to
+	if numSamples >= 0 {
+		computed = max(min(to, numSamples), from)
+	}
+	samples := p.resampler.resampleBuffer(input, inputPos, from, computed)
+
+	framer, err := newSTFTFramer(p.config.AnalysisRate, p.opts)
+	if err != nil {
+		return nil, err
+	}
+	framer.frameIdx = first
+
+	// The picker resumes where a serial one would be at frame first
+	picker := newPeakPicker(p.config)
+	picker.firstFrame, picker.numFrames = first, first
+	picker.center = owned
+	picker.blockIndex = owned / picker.blockFrames
+
+	var peaks []Peak
+	handleFrame := func(spectrum []complex128, frameTime float64) {
+		peaks = append(peaks, picker.push(spectrum, frameTime)...)
+	}
+	for f := first; f < end; f++ {
+		start := min((f-first)*p.opts.HopSize, len(samples))
+		if err := framer.transform(samples[start:min(start+p.opts.FrameSize, len(samples))], handleFrame); err != nil {
+			return nil, err
+		}
+	}
+
+	for picker.center < ownedEnd {
+		peaks = append(peaks, picker.evaluate()...)
+	}
+	return append(peaks, picker.finishBlock()...), nil
+}
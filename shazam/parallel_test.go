@@ -0,0 +1,100 @@
+package shazam
+
+import (
+	"context"
+	"reflect"
+	"song-recognition/models"
+	"song-recognition/synth"
+	"testing"
+)
+
+// streamPeaks extracts the peaks of samples with source, written in chunks
+// of chunkSize samples.
+func streamPeaks(t *testing.T, source peakSource, samples []float64, chunkSize int) []Peak {
+	t.Helper()
+	var peaks []Peak
+	for start := 0; start < len(samples); start += chunkSize {
+		chunk, err := source.Write(samples[start:min(start+chunkSize, len(samples))])
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		peaks = append(peaks, chunk...)
+	}
+	rest, err := source.Flush()
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	return append(peaks, rest...)
+}
+
+// testParallelStream returns a parallelPeakStream on 3 workers whose
+// segments span segmentBlocks density blocks, or the default length when 0.
+func testParallelStream(t *testing.T, config FingerprintConfig, segmentBlocks int) *parallelPeakStream {
+	t.Helper()
+	parallel, err := newParallelPeakStream(testSampleRate, config, 3)
+	if err != nil {
+		t.Fatalf("newParallelPeakStream: %v", err)
+	}
+	if segmentBlocks > 0 {
+		parallel.segmentFrames = segmentBlocks * newPeakPicker(config).blockFrames
+	}
+	return parallel
+}
+
+// testSerialPeaks returns the peaks of samples extracted by a PeakStream.
+func testSerialPeaks(t *testing.T, config FingerprintConfig, samples []float64) []Peak {
+	t.Helper()
+	serial, err := NewPeakStream(testSampleRate, config, nil)
+	if err != nil {
+		t.Fatalf("NewPeakStream: %v", err)
+	}
+	return streamPeaks(t, serial, samples, sampleChunkSize)
+}
+
+func TestParallelPeakStreamMatchesSerial(t *testing.T) {
+	config := DefaultFingerprintConfig()
+	song := synth.Mix(synth.Song(20, 65, testSampleRate), synth.PinkNoise(65, testSampleRate, 0.05, 21))
+
+	segmentFrames := testParallelStream(t, config, 0).segmentFrames
+	segmentSamples := segmentFrames * config.HopSize * testSampleRate / config.AnalysisRate
+
+	// Inputs ending just before, on and just after the edge of a full segment
+	for _, extra := range []int{-config.HopSize, -1, 0, 1, config.HopSize} {
+		samples := song[:2*segmentSamples+extra]
+		want := testSerialPeaks(t, config, samples)
+		if got := streamPeaks(t, testParallelStream(t, config, 0), samples, sampleChunkSize); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d samples: %d segmented peaks differ from the %d serial ones", len(samples), len(got), len(want))
+		}
+	}
+}
+
+func TestParallelPeakStreamSegmentEdges(t *testing.T) {
+	config := DefaultFingerprintConfig()
+	song := synth.Mix(synth.Song(23, 30, testSampleRate), synth.PinkNoise(30, testSampleRate, 0.05, 24))
+	want := testSerialPeaks(t, config, song)
+
+	// Segments of one density block put an edge every second, written in
+	// chunks smaller than a frame, of the usual size and all at once
+	for _, chunkSize := range []int{777, sampleChunkSize, len(song)} {
+		if got := streamPeaks(t, testParallelStream(t, config, 1), song, chunkSize); !reflect.DeepEqual(got, want) {
+			t.Errorf("chunks of %d: %d segmented peaks differ from the %d serial ones", chunkSize, len(got), len(want))
+		}
+	}
+}
+
+func TestFingerprintWorkersMatchSerial(t *testing.T) {
+	song := synth.Song(22, 75, testSampleRate)
+
+	fingerprint := func(workers string) map[uint32][]models.Couple {
+		t.Setenv("FINGERPRINT_WORKERS", workers)
+		fingerprints, err := FingerprintSamples(context.Background(), song, testSampleRate, 22, DefaultFingerprintConfig(), nil)
+		if err != nil {
+			t.Fatalf("FingerprintSamples: %v", err)
+		}
+		return fingerprints
+	}
+
+	if serial, segmented := fingerprint("1"), fingerprint("4"); !reflect.DeepEqual(segmented, serial) {
+		t.Errorf("segmented fingerprints differ from serial ones: %d addresses against %d", len(segmented), len(serial))
+	}
+}
@@ -0,0 +1,231 @@
+package shazam
+
+import (
+	"math"
+	"math/cmplx"
+	"sort"
+)
+
+// silenceFloorDb is the level, relative to a full-scale sine, below which a
+// spectrogram cell is never considered a peak.
+const silenceFloorDb = -80.0
+
+// Peak is a point of the constellation map: a spectrogram cell that is
+// louder than its time/frequency neighbourhood.
+type Peak struct {
+	Time      float64 // start of the frame, in seconds
+	FreqBin   int     // frequency bin within the frame
+	FreqHz    float64 // centre frequency of FreqBin
+	Magnitude float64 // level in dB relative to a full-scale sine
+}
+
+// ExtractPeaks extracts the constellation map of a spectrogram computed with
+// the framing of config, typically by Spectrogram.
+func ExtractPeaks(spectrogram *STFT, config FingerprintConfig) []Peak {
+	picker := newPeakPicker(config)
+
+	peaks := []Peak{}
+	for i, frame := range spectrogram.Frames {
+		peaks = append(peaks, picker.push(frame, spectrogram.FrameTimes[i])...)
+	}
+	peaks = append(peaks, picker.flush()...)
+
+	return peaks
+}
+
+// peakPicker finds the constellation peaks of a spectrogram fed one frame
+// at a time. A cell is a candidate when it is the maximum of the
+// neighbourhood spanning PeakNeighborhoodTime seconds and
+// PeakNeighborhoodFreq bins on each side, and exceeds the mean level of the
+// frames of that neighbourhood by PeakThresholdDb. Candidates are then
+// thinned to the PeaksPerSecond strongest of every block of about one
+// second. Every decision only depends on a bounded number of surrounding
+// frames, so the same peaks are found whatever the chunking of the input.
+type peakPicker struct {
+	config      FingerprintConfig
+	maxBin      int // highest bin below config.MaxFreq
+	radiusTime  int // neighbourhood half-width, in frames
+	radiusFreq  int // neighbourhood half-width, in bins
+	blockFrames int // frames per density block
+	blockPeaks  int // peaks kept per density block
+
+	levels     [][]float64 // dB levels of the buffered frames
+	freqMaxima [][]float64 // levels dilated over radiusFreq bins
+	means      []float64   // mean level of each buffered frame
+	times      []float64   // start time of each buffered frame
+	firstFrame int         // absolute index of the first buffered frame
+	numFrames  int         // frames received so far
+	center     int         // next frame to evaluate
+
+	block      []Peak // candidates of the current density block
+	blockIndex int
+}
+
+func newPeakPicker(config FingerprintConfig) *peakPicker {
+	frameDuration := float64(config.HopSize) / float64(config.AnalysisRate)
+	blockFrames := max(1, int(math.Round(1/frameDuration)))
+
+	return &peakPicker{
+		config:      config,
+		maxBin:      maxFreqBin(config),
+		radiusTime:  max(1, int(math.Round(config.PeakNeighborhoodTime/frameDuration))),
+		radiusFreq:  config.PeakNeighborhoodFreq,
+		blockFrames: blockFrames,
+		blockPeaks:  max(1, int(math.Round(float64(config.PeaksPerSecond)*float64(blockFrames)*frameDuration))),
+	}
+}
+
+// push adds the next spectrogram frame, starting at frameTime, and returns
+// the peaks that are final.
+func (p *peakPicker) push(frame []complex128, frameTime float64) []Peak {
+	levels := make([]float64, p.maxBin+1)
+	var sum float64
+	scale := 2 / float64(p.config.FreqBinSize)
+	for bin := range levels {
+		level := 20 * math.Log10(cmplx.Abs(frame[bin])*scale+1e-12)
+		levels[bin] = math.Max(level, silenceFloorDb-40)
+		sum += levels[bin]
+	}
+
+	p.levels = append(p.levels, levels)
+	p.freqMaxima = append(p.freqMaxima, slidingMax(levels, p.radiusFreq))
+	p.means = append(p.means, sum/float64(len(levels)))
+	p.times = append(p.times, frameTime)
+	p.numFrames++
+
+	var peaks []Peak
+	for p.center+p.radiusTime < p.numFrames {
+		peaks = append(peaks, p.evaluate()...)
+	}
+	p.trim()
+
+	return peaks
+}
+
+// flush evaluates the frames left at the end of the input and returns the
+// remaining peaks.
+func (p *peakPicker) flush() []Peak {
+	var peaks []Peak
+	for p.center < p.numFrames {
+		peaks = append(peaks, p.evaluate()...)
+	}
+	return append(peaks, p.finishBlock()...)
+}
+
+// evaluate looks for candidates in the centre frame, using the neighbouring
+// frames available, and returns the peaks of any density block completed.
+func (p *peakPicker) evaluate() []Peak {
+	var peaks []Peak
+	if block := p.center / p.blockFrames; block != p.blockIndex {
+		peaks = p.finishBlock()
+		p.blockIndex = block
+	}
+
+	from := max(p.center-p.radiusTime, 0)
+	to := min(p.center+p.radiusTime, p.numFrames-1)
+
+	var meanSum float64
+	for f := from; f <= to; f++ {
+		meanSum += p.means[f-p.firstFrame]
+	}
+	threshold := math.Max(meanSum/float64(to-from+1)+p.config.PeakThresholdDb, silenceFloorDb)
+
+	levels := p.levels[p.center-p.firstFrame]
+	freqMaxima := p.freqMaxima[p.center-p.firstFrame]
+	for bin, level := range levels {
+		// Cheap test first: the cell must be a maximum within its own frame
+		if level <= threshold || level < freqMaxima[bin] {
+			continue
+		}
+
+		isPeak := true
+		for f := from; f <= to && isPeak; f++ {
+			if f != p.center && p.freqMaxima[f-p.firstFrame][bin] > level {
+				isPeak = false
+			}
+		}
+
+		if isPeak {
+			p.block = append(p.block, Peak{
+				Time:      p.times[p.center-p.firstFrame],
+				FreqBin:   bin,
+				FreqHz:    float64(bin) * float64(p.config.AnalysisRate) / float64(p.config.FreqBinSize),
+				Magnitude: level,
+			})
+		}
+	}
+
+	p.center++
+	return peaks
+}
+
+// finishBlock keeps the strongest candidates of the current density block
+// and returns them in time, then frequency, order.
+func (p *peakPicker) finishBlock() []Peak {
+	block := p.block
+	p.block = nil
+
+	sort.Slice(block, func(i, j int) bool {
+		if block[i].Magnitude != block[j].Magnitude {
+			return block[i].Magnitude > block[j].Magnitude
+		}
+		if block[i].Time != block[j].Time {
+			return block[i].Time < block[j].Time
+		}
+		return block[i].FreqBin < block[j].FreqBin
+	})
+	if len(block) > p.blockPeaks {
+		block = block[:p.blockPeaks]
+	}
+
+	sort.Slice(block, func(i, j int) bool {
+		if block[i].Time != block[j].Time {
+			return block[i].Time < block[j].Time
+		}
+		return block[i].FreqBin < block[j].FreqBin
+	})
+	return block
+}
+
+// trim drops the buffered frames no future evaluation looks at.
+func (p *peakPicker) trim() {
+	drop := p.center - p.radiusTime - p.firstFrame
+	if drop <= 0 {
+		return
+	}
+
+	p.levels = append(p.levels[:0], p.levels[drop:]...)
+	p.freqMaxima = append(p.freqMaxima[:0], p.freqMaxima[drop:]...)
+	p.means = append(p.means[:0], p.means[drop:]...)
+	p.times = append(p.times[:0], p.times[drop:]...)
+	p.firstFrame += drop
+}
+
+// maxFreqBin returns the highest frequency bin below config.MaxFreq.
+func maxFreqBin(config FingerprintConfig) int {
+	bin := int(config.MaxFreq * float64(config.FreqBinSize) / float64(config.AnalysisRate))
+	return min(bin, config.FreqBinSize/2)
+}
+
+// slidingMax returns, for every index, the maximum of values within radius
+// of it, using a monotonic queue.
+func slidingMax(values []float64, radius int) []float64 {
+	result := make([]float64, len(values))
+	queue := make([]int, 0, 2*radius+1) // indices with decreasing values
+
+	next := 0
+	for i := range values {
+		for ; next < len(values) && next <= i+radius; next++ {
+			for len(queue) > 0 && values[queue[len(queue)-1]] <= values[next] {
+				queue = queue[:len(queue)-1]
+			}
+			queue = append(queue, next)
+		}
+		for queue[0] < i-radius {
+			queue = queue[1:]
+		}
+		result[i] = values[queue[0]]
+	}
+
+	return result
+}
@@ -0,0 +1,58 @@
+package shazam
+
+import (
+	"math"
+	"song-recognition/synth"
+	"testing"
+)
+
+func TestExtractPeaksOfToneSequence(t *testing.T) {
+	notes := []synth.Note{
+		{Freq: 440, Duration: 1, Amplitude: 0.5},
+		{Freq: 880, Duration: 1, Amplitude: 0.5},
+		{Freq: 660, Duration: 1, Amplitude: 0.5},
+		{Freq: 1320, Duration: 1, Amplitude: 0.5},
+		{Freq: 330, Duration: 1, Amplitude: 0.5},
+	}
+	config := DefaultFingerprintConfig()
+
+	spectrogram, err := Spectrogram(synth.Tones(notes, testSampleRate), testSampleRate, config)
+	if err != nil {
+		t.Fatalf("Spectrogram: %v", err)
+	}
+	peaks := ExtractPeaks(spectrogram, config)
+
+	// Frames within a note, away from the transitions, only hold its tone
+	frameSeconds := float64(config.FreqBinSize) / float64(config.AnalysisRate)
+	binHz := float64(config.AnalysisRate) / float64(config.FreqBinSize)
+	found := make([]int, len(notes))
+	for _, peak := range peaks {
+		note := int(peak.Time)
+		if note >= len(notes) || peak.Time-float64(note) < 0.05 || peak.Time+frameSeconds > float64(note+1)-0.05 {
+			continue
+		}
+
+		if diff := math.Abs(peak.FreqHz - notes[note].Freq); diff > binHz {
+			t.Errorf("peak at %.3f s: %.1f Hz, want %.0f Hz within %.1f Hz", peak.Time, peak.FreqHz, notes[note].Freq, binHz)
+		}
+		found[note]++
+	}
+
+	for i, count := range found {
+		if count == 0 {
+			t.Errorf("no peak found for the %.0f Hz tone", notes[i].Freq)
+		}
+	}
+}
+
+func TestExtractPeaksOfSilence(t *testing.T) {
+	config := DefaultFingerprintConfig()
+
+	spectrogram, err := Spectrogram(synth.Silence(3, testSampleRate), testSampleRate, config)
+	if err != nil {
+		t.Fatalf("Spectrogram: %v", err)
+	}
+	if peaks := ExtractPeaks(spectrogram, config); len(peaks) != 0 {
+		t.Errorf("found %d peaks in silence, want none", len(peaks))
+	}
+}
@@ -0,0 +1,355 @@
+package shazam
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// dcRemovalPole is the pole of the DC-blocking filter, which puts its
+	// cutoff around 9 Hz at the analysis rate.
+	dcRemovalPole = 0.995
+
+	// preEmphasisCoefficient is the weight of the previous sample subtracted
+	// by the pre-emphasis filter.
+	preEmphasisCoefficient = 0.97
+
+	// noiseWindowSeconds is the span, on each side of a frame, over which
+	// spectral subtraction looks for the quietest frames.
+	noiseWindowSeconds = 2.0
+
+	// noiseQuietFraction is the fraction of the frames of that span, the
+	// quietest ones, averaged into the noise profile.
+	noiseQuietFraction = 0.1
+
+	// noiseOverSubtraction scales the noise profile before it is subtracted.
+	noiseOverSubtraction = 3.0
+
+	// noiseSpectralFloor is the fraction of the noise profile a bin always
+	// keeps, so that subtraction leaves a smooth floor rather than isolated
+	// residual spikes, which would be picked as peaks.
+	noiseSpectralFloor = 0.5
+
+	// whiteningRadiusHz is the half-width of the moving average that gives
+	// the spectral envelope divided out by whitening.
+	whiteningRadiusHz = 350.0
+
+	// whiteningMaxGain bounds the boost whitening gives to the quietest
+	// parts of the spectrum, such as the band above the anti-aliasing cutoff.
+	whiteningMaxGain = 100.0
+)
+
+// Frame is one spectrogram frame flowing through a preprocessing chain.
+type Frame struct {
+	Spectrum []complex128
+	Time     float64 // start of the frame, in seconds
+}
+
+// PreprocessStage is the state of one preprocessing step for one stream.
+// ProcessSamples filters the samples, at the analysis rate, before they are
+// cut into frames. ProcessFrame filters the spectrogram frames; it may hold
+// frames back, for instance to look ahead, and returns them in order once
+// processed. Flush returns the frames still held at the end of the stream.
+// A stage that only works on one representation passes the other through.
+type PreprocessStage interface {
+	ProcessSamples(samples []float64) []float64
+	ProcessFrame(frame Frame) []Frame
+	Flush() []Frame
+}
+
+// Preprocessor creates a preprocessing stage for a new stream analysed with config.
+type Preprocessor func(config FingerprintConfig) PreprocessStage
+
+// PreprocessChain is an ordered list of preprocessors. Their sample filters
+// all run before framing and their frame filters after, each in chain order.
+type PreprocessChain []Preprocessor
+
+var (
+	preprocessorsMu sync.RWMutex
+	preprocessors   = map[string]Preprocessor{
+		"dc":          DCRemoval,
+		"preemphasis": PreEmphasis,
+		"subtract":    SpectralSubtraction,
+		"whiten":      Whitening,
+	}
+)
+
+// RegisterPreprocessor makes a preprocessor available to ParsePreprocessChain under name.
+func RegisterPreprocessor(name string, preprocessor Preprocessor) {
+	preprocessorsMu.Lock()
+	defer preprocessorsMu.Unlock()
+	preprocessors[name] = preprocessor
+}
+
+// ParsePreprocessChain builds a chain from a comma-separated list of
+// preprocessor names, such as "dc,subtract,whiten". An empty spec gives an
+// empty chain.
+func ParsePreprocessChain(spec string) (PreprocessChain, error) {
+	preprocessorsMu.RLock()
+	defer preprocessorsMu.RUnlock()
+
+	var chain PreprocessChain
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		preprocessor, ok := preprocessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown preprocessor %q", name)
+		}
+		chain = append(chain, preprocessor)
+	}
+
+	return chain, nil
+}
+
+// preprocessor runs the stages of a chain over one stream.
+type preprocessor struct {
+	stages []PreprocessStage
+}
+
+func (chain PreprocessChain) start(config FingerprintConfig) *preprocessor {
+	stages := make([]PreprocessStage, len(chain))
+	for i, newStage := range chain {
+		stages[i] = newStage(config)
+	}
+	return &preprocessor{stages: stages}
+}
+
+// samples runs the sample filters of every stage.
+func (p *preprocessor) samples(samples []float64) []float64 {
+	for _, stage := range p.stages {
+		samples = stage.ProcessSamples(samples)
+	}
+	return samples
+}
+
+// frame runs a frame through the frame filters and emits the frames that
+// come out of the last stage.
+func (p *preprocessor) frame(frame Frame, emit func([]complex128, float64)) {
+	p.frames(0, []Frame{frame}, emit)
+}
+
+// flush drains every stage, in order, through the stages that follow it.
+func (p *preprocessor) flush(emit func([]complex128, float64)) {
+	for i, stage := range p.stages {
+		p.frames(i+1, stage.Flush(), emit)
+	}
+}
+
+func (p *preprocessor) frames(from int, frames []Frame, emit func([]complex128, float64)) {
+	for _, stage := range p.stages[from:] {
+		var next []Frame
+		for _, frame := range frames {
+			next = append(next, stage.ProcessFrame(frame)...)
+		}
+		frames = next
+	}
+
+	for _, frame := range frames {
+		emit(frame.Spectrum, frame.Time)
+	}
+}
+
+// sampleStage is the base of stages that only filter samples.
+type sampleStage struct{}
+
+func (sampleStage) ProcessFrame(frame Frame) []Frame { return []Frame{frame} }
+func (sampleStage) Flush() []Frame                   { return nil }
+
+// frameStage is the base of stages that only filter frames.
+type frameStage struct{}
+
+func (frameStage) ProcessSamples(samples []float64) []float64 { return samples }
+func (frameStage) Flush() []Frame                             { return nil }
+
+// DCRemoval removes the DC offset and the lowest rumble with a one-pole
+// high-pass filter.
+func DCRemoval(config FingerprintConfig) PreprocessStage {
+	return &dcRemoval{}
+}
+
+type dcRemoval struct {
+	sampleStage
+	prevInput, prevOutput float64
+}
+
+func (d *dcRemoval) ProcessSamples(samples []float64) []float64 {
+	filtered := make([]float64, len(samples))
+	for i, x := range samples {
+		filtered[i] = x - d.prevInput + dcRemovalPole*d.prevOutput
+		d.prevInput, d.prevOutput = x, filtered[i]
+	}
+	return filtered
+}
+
+// PreEmphasis boosts high frequencies with a first-order difference filter,
+// so that the low end, where most room and road noise lies, weighs less.
+func PreEmphasis(config FingerprintConfig) PreprocessStage {
+	return &preEmphasis{}
+}
+
+type preEmphasis struct {
+	sampleStage
+	prevInput float64
+}
+
+func (p *preEmphasis) ProcessSamples(samples []float64) []float64 {
+	filtered := make([]float64, len(samples))
+	for i, x := range samples {
+		filtered[i] = x - preEmphasisCoefficient*p.prevInput
+		p.prevInput = x
+	}
+	return filtered
+}
+
+// SpectralSubtraction estimates the stationary noise of the recording as
+// the average magnitude spectrum of its quietest frames around each frame,
+// and subtracts it from that frame. Frames are delayed by the look-ahead
+// span, so that the result does not depend on how the stream is chunked.
+func SpectralSubtraction(config FingerprintConfig) PreprocessStage {
+	frameDuration := float64(config.HopSize) / float64(config.AnalysisRate)
+	return &spectralSubtraction{
+		radius: max(1, int(math.Round(noiseWindowSeconds/frameDuration))),
+	}
+}
+
+type spectralSubtraction struct {
+	frameStage
+	radius int // look-ahead and look-behind, in frames
+
+	frames     []Frame     // buffered frames, the first one being frame firstFrame
+	magnitudes [][]float64 // magnitude spectrum of each buffered frame
+	energies   []float64   // energy of each buffered frame
+	firstFrame int
+	numFrames  int // frames received so far
+	next       int // next frame to emit
+}
+
+func (s *spectralSubtraction) ProcessFrame(frame Frame) []Frame {
+	magnitudes := make([]float64, len(frame.Spectrum))
+	var energy float64
+	for bin, value := range frame.Spectrum {
+		magnitudes[bin] = math.Hypot(real(value), imag(value))
+		energy += magnitudes[bin] * magnitudes[bin]
+	}
+
+	s.frames = append(s.frames, frame)
+	s.magnitudes = append(s.magnitudes, magnitudes)
+	s.energies = append(s.energies, energy)
+	s.numFrames++
+
+	var ready []Frame
+	for s.next+s.radius < s.numFrames {
+		ready = append(ready, s.subtract())
+	}
+	s.trim()
+
+	return ready
+}
+
+func (s *spectralSubtraction) Flush() []Frame {
+	var ready []Frame
+	for s.next < s.numFrames {
+		ready = append(ready, s.subtract())
+	}
+	s.trim()
+
+	return ready
+}
+
+// subtract removes the noise profile of its neighbourhood from the next frame.
+func (s *spectralSubtraction) subtract() Frame {
+	from := max(s.next-s.radius, 0)
+	to := min(s.next+s.radius, s.numFrames-1)
+
+	neighbours := make([]int, 0, to-from+1)
+	for f := from; f <= to; f++ {
+		neighbours = append(neighbours, f-s.firstFrame)
+	}
+	sort.SliceStable(neighbours, func(i, j int) bool {
+		return s.energies[neighbours[i]] < s.energies[neighbours[j]]
+	})
+	quietest := neighbours[:max(1, int(float64(len(neighbours))*noiseQuietFraction))]
+
+	frame := s.frames[s.next-s.firstFrame]
+	magnitudes := s.magnitudes[s.next-s.firstFrame]
+	spectrum := make([]complex128, len(frame.Spectrum))
+	for bin, value := range frame.Spectrum {
+		var noise float64
+		for _, f := range quietest {
+			noise += s.magnitudes[f][bin]
+		}
+		noise /= float64(len(quietest))
+
+		magnitude := magnitudes[bin]
+		if magnitude == 0 {
+			continue
+		}
+		cleaned := math.Max(magnitude-noiseOverSubtraction*noise, noiseSpectralFloor*noise)
+		spectrum[bin] = value * complex(cleaned/magnitude, 0)
+	}
+
+	s.next++
+	return Frame{Spectrum: spectrum, Time: frame.Time}
+}
+
+// trim drops the buffered frames no future subtraction looks at.
+func (s *spectralSubtraction) trim() {
+	drop := s.next - s.radius - s.firstFrame
+	if drop <= 0 {
+		return
+	}
+
+	s.frames = append(s.frames[:0], s.frames[drop:]...)
+	s.magnitudes = append(s.magnitudes[:0], s.magnitudes[drop:]...)
+	s.energies = append(s.energies[:0], s.energies[drop:]...)
+	s.firstFrame += drop
+}
+
+// Whitening flattens the spectral envelope of every frame, dividing each
+// bin by the average magnitude of the surrounding bins, while keeping the
+// overall level of the frame. Peaks then stand out of coloured noise, such
+// as engine hum, as much as out of a quiet background.
+func Whitening(config FingerprintConfig) PreprocessStage {
+	binHz := float64(config.AnalysisRate) / float64(config.FreqBinSize)
+	return &whitening{
+		radius: max(1, int(math.Round(whiteningRadiusHz/binHz))),
+	}
+}
+
+type whitening struct {
+	frameStage
+	radius int // envelope half-width, in bins
+}
+
+func (w *whitening) ProcessFrame(frame Frame) []Frame {
+	magnitudes := make([]float64, len(frame.Spectrum))
+	prefix := make([]float64, len(frame.Spectrum)+1)
+	for bin, value := range frame.Spectrum {
+		magnitudes[bin] = math.Hypot(real(value), imag(value))
+		prefix[bin+1] = prefix[bin] + magnitudes[bin]
+	}
+
+	frameMean := prefix[len(magnitudes)] / float64(len(magnitudes))
+	if frameMean == 0 {
+		return []Frame{frame}
+	}
+
+	spectrum := make([]complex128, len(frame.Spectrum))
+	for bin, value := range frame.Spectrum {
+		from := max(bin-w.radius, 0)
+		to := min(bin+w.radius, len(magnitudes)-1)
+		envelope := (prefix[to+1] - prefix[from]) / float64(to-from+1)
+
+		gain := frameMean / math.Max(envelope, frameMean/whiteningMaxGain)
+		spectrum[bin] = value * complex(gain, 0)
+	}
+
+	return []Frame{{Spectrum: spectrum, Time: frame.Time}}
+}
@@ -0,0 +1,220 @@
+package shazam
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	// resampleZeroCrossings is the number of sinc zero crossings kept on each
+	// side of the interpolation kernel. More crossings give a sharper filter.
+	resampleZeroCrossings = 16
+
+	// resampleRolloff keeps the cutoff slightly below the Nyquist frequency of
+	// the slower rate so that the transition band does not alias.
+	resampleRolloff = 0.95
+
+	// kaiserBeta shapes the Kaiser window applied to the sinc kernel
+	// (about 90 dB of stop-band attenuation).
+	kaiserBeta = 8.6
+)
+
+// Resampler converts audio between two sample rates whose ratio is rational,
+// such as 48000→11025 or 22050→11025. Each output sample is interpolated
+// with a Kaiser-windowed sinc kernel which also acts as the anti-aliasing
+// low-pass filter. The kernel is precomputed for every fractional phase
+// (polyphase form).
+//
+// A Resampler can be fed incrementally with Process; it keeps the input it
+// still needs between calls, so chunked and one-shot resampling produce the
+// same samples.
+type Resampler struct {
+	up, down  int         // output/input rate ratio, reduced
+	halfTaps  int         // kernel taps on each side of the interpolated instant
+	phases    [][]float64 // kernel taps for each of the up fractional phases
+	buffer    []float64   // pending input, buffer[0] is input sample bufferPos
+	bufferPos int
+	inputLen  int // input samples received so far
+	next      int // index of the next output sample
+}
+
+// NewResampler creates a resampler from fromRate to toRate that also removes
+// content above cutoffHz. The cutoff is lowered to just below the Nyquist
+// frequency of the slower rate when needed.
+func NewResampler(fromRate, toRate int, cutoffHz float64) (*Resampler, error) {
+	if fromRate <= 0 || toRate <= 0 {
+		return nil, errors.New("sample rates must be positive")
+	}
+	if cutoffHz <= 0 {
+		return nil, errors.New("cutoff frequency must be positive")
+	}
+
+	divisor := gcd(fromRate, toRate)
+	up, down := toRate/divisor, fromRate/divisor
+
+	nyquist := resampleRolloff * 0.5 * float64(min(fromRate, toRate))
+	cutoff := math.Min(cutoffHz, nyquist) / float64(fromRate) // cycles per input sample
+
+	halfTaps := int(math.Ceil(resampleZeroCrossings / (2 * cutoff)))
+	halfWidth := float64(halfTaps)
+
+	phases := make([][]float64, up)
+	for p := range phases {
+		taps := make([]float64, 2*halfTaps)
+		frac := float64(p) / float64(up)
+
+		var sum float64
+		for j := range taps {
+			// Distance, in input samples, between the interpolated instant and
+			// the input sample this tap is applied to.
+			distance := frac + float64(halfTaps-1-j)
+			taps[j] = 2 * cutoff * sinc(2*cutoff*distance) * kaiser(distance/halfWidth)
+			sum += taps[j]
+		}
+
+		// Normalize every phase to unit DC gain
+		for j := range taps {
+			taps[j] /= sum
+		}
+		phases[p] = taps
+	}
+
+	return &Resampler{up: up, down: down, halfTaps: halfTaps, phases: phases}, nil
+}
+
+// Process consumes the next chunk of input and returns the output samples
+// that can be computed so far. Output samples that depend on input not yet
+// received are returned by later calls or by Flush.
+func (r *Resampler) Process(chunk []float64) []float64 {
+	r.buffer = append(r.buffer, chunk...)
+	r.inputLen += len(chunk)
+
+	var output []float64
+	for {
+		base := r.next * r.down / r.up
+		if base+r.halfTaps >= r.inputLen {
+			break
+		}
+		output = append(output, r.sample(r.buffer, r.bufferPos, r.next))
+		r.next++
+	}
+
+	r.discard()
+	return output
+}
+
+// Flush returns the remaining output samples, treating the input as
+// followed by silence. The resampler must not be used afterwards.
+func (r *Resampler) Flush() []float64 {
+	total := r.OutputLen(r.inputLen)
+
+	var output []float64
+	for ; r.next < total; r.next++ {
+		output = append(output, r.sample(r.buffer, r.bufferPos, r.next))
+	}
+
+	r.buffer = nil
+	return output
+}
+
+// OutputLen returns the number of output samples produced for inputLen
+// input samples.
+func (r *Resampler) OutputLen(inputLen int) int {
+	return (inputLen*r.up + r.down - 1) / r.down
+}
+
+// ResampleRange computes output samples [from, to) of resampling the whole
+// input. Input outside of the slice is treated as silence, so the result is
+// identical to the corresponding samples of a Process/Flush run, which lets
+// independent ranges be computed concurrently.
+func (r *Resampler) ResampleRange(input []float64, from, to int) []float64 {
+	return r.resampleBuffer(input, 0, from, to)
+}
+
+// resampleBuffer is ResampleRange for input held in buffer, whose first
+// element is input sample bufferPos.
+func (r *Resampler) resampleBuffer(buffer []float64, bufferPos, from, to int) []float64 {
+	output := make([]float64, 0, max(to-from, 0))
+	for k := from; k < to; k++ {
+		output = append(output, r.sample(buffer, bufferPos, k))
+	}
+	return output
+}
+
+// sample computes output sample k from input held in buffer, whose first
+// element is input sample bufferPos. Input outside the buffer counts as 0.
+func (r *Resampler) sample(buffer []float64, bufferPos, k int) float64 {
+	base := k * r.down / r.up
+	taps := r.phases[k*r.down%r.up]
+	first := base - r.halfTaps + 1
+
+	var acc float64
+	for j, tap := range taps {
+		idx := first + j - bufferPos
+		if idx >= 0 && idx < len(buffer) {
+			acc += tap * buffer[idx]
+		}
+	}
+	return acc
+}
+
+// discard drops buffered input that no future output sample depends on.
+func (r *Resampler) discard() {
+	needed := r.next*r.down/r.up - r.halfTaps + 1
+	drop := needed - r.bufferPos
+	if drop <= 0 {
+		return
+	}
+	if drop > len(r.buffer) {
+		drop = len(r.buffer)
+	}
+
+	r.buffer = append(r.buffer[:0], r.buffer[drop:]...)
+	r.bufferPos += drop
+}
+
+// Resample converts input from fromRate to toRate, removing content above
+// cutoffHz.
+func Resample(input []float64, fromRate, toRate int, cutoffHz float64) ([]float64, error) {
+	resampler, err := NewResampler(fromRate, toRate, cutoffHz)
+	if err != nil {
+		return nil, err
+	}
+
+	return resampler.ResampleRange(input, 0, resampler.OutputLen(len(input))), nil
+}
+
+// sinc is the normalized sinc function sin(πx)/(πx).
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// kaiser evaluates the Kaiser window at x in [-1, 1].
+func kaiser(x float64) float64 {
+	if x < -1 || x > 1 {
+		return 0
+	}
+	return besselI0(kaiserBeta*math.Sqrt(1-x*x)) / besselI0(kaiserBeta)
+}
+
+// besselI0 computes the zeroth order modified Bessel function of the first
+// kind with its power series.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
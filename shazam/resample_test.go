@@ -0,0 +1,95 @@
+package shazam
+
+import (
+	"math"
+	"song-recognition/synth"
+	"testing"
+)
+
+func TestResamplerChunkedMatchesOneShot(t *testing.T) {
+	for _, fromRate := range []int{44100, 48000} {
+		input := synth.Mix(synth.Song(50, 3, fromRate), synth.WhiteNoise(3, fromRate, 0.05, 51))
+		want, err := Resample(input, fromRate, 11025, 5000)
+		if err != nil {
+			t.Fatalf("Resample: %v", err)
+		}
+
+		for _, chunkSize := range []int{1, 777, sampleChunkSize, len(input)} {
+			resampler, err := NewResampler(fromRate, 11025, 5000)
+			if err != nil {
+				t.Fatalf("NewResampler: %v", err)
+			}
+			var got []float64
+			for start := 0; start < len(input); start += chunkSize {
+				got = append(got, resampler.Process(input[start:min(start+chunkSize, len(input))])...)
+			}
+			got = append(got, resampler.Flush()...)
+
+			if len(got) != resampler.OutputLen(len(input)) {
+				t.Errorf("%d Hz in chunks of %d: %d samples, OutputLen says %d", fromRate, chunkSize, len(got), resampler.OutputLen(len(input)))
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%d Hz in chunks of %d: %d samples, want %d", fromRate, chunkSize, len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("%d Hz in chunks of %d: sample %d = %g, want %g", fromRate, chunkSize, i, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestResamplerOutputLen(t *testing.T) {
+	for _, test := range []struct {
+		fromRate, inputLen, want int
+	}{
+		{44100, 0, 0},
+		{44100, 1, 1},
+		{44100, 4, 1},
+		{44100, 5, 2},
+		{44100, 44100, 11025},
+		{48000, 48000, 11025},
+		{48000, 100, 23},
+		{11025, 1000, 1000},
+	} {
+		resampler, err := NewResampler(test.fromRate, 11025, 5000)
+		if err != nil {
+			t.Fatalf("NewResampler: %v", err)
+		}
+		if got := resampler.OutputLen(test.inputLen); got != test.want {
+			t.Errorf("OutputLen(%d) from %d Hz = %d, want %d", test.inputLen, test.fromRate, got, test.want)
+		}
+		if got := len(resampler.ResampleRange(make([]float64, test.inputLen), 0, resampler.OutputLen(test.inputLen))); got != test.want {
+			t.Errorf("%d samples from %d Hz resampled to %d, want %d", test.inputLen, test.fromRate, got, test.want)
+		}
+	}
+}
+
+func TestResamplerCutoff(t *testing.T) {
+	for _, fromRate := range []int{44100, 48000} {
+		for _, test := range []struct {
+			freq    float64
+			minGain float64 // dB
+			maxGain float64 // dB
+		}{
+			{1000, -0.1, 0.1},
+			{4000, -0.1, 0.1},
+			{6000, math.Inf(-1), -60},
+			{9000, math.Inf(-1), -60},
+		} {
+			tone := synth.Tone(test.freq, 2, fromRate, 0.5)
+			output, err := Resample(tone, fromRate, 11025, 5000)
+			if err != nil {
+				t.Fatalf("Resample: %v", err)
+			}
+
+			// The edges, filtered from silence, are left out
+			middle := len(output) / 4
+			gain := 20 * math.Log10(rms(output[middle:3*middle])/rms(tone[len(tone)/4:3*len(tone)/4])+1e-12)
+			if gain < test.minGain || gain > test.maxGain {
+				t.Errorf("%.0f Hz tone from %d Hz: gain %.2f dB, want between %.1f and %.1f dB", test.freq, fromRate, gain, test.minGain, test.maxGain)
+			}
+		}
+	}
+}
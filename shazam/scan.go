@@ -0,0 +1,311 @@
+package shazam
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"song-recognition/db"
+)
+
+const (
+	// scanAlignmentTolerance is how far apart, in seconds, the song starts
+	// implied by two windows can be for the windows to belong to the same
+	// segment. Beyond it the song is considered to have been restarted.
+	scanAlignmentTolerance = 2.0
+)
+
+// ScanOptions controls how ScanPCM and ScanSamples split a long recording.
+type ScanOptions struct {
+	// Window is the length, in seconds, of the audio recognized at a time.
+	Window float64
+	// Hop is the time, in seconds, between the starts of two windows.
+	Hop float64
+	// MaxGap is the number of unrecognized windows a segment may bridge.
+	MaxGap int
+	// MinWindows is the number of windows a segment needs to be reported.
+	MinWindows int
+	// Match is used to recognize every window.
+	Match MatchOptions
+}
+
+// DefaultScanOptions returns 10 second windows every 5 seconds, with the
+// default match options.
+func DefaultScanOptions() ScanOptions {
+	return ScanOptions{
+		Window:     10,
+		Hop:        5,
+		MaxGap:     1,
+		MinWindows: 1,
+		Match:      DefaultMatchOptions(),
+	}
+}
+
+// Segment is a stretch of a long recording recognized as one song. Start
+// and End are in seconds from the start of the recording, SongOffset is the
+// position, in seconds, within the song at Start. Confidence is the mean
+// confidence of the windows that agreed on the song.
+type Segment struct {
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+	SongID     uint32  `json:"songId"`
+	SongTitle  string  `json:"title"`
+	SongArtist string  `json:"artist"`
+	YouTubeID  string  `json:"youtubeId"`
+	SongOffset float64 `json:"songOffset"`
+	Confidence float64 `json:"confidence"`
+	Speed      float64 `json:"speed"`
+	Windows    int     `json:"windows"`
+}
+
+// ScanPCM reads 16-bit little-endian mono PCM from r until EOF, recognizes
+// it window by window and returns the timeline of the songs found. The
+// samples go through leveler first, unless it is nil, so that they are
+// matched at the level songs were fingerprinted at: it is normally made
+// from a first pass of MeasureLoudnessPCM over the recording. It stops with
+// the error of ctx once ctx is done.
+func ScanPCM(ctx context.Context, r io.Reader, sampleRate int, leveler *Leveler, opts ScanOptions) ([]Segment, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	scanner, err := newScanner(ctx, dbClient, sampleRate, leveler, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readPCM(ctx, r, func(samples []float64) error {
+		return scanner.write(ctx, samples)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scanner.finish(ctx)
+}
+
+// ScanSamples is ScanPCM for a recording held in memory, leveled from its
+// own loudness.
+func ScanSamples(ctx context.Context, samples []float64, sampleRate int, opts ScanOptions) ([]Segment, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	scanner, err := newScanner(ctx, dbClient, sampleRate, MeasureLoudness(samples, sampleRate).Leveler(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeChunks(ctx, samples, func(chunk []float64) error {
+		return scanner.write(ctx, chunk)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scanner.finish(ctx)
+}
+
+// windowMatch is the best match of one scan window, if any.
+type windowMatch struct {
+	start, end float64
+	match      *Match
+}
+
+// scanner recognizes the windows of a stream as soon as all their peaks are
+// known. Only the peaks of the windows not yet recognized are kept.
+type scanner struct {
+	dbClient   db.DBClient
+	config     FingerprintConfig
+	opts       ScanOptions
+	sampleRate int
+	leveler    *Leveler
+	peaks      *PeakStream
+
+	pending  []Peak // peaks from the start of the next window on
+	next     int    // index of the next window to recognize
+	received int    // samples received so far
+	windows  []windowMatch
+}
+
+func newScanner(ctx context.Context, dbClient db.DBClient, sampleRate int, leveler *Leveler, opts ScanOptions) (*scanner, error) {
+	if opts.Window <= 0 || opts.Hop <= 0 {
+		return nil, errors.New("scan window and hop must be positive")
+	}
+
+	config, err := QueryConfig(ctx, dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	peaks, err := NewPeakStream(sampleRate, config, opts.Match.Preprocess)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scanner{
+		dbClient:   dbClient,
+		config:     config,
+		opts:       opts,
+		sampleRate: sampleRate,
+		leveler:    leveler,
+		peaks:      peaks,
+	}, nil
+}
+
+func (s *scanner) write(ctx context.Context, samples []float64) error {
+	s.received += len(samples)
+
+	peaks, err := s.peaks.Write(s.leveler.Process(samples))
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, peaks...)
+
+	// Peaks come out in time order, so a window is complete once a peak
+	// past its end has been seen.
+	for len(s.pending) > 0 && s.pending[len(s.pending)-1].Time >= s.windowStart(s.next)+s.opts.Window {
+		if err := s.recognizeWindow(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scanner) finish(ctx context.Context) ([]Segment, error) {
+	peaks, err := s.peaks.Flush()
+	if err != nil {
+		return nil, err
+	}
+	s.pending = append(s.pending, peaks...)
+
+	// Recognize the remaining windows, up to the first one reaching the end.
+	duration := float64(s.received) / float64(s.sampleRate)
+	for s.windowStart(s.next) < duration && (s.next == 0 || s.windowStart(s.next-1)+s.opts.Window < duration) {
+		if err := s.recognizeWindow(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return mergeWindows(s.windows, s.opts, duration), nil
+}
+
+func (s *scanner) windowStart(index int) float64 {
+	return float64(index) * s.opts.Hop
+}
+
+// recognizeWindow matches the peaks of the next window and moves on.
+func (s *scanner) recognizeWindow(ctx context.Context) error {
+	start := s.windowStart(s.next)
+	end := start + s.opts.Window
+
+	var windowPeaks []Peak
+	for _, peak := range s.pending {
+		if peak.Time >= end {
+			break
+		}
+		peak.Time -= start
+		windowPeaks = append(windowPeaks, peak)
+	}
+
+	result := windowMatch{start: start, end: end}
+	matches, err := matchPeaks(ctx, s.dbClient, s.config, windowPeaks, s.opts.Match)
+	if err != nil && !errors.Is(err, ErrNoMatch) {
+		return err
+	}
+	if len(matches) > 0 {
+		result.match = &matches[0]
+	}
+	s.windows = append(s.windows, result)
+
+	s.next++
+	nextStart := s.windowStart(s.next)
+	drop := 0
+	for drop < len(s.pending) && s.pending[drop].Time < nextStart {
+		drop++
+	}
+	s.pending = append(s.pending[:0], s.pending[drop:]...)
+
+	return nil
+}
+
+// songOrigin returns the time of the recording at which the song of a
+// window match would have started, which is the same for every window of a
+// continuous play.
+func (w windowMatch) songOrigin() float64 {
+	return w.start - float64(w.match.offsetMs)/1000/w.match.Speed
+}
+
+// mergeWindows joins consecutive windows that agree on the song and its
+// alignment into segments, bridging up to opts.MaxGap unrecognized windows.
+// Overlapping segments are split at the middle of their overlap.
+func mergeWindows(windows []windowMatch, opts ScanOptions, duration float64) []Segment {
+	var segments []Segment
+	var current *Segment
+	var origin, confidenceSum float64
+	gap := 0
+
+	closeSegment := func() {
+		if current != nil && current.Windows >= opts.MinWindows {
+			current.Confidence = confidenceSum / float64(current.Windows)
+			segments = append(segments, *current)
+		}
+		current = nil
+	}
+
+	for _, window := range windows {
+		if window.match == nil {
+			if current != nil && gap < opts.MaxGap {
+				gap++
+				continue
+			}
+			closeSegment()
+			continue
+		}
+
+		match := window.match
+		if current != nil && current.SongID == match.SongID && math.Abs(window.songOrigin()-origin) <= scanAlignmentTolerance {
+			current.End = window.end
+			current.Windows++
+			confidenceSum += match.Confidence
+			gap = 0
+			continue
+		}
+
+		closeSegment()
+		current = &Segment{
+			// The song may only start within the window
+			Start:      math.Max(window.start, window.songOrigin()),
+			End:        window.end,
+			SongID:     match.SongID,
+			SongTitle:  match.SongTitle,
+			SongArtist: match.SongArtist,
+			YouTubeID:  match.YouTubeID,
+			SongOffset: float64(match.Timestamp) / 1000,
+			Speed:      match.Speed,
+			Windows:    1,
+		}
+		origin = window.songOrigin()
+		confidenceSum = match.Confidence
+		gap = 0
+	}
+	closeSegment()
+
+	for i := range segments {
+		segments[i].End = math.Min(segments[i].End, duration)
+		if i == 0 {
+			continue
+		}
+
+		previous := &segments[i-1]
+		if previous.End > segments[i].Start {
+			boundary := (previous.End + segments[i].Start) / 2
+			segments[i].SongOffset += (boundary - segments[i].Start) * segments[i].Speed
+			previous.End, segments[i].Start = boundary, boundary
+		}
+	}
+
+	return segments
+}
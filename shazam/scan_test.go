@@ -0,0 +1,81 @@
+package shazam
+
+import (
+	"context"
+	"math"
+	"song-recognition/db"
+	"song-recognition/synth"
+	"testing"
+)
+
+// testScan scans samples against the songs of client, leveled by leveler.
+func testScan(t *testing.T, client db.DBClient, samples []float64, leveler *Leveler) []Segment {
+	t.Helper()
+	ctx := context.Background()
+	opts := DefaultScanOptions()
+	opts.Match = MatchOptions{MinConfidence: defaultMinConfidence}
+
+	scanner, err := newScanner(ctx, client, testSampleRate, leveler, opts)
+	if err != nil {
+		t.Fatalf("newScanner: %v", err)
+	}
+	err = writeChunks(ctx, samples, func(chunk []float64) error {
+		return scanner.write(ctx, chunk)
+	})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	segments, err := scanner.finish(ctx)
+	if err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	return segments
+}
+
+func TestScanLevelsQuietRecording(t *testing.T) {
+	client := testDB(t)
+	songs := testLibrary(t, client, 40, 30, 31, 32)
+
+	// Two songs 40 dB below the level they were indexed at, around a silence
+	var recording []float64
+	recording = append(recording, synth.Song(31, 40, testSampleRate)[5*testSampleRate:25*testSampleRate]...)
+	recording = append(recording, synth.Silence(8, testSampleRate)...)
+	recording = append(recording, synth.Song(30, 40, testSampleRate)[10*testSampleRate:30*testSampleRate]...)
+	for i := range recording {
+		recording[i] *= 0.01
+	}
+	recording = synth.Mix(recording, synth.WhiteNoise(48, testSampleRate, 1e-6, 33))
+
+	// The leveler boosts the recording and mutes the silence, which must
+	// keep the timeline of the segments
+	loudness := MeasureLoudness(recording, testSampleRate)
+	if loudness.Gain() < 20 || len(loudness.Silences) != 1 {
+		t.Fatalf("gain = %.1f dB, silences = %v, want a large gain and the silence between the songs", loudness.Gain(), loudness.Silences)
+	}
+	segments := testScan(t, client, recording, loudness.Leveler())
+
+	want := []struct {
+		songID     uint32
+		start, end float64
+		songOffset float64
+	}{
+		{songs[31], 0, 20, 5},
+		{songs[30], 28, 48, 10},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("found %d segments, want %d: %+v", len(segments), len(want), segments)
+	}
+	for i, segment := range segments {
+		if segment.SongID != want[i].songID {
+			t.Errorf("segment %d is %q, want Song %d", i, segment.SongTitle, want[i].songID)
+		}
+		if math.Abs(segment.SongOffset-(want[i].songOffset+segment.Start-want[i].start)) > 0.1 {
+			t.Errorf("segment %d starts %.2f s into its song at %.2f s, want %.2f s", i, segment.SongOffset, segment.Start, want[i].songOffset+segment.Start-want[i].start)
+		}
+		// Edges inside the silence are only known to a window
+		window := DefaultScanOptions().Window
+		if segment.Start < want[i].start-window || segment.End > want[i].end+window {
+			t.Errorf("segment %d spans %.1f-%.1f s, want within %.0f-%.0f s", i, segment.Start, segment.End, want[i].start, want[i].end)
+		}
+	}
+}
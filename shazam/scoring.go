@@ -0,0 +1,123 @@
+package shazam
+
+import (
+	"song-recognition/models"
+)
+
+// offsetBinMs is the width of an offset histogram bin. Hashes whose
+// reference/query time offsets fall into the same or an adjacent bin are
+// considered aligned, which absorbs the jitter introduced by framing.
+const offsetBinMs = 50
+
+// offsetScore describes the best time alignment found for a single song.
+type offsetScore struct {
+	OffsetMs     int64   // position of the query start in the reference track
+	Hits         int     // number of hashes agreeing on OffsetMs
+	AlignedRatio float64 // Hits relative to the number of query hashes
+}
+
+// offsetBin accumulates the hashes whose offset falls into one histogram bin.
+type offsetBin struct {
+	count int
+	sum   int64
+}
+
+// offsetHistogram counts the reference/query offsets of the hashes a query
+// shares with one song, by bin.
+type offsetHistogram map[int64]*offsetBin
+
+// add counts a hash with the given offset and returns its bin.
+func (h offsetHistogram) add(delta int64) int64 {
+	bin := floorDiv(delta, offsetBinMs)
+	if h[bin] == nil {
+		h[bin] = &offsetBin{}
+	}
+	h[bin].count++
+	h[bin].sum += delta
+	return bin
+}
+
+// scoreOffsets builds, for every song referenced by couples, a histogram of
+// the time offsets between matching query and reference hashes. Only
+// couples stored under an address that the query itself produced are
+// counted. The winning bin (merged with its right neighbour to tolerate
+// bin-boundary splits) gives the song's offset and hit count.
+func scoreOffsets(query map[uint32][]models.Couple, couples map[uint32][]models.Couple) map[uint32]offsetScore {
+	histograms := make(map[uint32]offsetHistogram)
+
+	for address, queryCouples := range query {
+		for _, queryCouple := range queryCouples {
+			for _, couple := range couples[address] {
+				histogram, ok := histograms[couple.SongID]
+				if !ok {
+					histogram = make(offsetHistogram)
+					histograms[couple.SongID] = histogram
+				}
+				histogram.add(int64(couple.AnchorTimeMs) - int64(queryCouple.AnchorTimeMs))
+			}
+		}
+	}
+
+	queryHashes := countCouples(query)
+
+	scores := make(map[uint32]offsetScore, len(histograms))
+	for songID, histogram := range histograms {
+		_, best := histogram.winner()
+
+		ratio := float64(best.count) / float64(queryHashes)
+		if ratio > 1 {
+			ratio = 1
+		}
+
+		scores[songID] = offsetScore{
+			OffsetMs:     best.sum / int64(best.count),
+			Hits:         best.count,
+			AlignedRatio: ratio,
+		}
+	}
+
+	return scores
+}
+
+// winner returns the bin which, merged with its right neighbour, holds the
+// most hashes, along with the merged content. Ties go to the earliest bin.
+func (h offsetHistogram) winner() (int64, offsetBin) {
+	var best offsetBin
+	var bestBin int64
+	for bin, b := range h {
+		merged := *b
+		if next, ok := h[bin+1]; ok {
+			merged.count += next.count
+			merged.sum += next.sum
+		}
+		if merged.count > best.count || (merged.count == best.count && bin < bestBin) {
+			best, bestBin = merged, bin
+		}
+	}
+	return bestBin, best
+}
+
+// aligned reports whether bin is counted in the winning bin best, which is
+// merged with its right neighbour.
+func aligned(bin, best int64) bool {
+	return bin == best || bin == best+1
+}
+
+// floorDiv divides a by b rounding towards negative infinity, so that
+// negative offsets are binned the same way as positive ones.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// countCouples returns the total number of (address, couple) pairs in fingerprints.
+func countCouples(fingerprints map[uint32][]models.Couple) int {
+	var total int
+	for _, couples := range fingerprints {
+		total += len(couples)
+	}
+	return total
+}
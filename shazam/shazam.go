@@ -1,106 +1,271 @@
 package shazam
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
-	"os/exec"
 	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
 	"time"
 )
 
-// SongInfo represents the JSON structure from recognize_song.py
-type SongInfo struct {
-	Title  string `json:"title"`
-	Artist string `json:"artist"`
-}
-
-// Match represents a recognized song match
+// Match represents a recognized song match. Timestamp is the position, in
+// milliseconds, of the start of the query within the matched song.
+// AlignedHits is the number of query hashes that agree on that position and
+// AlignedRatio is the fraction of all query hashes they represent.
+// Confidence is the probability, between 0 and 1, that the alignment is not
+// a chance one. Speed and Pitch are the tempo and pitch factors of the query
+// relative to the song, 1 unless found by the speed-tolerant mode.
 type Match struct {
-	SongID     uint32
-	SongTitle  string
-	SongArtist string
-	YouTubeID  string
-	Timestamp  uint32
-	Score      float64
+	SongID       uint32
+	SongTitle    string
+	SongArtist   string
+	YouTubeID    string
+	Timestamp    uint32
+	Score        float64
+	AlignedHits  int
+	AlignedRatio float64
+	Confidence   float64
+	Speed        float64
+	Pitch        float64
+
+	offsetMs int64 // Timestamp before clamping, negative when the query starts before the song
 }
 
-// runPythonScript executes a Python script and returns its output
-func runPythonScript(script string) (string, error) {
-	cmd := exec.Command("python3", script)
+// candidate is the best alignment found for a song and the transform of the
+// query that produced it.
+type candidate struct {
+	songID    uint32
+	score     offsetScore
+	transform Transform
+	variant   int // index of transform in the transforms tried
+	hashes    int // query hashes under that transform
+}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out // Capture standard error output
+// queryScores holds the fingerprints of every variant of a query, the
+// reference couples sharing their addresses and the best candidate of each
+// song.
+type queryScores struct {
+	transforms []Transform
+	variants   []map[uint32][]models.Couple
+	couples    map[uint32][]models.Couple
+	candidates map[uint32]candidate
+	ranked     []candidate // candidates by decreasing hits
+}
 
-	err := cmd.Run()
-	return out.String(), err
+// FindMatches processes the recorded song and finds a match in the database.
+// The recording is normalized and its silence muted, as songs are at
+// ingest. The query is tried under each of opts.Transforms, and every song
+// is scored with its best one. Only candidates reaching opts.MinConfidence
+// are returned, best first; when there is none the error is ErrNoMatch. The
+// search stops with the error of ctx once ctx is done.
+func FindMatches(ctx context.Context, audioSamples []float64, audioDuration float64, sampleRate int, opts MatchOptions) ([]Match, time.Duration, error) {
+	matches, _, searchDuration, err := FindMatchesExplained(ctx, audioSamples, audioDuration, sampleRate, opts, 0)
+	return matches, searchDuration, err
 }
 
-// FindMatches processes the recorded song and finds a match in the database
-func FindMatches(audioSamples []float64, audioDuration float64, sampleRate int) ([]Match, time.Duration, error) {
+// FindMatchesExplained finds the matches of a recording like FindMatches
+// and, when top is positive, explains how its top candidates were scored,
+// from the same scores. The explanation is also returned with ErrNoMatch,
+// as it shows why the candidates were rejected.
+func FindMatchesExplained(ctx context.Context, audioSamples []float64, audioDuration float64, sampleRate int, opts MatchOptions, top int) ([]Match, *Explanation, time.Duration, error) {
 	startTime := time.Now()
 
-	fmt.Println("🚀 Running `watch_recordings.py` to copy the latest recording...")
-	output, err := runPythonScript("shazam/watch_recordings.py")
+	dbClient, err := db.NewDBClient()
 	if err != nil {
-		log.Fatalf("❌ Error running watch_recordings.py: %v\nOutput: %s", err, output)
+		return nil, nil, time.Since(startTime), err
 	}
-	fmt.Println("✅ Copy successful!\n", output)
+	defer dbClient.Close()
 
-	fmt.Println("🎵 Running `recognize_song.py` to identify the song...")
-	output, err = runPythonScript("shazam/recognize_song.py")
+	config, err := QueryConfig(ctx, dbClient)
 	if err != nil {
-		log.Fatalf("❌ Error running recognize_song.py: %v\nOutput: %s", err, output)
+		return nil, nil, time.Since(startTime), err
 	}
 
-	// 🔍 Debugging: Print raw Python output
-	fmt.Println("🔍 Raw Output from Python:\n", output)
+	peaks, err := queryPeaks(ctx, audioSamples, sampleRate, config, opts)
+	if err != nil {
+		return nil, nil, time.Since(startTime), fmt.Errorf("failed to extract peaks: %v", err)
+	}
 
-	// ✅ Step 3: Extract the song title from JSON output
-	var songInfo SongInfo
-	err = json.Unmarshal([]byte(output), &songInfo)
+	scores, err := scoreQuery(ctx, dbClient, config, peaks, opts)
 	if err != nil {
-		log.Fatalf("❌ Failed to parse JSON: %v", err)
+		return nil, nil, time.Since(startTime), err
 	}
 
-	recognizedTitle := songInfo.Title
-	fmt.Printf("🎶 Recognized Song: %s\n", recognizedTitle)
+	var explanation *Explanation
+	if top > 0 {
+		explanation, err = scores.explain(ctx, dbClient, len(peaks), opts, top)
+		if err != nil {
+			return nil, nil, time.Since(startTime), err
+		}
+	}
+
+	matches, err := scores.matches(ctx, dbClient, opts)
+	return matches, explanation, time.Since(startTime), err
+}
+
+// queryPeaks levels a recording, as songs are at ingest, and extracts its
+// peaks after the preprocessing of opts.
+func queryPeaks(ctx context.Context, samples []float64, sampleRate int, config FingerprintConfig, opts MatchOptions) ([]Peak, error) {
+	return SamplePeaks(ctx, LevelSamples(samples, sampleRate), sampleRate, config, opts.Preprocess)
+}
 
-	// ✅ Step 4: Connect to the database
-	dbInstance, err := db.NewSQLiteClient("db.sqlite3")
+// matchPeaks finds the songs matching the constellation of a query, as
+// described by FindMatches. The Timestamp of a match is the song position
+// corresponding to time 0 of the peaks.
+func matchPeaks(ctx context.Context, dbClient db.DBClient, config FingerprintConfig, peaks []Peak, opts MatchOptions) ([]Match, error) {
+	scores, err := scoreQuery(ctx, dbClient, config, peaks, opts)
 	if err != nil {
-		log.Fatalf("❌ Failed to connect to database: %v", err)
+		return nil, err
+	}
+	return scores.matches(ctx, dbClient, opts)
+}
+
+// matches returns the candidates of the query reaching opts.MinConfidence,
+// best first, or ErrNoMatch when there is none.
+func (q *queryScores) matches(ctx context.Context, dbClient db.DBClient, opts MatchOptions) ([]Match, error) {
+	logger := utils.GetLogger()
+
+	var matchList []Match
+	for songID, c := range q.candidates {
+		score := c.score
+		confidence := q.confidence(c)
+		if confidence < opts.MinConfidence {
+			continue
+		}
+
+		song, songExists, err := dbClient.GetSongByID(ctx, songID)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			logger.Info(fmt.Sprintf("failed to get song by ID (%v): %v", songID, err))
+			continue
+		}
+		if !songExists {
+			logger.Info(fmt.Sprintf("song with ID (%v) doesn't exist", songID))
+			continue
+		}
+
+		var timestamp uint32
+		if score.OffsetMs > 0 {
+			timestamp = uint32(score.OffsetMs)
+		}
+
+		match := Match{
+			SongID:       songID,
+			SongTitle:    song.Title,
+			SongArtist:   song.Artist,
+			YouTubeID:    song.YouTubeID,
+			Timestamp:    timestamp,
+			Score:        float64(score.Hits),
+			AlignedHits:  score.Hits,
+			AlignedRatio: score.AlignedRatio,
+			Confidence:   confidence,
+			Speed:        c.transform.Tempo,
+			Pitch:        c.transform.Pitch,
+			offsetMs:     score.OffsetMs,
+		}
+		matchList = append(matchList, match)
+	}
+
+	if len(matchList) == 0 {
+		return nil, ErrNoMatch
+	}
+
+	sort.Slice(matchList, func(i, j int) bool {
+		return matchList[i].Score > matchList[j].Score
+	})
+
+	return matchList, nil
+}
+
+// scoreQuery fingerprints every variant of the query under opts.Transforms
+// and keeps the best alignment of each song across them.
+func scoreQuery(ctx context.Context, dbClient db.DBClient, config FingerprintConfig, peaks []Peak, opts MatchOptions) (*queryScores, error) {
+	transforms := opts.Transforms
+	if len(transforms) == 0 {
+		transforms = []Transform{identityTransform}
+	}
+
+	// Fingerprint every variant of the query first, so that the database is
+	// only queried once for all their addresses.
+	queryID := utils.GenerateUniqueID()
+	variants := make([]map[uint32][]models.Couple, len(transforms))
+	addressSet := map[uint32]struct{}{}
+	for i, transform := range transforms {
+		variants[i] = Fingerprint(applyTransform(peaks, transform, config), queryID, config)
+		for address := range variants[i] {
+			addressSet[address] = struct{}{}
+		}
+	}
+
+	addresses := make([]uint32, 0, len(addressSet))
+	for address := range addressSet {
+		addresses = append(addresses, address)
 	}
-	defer dbInstance.Close()
 
-	// ✅ Step 5: Fetch song by title from the database
-	song, found, err := dbInstance.GetSongByTitle(recognizedTitle)
+	couples, err := dbClient.GetCouples(ctx, addresses)
 	if err != nil {
-		log.Fatalf("❌ Database error: %v", err)
+		return nil, err
 	}
 
-	// ✅ Step 6: Prepare the match list
-	var matches []Match
-	if found {
-		// 🎯 Song is found, add to matches list
-		fmt.Printf("✅ Song FOUND in database: %s by %s (YouTube ID: %s)\n", song.Title, song.Artist, song.YouTubeID)
+	return newQueryScores(transforms, variants, couples), nil
+}
 
-		match := Match{
-			SongID:     0, // No songID needed
-			SongTitle:  song.Title,
-			SongArtist: song.Artist,
-			YouTubeID:  song.YouTubeID,
-			Timestamp:  0,   // No timestamp needed
-			Score:      1.0, // High confidence since it's an exact match
+// newQueryScores keeps the best alignment of each song referenced by
+// couples across the variants of a query, and ranks them.
+func newQueryScores(transforms []Transform, variants []map[uint32][]models.Couple, couples map[uint32][]models.Couple) *queryScores {
+	scores := &queryScores{
+		transforms: transforms,
+		variants:   variants,
+		couples:    couples,
+		candidates: map[uint32]candidate{},
+	}
+	for i, fingerprints := range variants {
+		queryHashes := countCouples(fingerprints)
+		for songID, score := range scoreOffsets(fingerprints, couples) {
+			if best, ok := scores.candidates[songID]; !ok || score.Hits > best.score.Hits {
+				scores.candidates[songID] = candidate{songID: songID, score: score, transform: transforms[i], variant: i, hashes: queryHashes}
+			}
 		}
-		matches = append(matches, match)
-	} else {
-		// ❌ Song not found, return an empty match list
-		fmt.Printf("❌ Song NOT found in database: %s\n", recognizedTitle)
 	}
 
-	// ✅ Return the matches
-	return matches, time.Since(startTime), nil
+	for _, c := range scores.candidates {
+		scores.ranked = append(scores.ranked, c)
+	}
+	sort.Slice(scores.ranked, func(i, j int) bool {
+		if scores.ranked[i].score.Hits != scores.ranked[j].score.Hits {
+			return scores.ranked[i].score.Hits > scores.ranked[j].score.Hits
+		}
+		return scores.ranked[i].songID < scores.ranked[j].songID
+	})
+
+	return scores
+}
+
+// confidence returns the confidence of c against the strongest other
+// candidate, corrected for the number of transforms tried. Candidates
+// aligned with the query exactly like c, such as a song indexed twice, are
+// the same recording rather than competitors and are passed over.
+func (q *queryScores) confidence(c candidate) float64 {
+	var competitorHits int
+	for _, other := range q.ranked {
+		if other.songID != c.songID && !sameRecording(c, other) {
+			competitorHits = other.score.Hits
+			break
+		}
+	}
+
+	confidence := matchConfidence(c.score.Hits, competitorHits, c.hashes)
+	return correctForTrials(confidence, len(q.transforms))
+}
+
+// sameRecording reports whether two candidates align with the query under
+// the same transform and at the same offset, up to one histogram bin, as
+// copies of one recording do.
+func sameRecording(a, b candidate) bool {
+	delta := a.score.OffsetMs - b.score.OffsetMs
+	return a.variant == b.variant && delta <= offsetBinMs && delta >= -offsetBinMs
 }
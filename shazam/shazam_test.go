@@ -0,0 +1,146 @@
+package shazam
+
+import (
+	"context"
+	"song-recognition/models"
+	"song-recognition/synth"
+	"testing"
+)
+
+const testSampleRate = 22050
+
+// testFingerprints fingerprints samples as songID with the default config.
+func testFingerprints(t *testing.T, samples []float64, songID uint32) map[uint32][]models.Couple {
+	t.Helper()
+	fingerprints, err := FingerprintSamples(context.Background(), samples, testSampleRate, songID, DefaultFingerprintConfig(), nil)
+	if err != nil {
+		t.Fatalf("FingerprintSamples: %v", err)
+	}
+	return fingerprints
+}
+
+// testScores scores query against an index made of songs, keeping only the
+// couples stored under the query's addresses, as GetCouples does.
+func testScores(t *testing.T, query []float64, songs map[uint32][]float64) *queryScores {
+	t.Helper()
+	index := map[uint32][]models.Couple{}
+	for songID, samples := range songs {
+		mergeFingerprints(index, testFingerprints(t, samples, songID))
+	}
+
+	fingerprints := testFingerprints(t, query, 0)
+	couples := map[uint32][]models.Couple{}
+	for address := range fingerprints {
+		if songCouples, ok := index[address]; ok {
+			couples[address] = songCouples
+		}
+	}
+
+	return newQueryScores([]Transform{identityTransform}, []map[uint32][]models.Couple{fingerprints}, couples)
+}
+
+func TestConfidenceOfSongIndexedTwice(t *testing.T) {
+	song := synth.Song(1, 40, testSampleRate)
+	query := synth.Mix(song[15*testSampleRate:25*testSampleRate], synth.PinkNoise(10, testSampleRate, 0.1, 2))
+
+	scores := testScores(t, query, map[uint32][]float64{
+		1: song,
+		2: song,
+		3: synth.Song(3, 40, testSampleRate),
+	})
+
+	for _, songID := range []uint32{1, 2} {
+		c, ok := scores.candidates[songID]
+		if !ok {
+			t.Fatalf("song %d is not a candidate", songID)
+		}
+		if confidence := scores.confidence(c); confidence < defaultMinConfidence {
+			t.Errorf("confidence of song %d = %.3f, want at least %.2f", songID, confidence, defaultMinConfidence)
+		}
+		if offset := c.score.OffsetMs; offset < 14950 || offset > 15050 {
+			t.Errorf("offset of song %d = %d ms, want about 15000", songID, offset)
+		}
+	}
+
+	if c, ok := scores.candidates[3]; ok {
+		if confidence := scores.confidence(c); confidence >= defaultMinConfidence {
+			t.Errorf("confidence of unrelated song = %.3f, want below %.2f", confidence, defaultMinConfidence)
+		}
+	}
+}
+
+func TestConfidenceAgainstDifferentSongs(t *testing.T) {
+	songs := map[uint32][]float64{}
+	for seed := int64(1); seed <= 4; seed++ {
+		songs[uint32(seed)] = synth.Song(seed, 30, testSampleRate)
+	}
+	query := songs[2][5*testSampleRate : 15*testSampleRate]
+
+	scores := testScores(t, query, songs)
+	if len(scores.ranked) == 0 || scores.ranked[0].songID != 2 {
+		t.Fatalf("best candidate is not song 2: %+v", scores.ranked)
+	}
+	if confidence := scores.confidence(scores.ranked[0]); confidence < defaultMinConfidence {
+		t.Errorf("confidence = %.3f, want at least %.2f", confidence, defaultMinConfidence)
+	}
+}
+
+func TestExplainHitsAgreeWithScores(t *testing.T) {
+	song := synth.Song(5, 30, testSampleRate)
+	query := synth.Mix(song[8*testSampleRate:18*testSampleRate], synth.WhiteNoise(10, testSampleRate, 0.05, 6))
+
+	scores := testScores(t, query, map[uint32][]float64{5: song, 6: synth.Song(6, 30, testSampleRate)})
+	for _, c := range scores.ranked {
+		candidate := CandidateExplanation{SongID: c.songID}
+		scores.explainHits(&candidate, c.variant)
+
+		var aligned int
+		for _, hit := range candidate.Hits {
+			if hit.Aligned {
+				aligned++
+			}
+		}
+		if aligned != c.score.Hits {
+			t.Errorf("song %d: %d aligned hits explained, %d scored", c.songID, aligned, c.score.Hits)
+		}
+		if offset := candidate.WinningBinMs; c.score.OffsetMs < offset || c.score.OffsetMs >= offset+2*offsetBinMs {
+			t.Errorf("song %d: offset %d ms outside the winning bins from %d ms", c.songID, c.score.OffsetMs, offset)
+		}
+	}
+}
+
+func TestMatchNoisyExcerpt(t *testing.T) {
+	ctx := context.Background()
+	client := testDB(t)
+	config := DefaultFingerprintConfig()
+
+	songs := testLibrary(t, client, 40, 10, 11, 12, 13)
+
+	// A quiet excerpt starting between two frames, under pink noise
+	start := 12345 * testSampleRate / 1000
+	excerpt := synth.Song(12, 40, testSampleRate)[start : start+8*testSampleRate]
+	for i := range excerpt {
+		excerpt[i] *= 0.3
+	}
+	query := synth.Mix(excerpt, synth.PinkNoise(8, testSampleRate, 0.05, 99))
+
+	opts := MatchOptions{MinConfidence: defaultMinConfidence}
+	peaks, err := queryPeaks(ctx, query, testSampleRate, config, opts)
+	if err != nil {
+		t.Fatalf("queryPeaks: %v", err)
+	}
+	matches, err := matchPeaks(ctx, client, config, peaks, opts)
+	if err != nil {
+		t.Fatalf("matchPeaks: %v", err)
+	}
+
+	if matches[0].SongID != songs[12] {
+		t.Fatalf("best match is %q, want Song 12", matches[0].SongTitle)
+	}
+	if timestamp := matches[0].Timestamp; timestamp < 12345-offsetBinMs || timestamp > 12345+offsetBinMs {
+		t.Errorf("timestamp = %d ms, want about 12345", timestamp)
+	}
+	for _, match := range matches[1:] {
+		t.Errorf("unrelated song %q matched with confidence %.3f", match.SongTitle, match.Confidence)
+	}
+}
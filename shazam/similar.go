@@ -0,0 +1,126 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"song-recognition/db"
+	"song-recognition/models"
+	"sort"
+)
+
+// SimilarSong is a song that sounds like another one. Similarity, between
+// -1 and 1, is the cosine similarity of their embeddings, each feature
+// standardized over the library.
+type SimilarSong struct {
+	SongID     uint32  `json:"songId"`
+	SongTitle  string  `json:"title"`
+	SongArtist string  `json:"artist"`
+	YouTubeID  string  `json:"youtubeId"`
+	Similarity float64 `json:"similarity"`
+}
+
+// FindSimilarSongs returns the top songs whose embeddings are nearest to
+// that of the song with ID songID, most similar first; all of them when top
+// is not positive. Songs without an embedding of the current version are
+// left out. The search stops with the error of ctx once ctx is done.
+func FindSimilarSongs(ctx context.Context, songID uint32, top int) ([]SimilarSong, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	embeddings, err := dbClient.GetAllEmbeddings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for id, embedding := range embeddings {
+		if embedding.Version != EmbeddingVersion || len(embedding.Values) != 2*numFrameFeatures {
+			delete(embeddings, id)
+		}
+	}
+
+	if _, ok := embeddings[songID]; !ok {
+		return nil, fmt.Errorf("song %d has no embedding, ingest it again to compute one", songID)
+	}
+
+	standardized := standardizeEmbeddings(embeddings)
+	query := standardized[songID]
+
+	var similar []SimilarSong
+	for id, values := range standardized {
+		if id == songID {
+			continue
+		}
+		similar = append(similar, SimilarSong{SongID: id, Similarity: cosineSimilarity(query, values)})
+	}
+
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Similarity != similar[j].Similarity {
+			return similar[i].Similarity > similar[j].Similarity
+		}
+		return similar[i].SongID < similar[j].SongID
+	})
+	if top > 0 && len(similar) > top {
+		similar = similar[:top]
+	}
+
+	for i := range similar {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		song, songExists, err := dbClient.GetSongByID(ctx, similar[i].SongID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get song by ID (%v): %v", similar[i].SongID, err)
+		}
+		if songExists {
+			similar[i].SongTitle, similar[i].SongArtist, similar[i].YouTubeID = song.Title, song.Artist, song.YouTubeID
+		}
+	}
+
+	return similar, nil
+}
+
+// standardizeEmbeddings scales every feature of the embeddings to zero mean
+// and unit variance over all of them, so that features of every unit weigh
+// alike. Features that do not vary are only centred.
+func standardizeEmbeddings(embeddings map[uint32]models.Embedding) map[uint32][]float64 {
+	dims := 2 * numFrameFeatures
+	stats := make([]featureStats, dims)
+	for _, embedding := range embeddings {
+		for dim, value := range embedding.Values {
+			stats[dim].add(value)
+		}
+	}
+
+	standardized := make(map[uint32][]float64, len(embeddings))
+	for id, embedding := range embeddings {
+		values := make([]float64, dims)
+		for dim, value := range embedding.Values {
+			mean, std := stats[dim].meanStd()
+			if std == 0 {
+				std = 1
+			}
+			values[dim] = (value - mean) / std
+		}
+		standardized[id] = values
+	}
+	return standardized
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b, 0 when
+// either is zero.
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
@@ -0,0 +1,99 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"song-recognition/db"
+	"song-recognition/synth"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"testing"
+)
+
+// testWorkDir runs the rest of the test in an empty directory, where
+// db.NewDBClient opens its own database.
+func testWorkDir(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// reencode degrades samples as a copy of another release would be:
+// band-limited through a lower rate, with a noise floor 70 dB down, at
+// another level and quantized to 16 bits.
+func reencode(t *testing.T, samples []float64, seed int64) []float64 {
+	t.Helper()
+	low, err := Resample(samples, testSampleRate, 16000, 7000)
+	if err != nil {
+		t.Fatalf("Resample: %v", err)
+	}
+	back, err := Resample(low, 16000, testSampleRate, 7000)
+	if err != nil {
+		t.Fatalf("Resample: %v", err)
+	}
+	noisy := synth.Mix(back[:len(samples)], synth.WhiteNoise(float64(len(samples))/testSampleRate, testSampleRate, 0.0003, seed))
+
+	pcm, err := utils.FloatsToBytes(synth.Normalize(noisy, 0.5), 16)
+	if err != nil {
+		t.Fatalf("FloatsToBytes: %v", err)
+	}
+	decoded, err := wav.WavBytesToSamples(pcm)
+	if err != nil {
+		t.Fatalf("WavBytesToSamples: %v", err)
+	}
+	return decoded
+}
+
+func TestFindSimilarSongsRanksCopyFirst(t *testing.T) {
+	testWorkDir(t)
+	ctx := context.Background()
+	client, err := db.NewDBClient()
+	if err != nil {
+		t.Fatalf("NewDBClient: %v", err)
+	}
+	defer client.Close()
+
+	store := func(title string, samples []float64) uint32 {
+		songID, err := client.RegisterSong(ctx, title, "Synth", title)
+		if err != nil {
+			t.Fatalf("RegisterSong: %v", err)
+		}
+		if err := client.StoreEmbedding(ctx, songID, testEmbedding(t, samples, nil).embedding()); err != nil {
+			t.Fatalf("StoreEmbedding: %v", err)
+		}
+		return songID
+	}
+
+	// A song, a degraded copy of it and songs of other seeds, some of them
+	// in the same key and at the same tempo
+	opts := synth.SongOptions{Tempo: 112, Root: 50}
+	song := synth.SongWithOptions(90, 30, testSampleRate, opts)
+	original := store("original", song)
+	copied := store("copy", reencode(t, song, 91))
+	for seed := int64(92); seed < 100; seed++ {
+		if seed%2 == 0 {
+			store(fmt.Sprintf("song %d", seed), synth.SongWithOptions(seed, 30, testSampleRate, opts))
+		} else {
+			store(fmt.Sprintf("song %d", seed), synth.Song(seed, 30, testSampleRate))
+		}
+	}
+
+	similar, err := FindSimilarSongs(ctx, original, 0)
+	if err != nil {
+		t.Fatalf("FindSimilarSongs: %v", err)
+	}
+	if len(similar) != 9 {
+		t.Fatalf("found %d similar songs, want 9", len(similar))
+	}
+	if similar[0].SongID != copied {
+		t.Errorf("most similar song is %q (%.3f), want the copy", similar[0].SongTitle, similar[0].Similarity)
+	}
+}
@@ -1,158 +1,252 @@
 package shazam
 
 import (
-	"errors"
 	"fmt"
 	"math"
-	"math/cmplx"
 )
 
+// WindowType names the window function applied to every STFT frame.
+type WindowType string
+
 const (
-	dspRatio    = 4
-	freqBinSize = 1024
-	maxFreq     = 5000.0 // 5kHz
-	hopSize     = freqBinSize / 32
+	HannWindow     WindowType = "hann"
+	HammingWindow  WindowType = "hamming"
+	BlackmanWindow WindowType = "blackman"
 )
 
-func Spectrogram(samples []float64, sampleRate int) ([][]complex128, error) {
-	lpf := NewLowPassFilter(maxFreq, float64(sampleRate))
-	filteredSamples := lpf.Filter(samples)
+// PaddingPolicy tells the STFT what to do with the samples following the
+// last complete frame.
+type PaddingPolicy string
 
-	downsampledSamples, err := Downsample(filteredSamples, sampleRate, sampleRate/dspRatio)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't downsample audio samples: %v", err)
-	}
+const (
+	// PadNone drops the trailing samples that do not fill a complete frame.
+	PadNone PaddingPolicy = "none"
+	// PadEnd zero-pads the end of the signal so that the last samples are
+	// covered by one final frame.
+	PadEnd PaddingPolicy = "end"
+)
 
-	numOfWindows := len(downsampledSamples) / (freqBinSize - hopSize)
-	spectrogram := make([][]complex128, numOfWindows)
+// STFTOptions describes the framing of a short-time Fourier transform.
+type STFTOptions struct {
+	Window    WindowType
+	FrameSize int // samples per frame, a power of two
+	HopSize   int // samples between the starts of two frames
+	Padding   PaddingPolicy
+}
 
-	// Apply Hamming window function
-	window := make([]float64, freqBinSize)
-	for i := range window {
-		window[i] = 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/(float64(freqBinSize)-1))
-	}
+// STFT is the result of a short-time Fourier transform. Frames[i] holds the
+// FrameSize/2+1 bins of the frame starting at FrameTimes[i] seconds.
+type STFT struct {
+	Frames     [][]complex128
+	FrameTimes []float64
+	SampleRate int
+	Options    STFTOptions
+}
 
-	// Perform STFT
-	for i := 0; i < numOfWindows; i++ {
-		start := i * hopSize
-		end := start + freqBinSize
-		if end > len(downsampledSamples) {
-			end = len(downsampledSamples)
-		}
+// STFTOptionsFromConfig returns the framing used by the fingerprinting pipeline.
+func STFTOptionsFromConfig(config FingerprintConfig) STFTOptions {
+	return STFTOptions{
+		Window:    WindowType(config.Window),
+		FrameSize: config.FreqBinSize,
+		HopSize:   config.HopSize,
+		Padding:   PaddingPolicy(config.Padding),
+	}
+}
 
-		bin := make([]float64, freqBinSize)
-		copy(bin, downsampledSamples[start:end])
+// Validate checks that the options describe a usable framing.
+func (opts STFTOptions) Validate() error {
+	if _, err := windowFunction(opts.Window, 1); err != nil {
+		return err
+	}
+	if err := checkFFTSize(opts.FrameSize); err != nil {
+		return err
+	}
+	if opts.HopSize < 1 || opts.HopSize > opts.FrameSize {
+		return fmt.Errorf("hop size must be between 1 and the frame size (%d)", opts.FrameSize)
+	}
+	if opts.Padding != PadNone && opts.Padding != PadEnd {
+		return fmt.Errorf("unknown padding policy %q", opts.Padding)
+	}
+	return nil
+}
 
-		// Apply Hamming window
-		for j := range window {
-			bin[j] *= window[j]
+// NumFrames returns the number of frames the options produce for numSamples samples.
+func (opts STFTOptions) NumFrames(numSamples int) int {
+	if numSamples <= 0 {
+		return 0
+	}
+	if numSamples <= opts.FrameSize {
+		if opts.Padding == PadEnd || numSamples == opts.FrameSize {
+			return 1
 		}
+		return 0
+	}
 
-		spectrogram[i] = FFT(bin)
+	extra := numSamples - opts.FrameSize
+	if opts.Padding == PadEnd {
+		return 1 + (extra+opts.HopSize-1)/opts.HopSize
 	}
+	return 1 + extra/opts.HopSize
+}
 
-	return spectrogram, nil
+// Spectrogram resamples the samples to the analysis rate of config, which
+// also low-pass filters them below config.MaxFreq, then computes their
+// short-time Fourier transform with the framing of config.
+func Spectrogram(samples []float64, sampleRate int, config FingerprintConfig) (*STFT, error) {
+	return PreprocessedSpectrogram(samples, sampleRate, config, nil)
 }
 
-// Downsample downsamples the input audio from originalSampleRate to targetSampleRate
-func Downsample(input []float64, originalSampleRate, targetSampleRate int) ([]float64, error) {
-	if targetSampleRate <= 0 || originalSampleRate <= 0 {
-		return nil, errors.New("sample rates must be positive")
+// PreprocessedSpectrogram is Spectrogram with the stages of chain applied
+// to the resampled samples and to the frames.
+func PreprocessedSpectrogram(samples []float64, sampleRate int, config FingerprintConfig, chain PreprocessChain) (*STFT, error) {
+	downsampledSamples, err := Resample(samples, sampleRate, config.AnalysisRate, config.MaxFreq)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resample audio samples: %v", err)
 	}
-	if targetSampleRate > originalSampleRate {
-		return nil, errors.New("target sample rate must be less than or equal to original sample rate")
+
+	return computeSTFT(downsampledSamples, config.AnalysisRate, STFTOptionsFromConfig(config), chain.start(config))
+}
+
+// ComputeSTFT computes the short-time Fourier transform of samples taken at sampleRate.
+func ComputeSTFT(samples []float64, sampleRate int, opts STFTOptions) (*STFT, error) {
+	return computeSTFT(samples, sampleRate, opts, &preprocessor{})
+}
+
+func computeSTFT(samples []float64, sampleRate int, opts STFTOptions, pre *preprocessor) (*STFT, error) {
+	framer, err := newSTFTFramer(sampleRate, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	ratio := originalSampleRate / targetSampleRate
-	if ratio <= 0 {
-		return nil, errors.New("invalid ratio calculated from sample rates")
+	numFrames := opts.NumFrames(len(samples))
+	stft := &STFT{
+		Frames:     make([][]complex128, 0, numFrames),
+		FrameTimes: make([]float64, 0, numFrames),
+		SampleRate: sampleRate,
+		Options:    opts,
 	}
 
-	var resampled []float64
-	for i := 0; i < len(input); i += ratio {
-		end := i + ratio
-		if end > len(input) {
-			end = len(input)
-		}
+	collect := func(spectrum []complex128, frameTime float64) {
+		stft.Frames = append(stft.Frames, spectrum)
+		stft.FrameTimes = append(stft.FrameTimes, frameTime)
+	}
+	handleFrame := func(spectrum []complex128, frameTime float64) {
+		pre.frame(Frame{Spectrum: spectrum, Time: frameTime}, collect)
+	}
 
-		sum := 0.0
-		for j := i; j < end; j++ {
-			sum += input[j]
-		}
-		avg := sum / float64(end-i)
-		resampled = append(resampled, avg)
+	if err := framer.write(pre.samples(samples), handleFrame); err != nil {
+		return nil, err
 	}
+	if err := framer.flush(handleFrame); err != nil {
+		return nil, err
+	}
+	pre.flush(collect)
 
-	return resampled, nil
+	return stft, nil
 }
 
-type Peak struct {
-	Time float64
-	Freq complex128
+// stftFramer cuts a stream of samples into windowed frames and transforms
+// them. Samples are fed with write; flush applies the padding policy.
+type stftFramer struct {
+	opts       STFTOptions
+	sampleRate int
+	window     []float64
+
+	pending  []float64 // samples from the start of the next frame on
+	frameIdx int       // index of the next frame
+	received int       // samples received so far
 }
 
-// ExtractPeaks analyzes a spectrogram and extracts significant peaks in the frequency domain over time.
-func ExtractPeaks(spectrogram [][]complex128, audioDuration float64) []Peak {
-	if len(spectrogram) < 1 {
-		return []Peak{}
-	}
-
-	type maxies struct {
-		maxMag  float64
-		maxFreq complex128
-		freqIdx int
-	}
-
-	bands := []struct{ min, max int }{{0, 10}, {10, 20}, {20, 40}, {40, 80}, {80, 160}, {160, 512}}
-
-	var peaks []Peak
-	binDuration := audioDuration / float64(len(spectrogram))
-
-	for binIdx, bin := range spectrogram {
-		var maxMags []float64
-		var maxFreqs []complex128
-		var freqIndices []float64
-
-		binBandMaxies := []maxies{}
-		for _, band := range bands {
-			var maxx maxies
-			var maxMag float64
-			for idx, freq := range bin[band.min:band.max] {
-				magnitude := cmplx.Abs(freq)
-				if magnitude > maxMag {
-					maxMag = magnitude
-					freqIdx := band.min + idx
-					maxx = maxies{magnitude, freq, freqIdx}
-				}
-			}
-			binBandMaxies = append(binBandMaxies, maxx)
-		}
+func newSTFTFramer(sampleRate int, opts STFTOptions) (*stftFramer, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("sample rate must be positive")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
 
-		for _, value := range binBandMaxies {
-			maxMags = append(maxMags, value.maxMag)
-			maxFreqs = append(maxFreqs, value.maxFreq)
-			freqIndices = append(freqIndices, float64(value.freqIdx))
+	window, err := windowFunction(opts.Window, opts.FrameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stftFramer{opts: opts, sampleRate: sampleRate, window: window}, nil
+}
+
+// write appends samples and transforms every frame now complete, passing
+// each spectrum and its start time to emit.
+func (f *stftFramer) write(samples []float64, emit func([]complex128, float64)) error {
+	f.pending = append(f.pending, samples...)
+	f.received += len(samples)
+
+	start := 0
+	for start+f.opts.FrameSize <= len(f.pending) {
+		if err := f.transform(f.pending[start:start+f.opts.FrameSize], emit); err != nil {
+			return err
 		}
+		start += f.opts.HopSize
+	}
 
-		// Calculate the average magnitude
-		var maxMagsSum float64
-		for _, max := range maxMags {
-			maxMagsSum += max
+	start = min(start, len(f.pending))
+	f.pending = append(f.pending[:0], f.pending[start:]...)
+	return nil
+}
+
+// flush transforms the zero-padded trailing frames required by the padding policy.
+func (f *stftFramer) flush(emit func([]complex128, float64)) error {
+	total := f.opts.NumFrames(f.received)
+
+	start := 0
+	for f.frameIdx < total {
+		end := min(start+f.opts.FrameSize, len(f.pending))
+		if err := f.transform(f.pending[min(start, end):end], emit); err != nil {
+			return err
 		}
-		avg := maxMagsSum / float64(len(maxFreqs)) // * coefficient
+		start += f.opts.HopSize
+	}
+
+	f.pending = nil
+	return nil
+}
+
+// transform windows one frame, zero-padded to the frame size, and emits its spectrum.
+func (f *stftFramer) transform(samples []float64, emit func([]complex128, float64)) error {
+	frame := make([]float64, f.opts.FrameSize)
+	copy(frame, samples)
+	for j := range frame {
+		frame[j] *= f.window[j]
+	}
 
-		// Add peaks that exceed the average magnitude
-		for i, value := range maxMags {
-			if value > avg {
-				peakTimeInBin := freqIndices[i] * binDuration / float64(len(bin))
+	spectrum, err := RealFFT(frame)
+	if err != nil {
+		return err
+	}
 
-				// Calculate the absolute time of the peak
-				peakTime := float64(binIdx)*binDuration + peakTimeInBin
+	frameTime := float64(f.frameIdx*f.opts.HopSize) / float64(f.sampleRate)
+	f.frameIdx++
 
-				peaks = append(peaks, Peak{Time: peakTime, Freq: maxFreqs[i]})
-			}
+	emit(spectrum, frameTime)
+	return nil
+}
+
+// windowFunction returns the coefficients of the named window for frames of size samples.
+func windowFunction(windowType WindowType, size int) ([]float64, error) {
+	window := make([]float64, size)
+	denominator := math.Max(float64(size-1), 1)
+
+	for i := range window {
+		x := 2 * math.Pi * float64(i) / denominator
+		switch windowType {
+		case HannWindow:
+			window[i] = 0.5 - 0.5*math.Cos(x)
+		case HammingWindow:
+			window[i] = 0.54 - 0.46*math.Cos(x)
+		case BlackmanWindow:
+			window[i] = 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x)
+		default:
+			return nil, fmt.Errorf("unknown window type %q", windowType)
 		}
 	}
 
-	return peaks
+	return window, nil
 }
@@ -0,0 +1,57 @@
+package shazam
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSTFTFraming(t *testing.T) {
+	const sampleRate = 1000
+	for _, test := range []struct {
+		numSamples int
+		padding    PaddingPolicy
+		want       int
+	}{
+		{0, PadNone, 0},
+		{0, PadEnd, 0},
+		{5, PadNone, 0},
+		{5, PadEnd, 1},
+		{8, PadNone, 1},
+		{8, PadEnd, 1},
+		{9, PadNone, 1},
+		{9, PadEnd, 2},
+		{11, PadNone, 2},
+		{11, PadEnd, 2},
+		{12, PadNone, 2},
+		{12, PadEnd, 3},
+		{20, PadNone, 5},
+		{20, PadEnd, 5},
+	} {
+		opts := STFTOptions{Window: HannWindow, FrameSize: 8, HopSize: 3, Padding: test.padding}
+		if got := opts.NumFrames(test.numSamples); got != test.want {
+			t.Errorf("NumFrames(%d) with padding %q = %d, want %d", test.numSamples, test.padding, got, test.want)
+		}
+
+		stft, err := ComputeSTFT(make([]float64, test.numSamples), sampleRate, opts)
+		if err != nil {
+			t.Fatalf("ComputeSTFT: %v", err)
+		}
+		if len(stft.Frames) != test.want || len(stft.FrameTimes) != test.want {
+			t.Fatalf("%d samples with padding %q: %d frames and %d times, want %d", test.numSamples, test.padding, len(stft.Frames), len(stft.FrameTimes), test.want)
+		}
+
+		// Frames start a hop apart, and with PadEnd the last one reaches the
+		// last sample
+		for i, frameTime := range stft.FrameTimes {
+			if want := float64(i*opts.HopSize) / sampleRate; math.Abs(frameTime-want) > 1e-12 {
+				t.Errorf("%d samples with padding %q: frame %d at %g s, want %g s", test.numSamples, test.padding, i, frameTime, want)
+			}
+			if len(stft.Frames[i]) != opts.FrameSize/2+1 {
+				t.Errorf("frame %d has %d bins, want %d", i, len(stft.Frames[i]), opts.FrameSize/2+1)
+			}
+		}
+		if test.padding == PadEnd && test.want > 0 && (test.want-1)*opts.HopSize+opts.FrameSize < test.numSamples {
+			t.Errorf("%d samples with padding %q: the last frame ends before the last sample", test.numSamples, test.padding)
+		}
+	}
+}
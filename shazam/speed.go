@@ -0,0 +1,106 @@
+package shazam
+
+import (
+	"math"
+)
+
+const (
+	// pitchGridStep is the relative step between two pitch factors of the
+	// search grid. Frequency bins are matched exactly, so a pitch error of
+	// half a step must stay below half a bin for most peaks: 0.5% keeps
+	// peaks up to about 2 kHz aligned.
+	pitchGridStep = 0.005
+
+	// tempoGridStep is the relative step between two time-stretch factors.
+	// Times are matched on the frame grid, which tolerates a larger error
+	// over the short anchor/target distances.
+	tempoGridStep = 0.02
+)
+
+// Transform describes how a query relates to the indexed recording: it is
+// played Tempo times faster and its frequencies are multiplied by Pitch.
+// A sped-up edit or a record played at the wrong speed changes both by the
+// same factor, a time-stretch only changes Tempo and a pitch shift only
+// changes Pitch.
+type Transform struct {
+	Tempo float64
+	Pitch float64
+}
+
+// identityTransform leaves the query unchanged.
+var identityTransform = Transform{Tempo: 1, Pitch: 1}
+
+// SpeedGrid returns the transforms searched by the speed-tolerant mode for
+// changes of up to maxChange (0.25 for ±25%): speed changes, time-stretches
+// and pitch shifts, starting with the identity.
+//
+// The grid grows linearly with maxChange, about 9 transforms per percent,
+// and every transform fingerprints the query again and adds its own hashes
+// to look up: ±10% gives 90 transforms and ±25% 228, which makes a query
+// about 6 and 12 times slower than exact matching.
+func SpeedGrid(maxChange float64) []Transform {
+	transforms := []Transform{identityTransform}
+	if maxChange <= 0 {
+		return transforms
+	}
+
+	for _, factor := range gridFactors(maxChange, pitchGridStep) {
+		transforms = append(transforms, Transform{Tempo: factor, Pitch: factor})
+	}
+	for _, factor := range gridFactors(maxChange, tempoGridStep) {
+		transforms = append(transforms, Transform{Tempo: factor, Pitch: 1})
+	}
+	for _, factor := range gridFactors(maxChange, pitchGridStep) {
+		transforms = append(transforms, Transform{Tempo: 1, Pitch: factor})
+	}
+
+	return transforms
+}
+
+// gridFactors returns the factors between 1-maxChange and 1+maxChange,
+// other than 1, spaced geometrically by step.
+func gridFactors(maxChange, step float64) []float64 {
+	low := math.Max(1-maxChange, 0.1)
+	high := 1 + maxChange
+	ratio := 1 + step
+
+	var factors []float64
+	for factor := 1 / ratio; factor >= low; factor /= ratio {
+		factors = append(factors, factor)
+	}
+	for factor := ratio; factor <= high; factor *= ratio {
+		factors = append(factors, factor)
+	}
+	return factors
+}
+
+// applyTransform maps query peaks onto the time and frequency scale of the
+// reference under t. Times are snapped to the frame grid and bins rounded,
+// so that the resulting hashes can equal those of the reference. Peaks
+// moved outside the fingerprinted band are dropped.
+func applyTransform(peaks []Peak, t Transform, config FingerprintConfig) []Peak {
+	if t == identityTransform {
+		return peaks
+	}
+
+	frameDuration := float64(config.HopSize) / float64(config.AnalysisRate)
+	maxBin := maxFreqBin(config)
+	binHz := float64(config.AnalysisRate) / float64(config.FreqBinSize)
+
+	transformed := make([]Peak, 0, len(peaks))
+	for _, peak := range peaks {
+		bin := int(math.Round(float64(peak.FreqBin) / t.Pitch))
+		if bin < 0 || bin > maxBin {
+			continue
+		}
+
+		transformed = append(transformed, Peak{
+			Time:      math.Round(peak.Time*t.Tempo/frameDuration) * frameDuration,
+			FreqBin:   bin,
+			FreqHz:    float64(bin) * binHz,
+			Magnitude: peak.Magnitude,
+		})
+	}
+
+	return transformed
+}
@@ -0,0 +1,330 @@
+package shazam
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"song-recognition/models"
+	"song-recognition/wav"
+)
+
+// pcmChunkSize is the number of bytes read at a time by FingerprintPCM
+// (about 3 seconds of 16-bit mono audio at 44.1 kHz).
+const pcmChunkSize = 1 << 18
+
+// sampleChunkSize is the number of samples held in memory that are
+// processed between two checks for cancellation.
+const sampleChunkSize = pcmChunkSize / 2
+
+// PeakStream extracts the constellation peaks of audio delivered in chunks:
+// it resamples, preprocesses, frames and picks peaks incrementally, so that
+// memory stays bounded whatever the length of the input. Peaks come out in
+// time order and do not depend on how the input is chunked.
+type PeakStream struct {
+	resampler    *Resampler
+	preprocessor *preprocessor
+	framer       *stftFramer
+	picker       *peakPicker
+}
+
+// NewPeakStream creates a peak extractor for audio sampled at sampleRate.
+// The stages of chain, which may be empty, are applied before peak picking.
+func NewPeakStream(sampleRate int, config FingerprintConfig, chain PreprocessChain) (*PeakStream, error) {
+	if err := ValidateConfig(config); err != nil {
+		return nil, err
+	}
+
+	resampler, err := NewResampler(sampleRate, config.AnalysisRate, config.MaxFreq)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create resampler: %v", err)
+	}
+
+	framer, err := newSTFTFramer(config.AnalysisRate, STFTOptionsFromConfig(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PeakStream{
+		resampler:    resampler,
+		preprocessor: chain.start(config),
+		framer:       framer,
+		picker:       newPeakPicker(config),
+	}, nil
+}
+
+// Write consumes the next chunk of samples and returns the peaks that are final.
+func (p *PeakStream) Write(samples []float64) ([]Peak, error) {
+	var peaks []Peak
+	handleFrame := p.frameHandler(&peaks)
+
+	samples = p.preprocessor.samples(p.resampler.Process(samples))
+	if err := p.framer.write(samples, handleFrame); err != nil {
+		return nil, err
+	}
+
+	return peaks, nil
+}
+
+// Flush processes the end of the stream, padding the last frames as the
+// config requires, and returns the remaining peaks.
+func (p *PeakStream) Flush() ([]Peak, error) {
+	var peaks []Peak
+	handleFrame := p.frameHandler(&peaks)
+
+	if err := p.framer.write(p.preprocessor.samples(p.resampler.Flush()), handleFrame); err != nil {
+		return nil, err
+	}
+	if err := p.framer.flush(handleFrame); err != nil {
+		return nil, err
+	}
+	p.preprocessor.flush(p.peakHandler(&peaks))
+
+	return append(peaks, p.picker.flush()...), nil
+}
+
+// frameHandler returns the callback that preprocesses each new STFT frame
+// and passes it on to the peakHandler.
+func (p *PeakStream) frameHandler(peaks *[]Peak) func([]complex128, float64) {
+	handlePeaks := p.peakHandler(peaks)
+	return func(spectrum []complex128, frameTime float64) {
+		p.preprocessor.frame(Frame{Spectrum: spectrum, Time: frameTime}, handlePeaks)
+	}
+}
+
+// peakHandler returns the callback that picks the peaks of each
+// preprocessed frame and appends them to peaks.
+func (p *PeakStream) peakHandler(peaks *[]Peak) func([]complex128, float64) {
+	return func(spectrum []complex128, frameTime float64) {
+		*peaks = append(*peaks, p.picker.push(spectrum, frameTime)...)
+	}
+}
+
+// SamplePeaks extracts the peaks of a complete clip held in memory. It
+// stops with the error of ctx once ctx is done.
+func SamplePeaks(ctx context.Context, samples []float64, sampleRate int, config FingerprintConfig, chain PreprocessChain) ([]Peak, error) {
+	stream, err := NewPeakStream(sampleRate, config, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	var peaks []Peak
+	err = writeChunks(ctx, samples, func(chunk []float64) error {
+		chunkPeaks, err := stream.Write(chunk)
+		peaks = append(peaks, chunkPeaks...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rest, err := stream.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(peaks, rest...), nil
+}
+
+// StreamFingerprinter computes fingerprints from audio delivered in chunks.
+// It keeps a peak extractor and the most recent peaks between calls, so
+// memory stays bounded whatever the length of the input. Without
+// preprocessing, peaks are extracted on FingerprintWorkers goroutines, with
+// the same result.
+type StreamFingerprinter struct {
+	config FingerprintConfig
+	songID uint32
+	peaks  peakSource
+
+	recentPeaks []Peak // last peaks, still awaiting their targets
+}
+
+// NewStreamFingerprinter creates a fingerprinter for audio sampled at
+// sampleRate, producing couples for songID. The stages of chain, which may
+// be empty, are applied before peak extraction.
+func NewStreamFingerprinter(sampleRate int, songID uint32, config FingerprintConfig, chain PreprocessChain) (*StreamFingerprinter, error) {
+	// Preprocessing stages may keep unbounded state, such as the DC removal
+	// filter, so only plain extraction can be split into segments.
+	var peaks peakSource
+	var err error
+	if workers := FingerprintWorkers(); len(chain) == 0 && workers > 1 {
+		peaks, err = newParallelPeakStream(sampleRate, config, workers)
+	} else {
+		peaks, err = NewPeakStream(sampleRate, config, chain)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamFingerprinter{config: config, songID: songID, peaks: peaks}, nil
+}
+
+// Write consumes the next chunk of samples and returns the fingerprints
+// whose anchor and target peaks are both known by now.
+func (s *StreamFingerprinter) Write(samples []float64) (map[uint32][]models.Couple, error) {
+	peaks, err := s.peaks.Write(samples)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.addPeaks(peaks), nil
+}
+
+// Flush processes the end of the stream and returns the remaining fingerprints.
+func (s *StreamFingerprinter) Flush() (map[uint32][]models.Couple, error) {
+	peaks, err := s.peaks.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.addPeaks(peaks), nil
+}
+
+// addPeaks fingerprints new peaks against the recent ones.
+func (s *StreamFingerprinter) addPeaks(peaks []Peak) map[uint32][]models.Couple {
+	fingerprints := map[uint32][]models.Couple{}
+	for _, peak := range peaks {
+		s.addPeak(peak, fingerprints)
+	}
+	return fingerprints
+}
+
+// addPeak pairs peak, as a target, with each of the last TargetZoneSize
+// peaks, which gives the same couples as Fingerprint over the whole list.
+func (s *StreamFingerprinter) addPeak(peak Peak, fingerprints map[uint32][]models.Couple) {
+	for _, anchor := range s.recentPeaks {
+		address := createAddress(anchor, peak, s.config)
+		anchorTimeMs := uint32(math.Round(anchor.Time * 1000))
+		fingerprints[address] = append(fingerprints[address], models.Couple{AnchorTimeMs: anchorTimeMs, SongID: s.songID})
+	}
+
+	s.recentPeaks = append(s.recentPeaks, peak)
+	if len(s.recentPeaks) > s.config.TargetZoneSize {
+		s.recentPeaks = append(s.recentPeaks[:0], s.recentPeaks[1:]...)
+	}
+}
+
+// FingerprintSamples fingerprints a complete clip held in memory.
+func FingerprintSamples(ctx context.Context, samples []float64, sampleRate int, songID uint32, config FingerprintConfig, chain PreprocessChain) (map[uint32][]models.Couple, error) {
+	fingerprints := map[uint32][]models.Couple{}
+
+	err := FingerprintStream(ctx, samples, sampleRate, songID, config, chain, func(batch map[uint32][]models.Couple) error {
+		mergeFingerprints(fingerprints, batch)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fingerprints, nil
+}
+
+// FingerprintStream fingerprints samples in one pass and hands the result to
+// emit, possibly in several batches. It stops with the error of ctx once ctx
+// is done.
+func FingerprintStream(ctx context.Context, samples []float64, sampleRate int, songID uint32, config FingerprintConfig, chain PreprocessChain, emit func(map[uint32][]models.Couple) error) error {
+	fingerprinter, err := NewStreamFingerprinter(sampleRate, songID, config, chain)
+	if err != nil {
+		return err
+	}
+
+	err = writeChunks(ctx, samples, func(chunk []float64) error {
+		batch, err := fingerprinter.Write(chunk)
+		if err != nil {
+			return err
+		}
+		return emit(batch)
+	})
+	if err != nil {
+		return err
+	}
+
+	batch, err := fingerprinter.Flush()
+	if err != nil {
+		return err
+	}
+	return emit(batch)
+}
+
+// FingerprintPCM reads 16-bit little-endian mono PCM from r until EOF and
+// hands the fingerprints to emit as they become available, one batch per
+// chunk read. Only the current chunk is held in memory. The samples go
+// through leveler first, unless it is nil. It stops with the error of ctx
+// once ctx is done.
+func FingerprintPCM(ctx context.Context, r io.Reader, sampleRate int, songID uint32, config FingerprintConfig, chain PreprocessChain, leveler *Leveler, emit func(map[uint32][]models.Couple) error) error {
+	fingerprinter, err := NewStreamFingerprinter(sampleRate, songID, config, chain)
+	if err != nil {
+		return err
+	}
+
+	err = readPCM(ctx, r, func(samples []float64) error {
+		batch, err := fingerprinter.Write(leveler.Process(samples))
+		if err != nil {
+			return err
+		}
+		return emit(batch)
+	})
+	if err != nil {
+		return err
+	}
+
+	batch, err := fingerprinter.Flush()
+	if err != nil {
+		return err
+	}
+	return emit(batch)
+}
+
+// readPCM reads 16-bit little-endian mono PCM from r until EOF and hands
+// the samples to handle, pcmChunkSize bytes at a time, until ctx is done.
+func readPCM(ctx context.Context, r io.Reader, handle func([]float64) error) error {
+	reader := bufio.NewReaderSize(r, pcmChunkSize)
+	buf := make([]byte, pcmChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, readErr := io.ReadFull(reader, buf)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("error reading PCM data: %v", readErr)
+		}
+
+		// Ignore a trailing odd byte, it cannot form a sample
+		samples, err := wav.WavBytesToSamples(buf[:n-n%2])
+		if err != nil {
+			return fmt.Errorf("error converting PCM data to samples: %v", err)
+		}
+
+		if err := handle(samples); err != nil {
+			return err
+		}
+
+		if readErr != nil {
+			return nil
+		}
+	}
+}
+
+// writeChunks hands samples to write sampleChunkSize at a time, until ctx
+// is done.
+func writeChunks(ctx context.Context, samples []float64, write func([]float64) error) error {
+	for start := 0; start < len(samples); start += sampleChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := write(samples[start:min(start+sampleChunkSize, len(samples))]); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// mergeFingerprints appends the couples of src to dst.
+func mergeFingerprints(dst, src map[uint32][]models.Couple) {
+	for address, couples := range src {
+		dst[address] = append(dst[address], couples...)
+	}
+}
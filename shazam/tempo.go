@@ -0,0 +1,198 @@
+package shazam
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+const (
+	// tempoFrameSeconds is the approximate length of the STFT frames onsets
+	// are detected in. Frames overlap by three quarters, so that the onset
+	// envelope resolves beats to about a hundredth of a second.
+	tempoFrameSeconds = 0.046
+
+	// tempoCompression shapes the logarithmic compression of the bin
+	// magnitudes, so that soft onsets count as well as loud ones.
+	tempoCompression = 1000.0
+
+	// tempoMinFreq is the lowest frequency, in Hz, onsets are detected
+	// from, and tempoBandsPerOctave the number of bands per octave they are
+	// detected in. Bands give the few bins of a kick drum as much weight as
+	// the many of a hi-hat.
+	tempoMinFreq        = 40.0
+	tempoBandsPerOctave = 3
+
+	// tempoMinBPM and tempoMaxBPM bound the tempos considered.
+	tempoMinBPM = 60.0
+	tempoMaxBPM = 200.0
+
+	// tempoPreferredBPM and tempoPriorOctaves shape the preference for
+	// moderate tempos that resolves the ambiguity between a tempo and its
+	// double or half: the weight of a tempo falls as a Gaussian of its
+	// distance in octaves from tempoPreferredBPM.
+	tempoPreferredBPM = 120.0
+	tempoPriorOctaves = 1.0
+
+	// tempoMinSeconds is the length of audio needed to estimate a tempo.
+	tempoMinSeconds = 5.0
+
+	// tempoDetrendSeconds is the window of the moving average removed from
+	// the onset envelope, leaving its peaks.
+	tempoDetrendSeconds = 0.5
+)
+
+// tempoSTFTOptions returns the framing onsets are detected with at the
+// analysis rate of config.
+func tempoSTFTOptions(config FingerprintConfig) STFTOptions {
+	frameSize := 1 << int(math.Round(math.Log2(float64(config.AnalysisRate)*tempoFrameSeconds)))
+	return STFTOptions{
+		Window:    WindowType(config.Window),
+		FrameSize: frameSize,
+		HopSize:   frameSize / 4,
+		Padding:   PadEnd,
+	}
+}
+
+// tempoAccumulator builds the onset envelope of STFT frames: the summed
+// increase of the compressed band levels from one frame to the next.
+type tempoAccumulator struct {
+	bands     []int // band of each bin, -1 outside the analysed range
+	numBands  int
+	scale     float64 // turns bin magnitudes into sinusoid amplitudes
+	frameRate float64 // frames per second
+
+	previous []float64
+	envelope []float64
+}
+
+func newTempoAccumulator(sampleRate int, opts STFTOptions, maxFreq float64) *tempoAccumulator {
+	bins := min(int(maxFreq*float64(opts.FrameSize)/float64(sampleRate)), opts.FrameSize/2) + 1
+
+	bands := make([]int, bins)
+	numBands := 0
+	for bin := range bands {
+		freq := float64(bin) * float64(sampleRate) / float64(opts.FrameSize)
+		if freq < tempoMinFreq {
+			bands[bin] = -1
+			continue
+		}
+		bands[bin] = int(tempoBandsPerOctave * math.Log2(freq/tempoMinFreq))
+		numBands = max(numBands, bands[bin]+1)
+	}
+
+	return &tempoAccumulator{
+		bands:     bands,
+		numBands:  numBands,
+		scale:     2 / float64(opts.FrameSize),
+		frameRate: float64(sampleRate) / float64(opts.HopSize),
+	}
+}
+
+// push adds the onset strength of one STFT frame to the envelope.
+func (t *tempoAccumulator) push(spectrum []complex128, _ float64) {
+	energies := make([]float64, t.numBands)
+	counts := make([]int, t.numBands)
+	for bin, band := range t.bands {
+		if band < 0 || bin >= len(spectrum) {
+			continue
+		}
+		magnitude := cmplx.Abs(spectrum[bin]) * t.scale
+		energies[band] += magnitude * magnitude
+		counts[band]++
+	}
+
+	levels := make([]float64, t.numBands)
+	for band, energy := range energies {
+		if counts[band] > 0 {
+			levels[band] = math.Log1p(tempoCompression * math.Sqrt(energy/float64(counts[band])))
+		}
+	}
+
+	var flux float64
+	if t.previous != nil {
+		for band, level := range levels {
+			flux += math.Max(level-t.previous[band], 0)
+		}
+	}
+	t.previous = levels
+	t.envelope = append(t.envelope, flux)
+}
+
+// bpm estimates the tempo from the periodicity of the onset envelope: the
+// lag of the highest weighted autocorrelation between tempoMinBPM and
+// tempoMaxBPM, refined by parabolic interpolation. It returns 0 when the
+// audio is too short or has no onsets.
+func (t *tempoAccumulator) bpm() float64 {
+	if float64(len(t.envelope)) < tempoMinSeconds*t.frameRate {
+		return 0
+	}
+
+	// Remove the moving average and keep what rises above it
+	radius := max(1, int(tempoDetrendSeconds*t.frameRate/2))
+	prefix := make([]float64, len(t.envelope)+1)
+	for i, value := range t.envelope {
+		prefix[i+1] = prefix[i] + value
+	}
+	onsets := make([]float64, len(t.envelope))
+	for i, value := range t.envelope {
+		from, to := max(0, i-radius), min(len(t.envelope), i+radius+1)
+		onsets[i] = math.Max(value-(prefix[to]-prefix[from])/float64(to-from), 0)
+	}
+
+	minLag := int(math.Floor(60 / tempoMaxBPM * t.frameRate))
+	maxLag := int(math.Ceil(60 / tempoMinBPM * t.frameRate))
+	scores := make([]float64, maxLag+2)
+	for lag := max(1, minLag-1); lag <= maxLag+1 && lag < len(onsets); lag++ {
+		var sum float64
+		for i := lag; i < len(onsets); i++ {
+			sum += onsets[i] * onsets[i-lag]
+		}
+		bpm := 60 * t.frameRate / float64(lag)
+		prior := math.Log2(bpm/tempoPreferredBPM) / tempoPriorOctaves
+		scores[lag] = sum / float64(len(onsets)-lag) * math.Exp(-prior*prior/2)
+	}
+
+	best := 0
+	for lag := max(1, minLag); lag <= maxLag; lag++ {
+		if scores[lag] > scores[best] {
+			best = lag
+		}
+	}
+	if best == 0 {
+		return 0
+	}
+
+	lag := float64(best)
+	if low, high := scores[best-1], scores[best+1]; low+high < 2*scores[best] {
+		lag += (low - high) / (2 * (low - 2*scores[best] + high))
+	}
+	return math.Round(600*t.frameRate/lag) / 10
+}
+
+// tempoExtractor estimates the tempo of audio at the analysis rate of a
+// fingerprint config.
+type tempoExtractor struct {
+	framer *stftFramer
+	acc    *tempoAccumulator
+}
+
+func newTempoExtractor(config FingerprintConfig) (*tempoExtractor, error) {
+	opts := tempoSTFTOptions(config)
+	framer, err := newSTFTFramer(config.AnalysisRate, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tempoExtractor{
+		framer: framer,
+		acc:    newTempoAccumulator(config.AnalysisRate, opts, config.MaxFreq),
+	}, nil
+}
+
+func (t *tempoExtractor) write(samples []float64) error {
+	return t.framer.write(samples, t.acc.push)
+}
+
+func (t *tempoExtractor) flush() error {
+	return t.framer.flush(t.acc.push)
+}
@@ -0,0 +1,112 @@
+package shazam
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TimelineFormat is an output format for the segments found by a scan.
+type TimelineFormat string
+
+const (
+	TimelineJSON TimelineFormat = "json"
+	TimelineCSV  TimelineFormat = "csv"
+	TimelineCUE  TimelineFormat = "cue"
+)
+
+// ParseTimelineFormat returns the format named s.
+func ParseTimelineFormat(s string) (TimelineFormat, error) {
+	switch format := TimelineFormat(strings.ToLower(s)); format {
+	case TimelineJSON, TimelineCSV, TimelineCUE:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown timeline format %q, expected json, csv or cue", s)
+	}
+}
+
+// WriteTimeline writes segments to w in the given format. audioFile is the
+// scanned recording, referenced by the CUE sheet.
+func WriteTimeline(w io.Writer, segments []Segment, format TimelineFormat, audioFile string) error {
+	switch format {
+	case TimelineJSON:
+		return writeTimelineJSON(w, segments)
+	case TimelineCSV:
+		return writeTimelineCSV(w, segments)
+	case TimelineCUE:
+		return writeTimelineCUE(w, segments, audioFile)
+	default:
+		return fmt.Errorf("unknown timeline format %q", format)
+	}
+}
+
+func writeTimelineJSON(w io.Writer, segments []Segment) error {
+	if segments == nil {
+		segments = []Segment{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(segments)
+}
+
+func writeTimelineCSV(w io.Writer, segments []Segment) error {
+	writer := csv.NewWriter(w)
+
+	header := []string{"start", "end", "song_id", "title", "artist", "youtube_id", "song_offset", "confidence", "speed"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		record := []string{
+			strconv.FormatFloat(segment.Start, 'f', 3, 64),
+			strconv.FormatFloat(segment.End, 'f', 3, 64),
+			strconv.FormatUint(uint64(segment.SongID), 10),
+			segment.SongTitle,
+			segment.SongArtist,
+			segment.YouTubeID,
+			strconv.FormatFloat(segment.SongOffset, 'f', 3, 64),
+			strconv.FormatFloat(segment.Confidence, 'f', 4, 64),
+			strconv.FormatFloat(segment.Speed, 'f', 3, 64),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeTimelineCUE writes a CUE sheet with one track per segment.
+func writeTimelineCUE(w io.Writer, segments []Segment, audioFile string) error {
+	var sheet strings.Builder
+
+	fmt.Fprintf(&sheet, "FILE %s WAVE\n", cueString(filepath.Base(audioFile)))
+	for i, segment := range segments {
+		fmt.Fprintf(&sheet, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(&sheet, "    TITLE %s\n", cueString(segment.SongTitle))
+		fmt.Fprintf(&sheet, "    PERFORMER %s\n", cueString(segment.SongArtist))
+		fmt.Fprintf(&sheet, "    INDEX 01 %s\n", cueTime(segment.Start))
+	}
+
+	_, err := io.WriteString(w, sheet.String())
+	return err
+}
+
+// cueString quotes s for a CUE sheet, which has no escape sequences.
+func cueString(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+}
+
+// cueTime formats seconds as mm:ss:ff, with 75 frames per second.
+func cueTime(seconds float64) string {
+	frames := int(math.Round(seconds * 75))
+	return fmt.Sprintf("%02d:%02d:%02d", frames/(75*60), frames/75%60, frames%75)
+}
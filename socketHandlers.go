@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
@@ -15,8 +17,11 @@ import (
 	"song-recognition/spotdl"
 	"song-recognition/utils"
 	"song-recognition/wav"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/mdobak/go-xerrors"
@@ -37,7 +42,8 @@ func downloadStatus(statusType, message string) string {
 
 func handleTotalSongs(socket socketio.Conn) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
 
 	db, err := db.NewDBClient()
 	if err != nil {
@@ -47,7 +53,7 @@ func handleTotalSongs(socket socketio.Conn) {
 	}
 	defer db.Close()
 
-	totalSongs, err := db.TotalSongs()
+	totalSongs, err := db.TotalSongs(ctx)
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "Log error getting total songs", slog.Any("error", err))
@@ -82,7 +88,8 @@ func handleSongDownload(socket socketio.Conn, spotifyURL string) {
 
 func handleNewRecording(socket socketio.Conn, recordData string) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
 
 	var recData models.RecordData
 	if err := json.Unmarshal([]byte(recordData), &recData); err != nil {
@@ -98,7 +105,20 @@ func handleNewRecording(socket socketio.Conn, recordData string) {
 		return
 	}
 
-	matches, _, err := shazam.FindMatches(samples, recData.Duration, recData.SampleRate)
+	if recData.Cover {
+		emitCovers(ctx, socket, samples, recData.SampleRate)
+		return
+	}
+
+	opts := recordingMatchOptions(recData.SpeedTolerant)
+	matches, explanation, _, err := shazam.FindMatchesExplained(ctx, samples, recData.Duration, recData.SampleRate, opts, recData.Explain)
+	if explanation != nil {
+		emitExplanation(ctx, socket, explanation)
+	}
+	if errors.Is(err, shazam.ErrNoMatch) {
+		socket.Emit("matches", "[]")
+		return
+	}
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
@@ -118,9 +138,62 @@ func handleNewRecording(socket socketio.Conn, recordData string) {
 	socket.Emit("matches", string(jsonData))
 }
 
+// emitExplanation sends an "explanation" event detailing how the top
+// candidates of a recording were scored.
+func emitExplanation(ctx context.Context, socket socketio.Conn, explanation *shazam.Explanation) {
+	logger := utils.GetLogger()
+
+	jsonData, err := json.Marshal(explanation)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to marshal explanation.", slog.Any("error", err))
+		return
+	}
+
+	socket.Emit("explanation", string(jsonData))
+}
+
+// emitCovers sends a "coverMatches" event listing the songs whose harmony
+// follows that of a recording.
+func emitCovers(ctx context.Context, socket socketio.Conn, samples []float64, sampleRate int) {
+	logger := utils.GetLogger()
+
+	covers, err := shazam.FindCovers(ctx, samples, sampleRate, shazam.DefaultCoverOptions())
+	if errors.Is(err, shazam.ErrNoMatch) {
+		socket.Emit("coverMatches", "[]")
+		return
+	}
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to find covers.", slog.Any("error", err))
+		socket.Emit("coverMatches", "[]")
+		return
+	}
+
+	jsonData, err := json.Marshal(covers)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to marshal covers.", slog.Any("error", err))
+		return
+	}
+
+	socket.Emit("coverMatches", string(jsonData))
+}
+
+// recordingMatchOptions returns the options used to match the recordings
+// sent by clients, which can ask for the speed-tolerant mode.
+func recordingMatchOptions(speedTolerant bool) shazam.MatchOptions {
+	opts := shazam.DefaultMatchOptions()
+	if speedTolerant && len(opts.Transforms) == 0 {
+		opts.Transforms = shazam.SpeedGrid(shazam.DefaultSpeedTolerance)
+	}
+	return opts
+}
+
 func handleGetAllSongs(socket socketio.Conn) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
 
 	dbClient, err := db.NewDBClient()
 	if err != nil {
@@ -131,7 +204,7 @@ func handleGetAllSongs(socket socketio.Conn) {
 	}
 	defer dbClient.Close()
 
-	songs, err := dbClient.GetAllSongs()
+	songs, err := dbClient.GetAllSongs(ctx)
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "error getting all songs", slog.Any("error", err))
@@ -150,9 +223,40 @@ func handleGetAllSongs(socket socketio.Conn) {
 	socket.Emit("allSongs", string(jsonData))
 }
 
+func handleGetSimilarSongs(socket socketio.Conn, songID string) {
+	logger := utils.GetLogger()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
+
+	id64, err := strconv.ParseUint(songID, 10, 32)
+	if err != nil {
+		socket.Emit("similarSongs", "[]")
+		return
+	}
+
+	similarSongs, err := shazam.FindSimilarSongs(ctx, uint32(id64), 10)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "error finding similar songs", slog.Any("error", err))
+		socket.Emit("similarSongs", "[]")
+		return
+	}
+
+	jsonData, err := json.Marshal(similarSongs)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to marshal similar songs", slog.Any("error", err))
+		socket.Emit("similarSongs", "[]")
+		return
+	}
+
+	socket.Emit("similarSongs", string(jsonData))
+}
+
 func handleDeleteSong(socket socketio.Conn, songID string) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
 
 	// Convert string ID to uint32
 	id64, err := strconv.ParseUint(songID, 10, 32)
@@ -172,7 +276,7 @@ func handleDeleteSong(socket socketio.Conn, songID string) {
 	defer dbClient.Close()
 
 	// Get song info before deletion
-	song, found, err := dbClient.GetSongByID(songIDUint)
+	song, found, err := dbClient.GetSongByID(ctx, songIDUint)
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "error getting song", slog.Any("error", err))
@@ -186,7 +290,7 @@ func handleDeleteSong(socket socketio.Conn, songID string) {
 	}
 
 	// Delete song from database
-	err = dbClient.DeleteSongByID(songIDUint)
+	err = dbClient.DeleteSongByID(ctx, songIDUint)
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "error deleting song", slog.Any("error", err))
@@ -209,7 +313,8 @@ func handleDeleteSong(socket socketio.Conn, songID string) {
 
 func handleDeleteAllSongs(socket socketio.Conn) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
 
 	dbClient, err := db.NewDBClient()
 	if err != nil {
@@ -221,14 +326,14 @@ func handleDeleteAllSongs(socket socketio.Conn) {
 	defer dbClient.Close()
 
 	// Get total count before deletion
-	totalSongs, err := dbClient.TotalSongs()
+	totalSongs, err := dbClient.TotalSongs(ctx)
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "error getting total songs", slog.Any("error", err))
 	}
 
 	// Delete all fingerprints and songs
-	err = dbClient.DeleteCollection("fingerprints")
+	err = dbClient.DeleteCollection(ctx, "fingerprints")
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "error deleting fingerprints", slog.Any("error", err))
@@ -236,7 +341,7 @@ func handleDeleteAllSongs(socket socketio.Conn) {
 		return
 	}
 
-	err = dbClient.DeleteCollection("songs")
+	err = dbClient.DeleteCollection(ctx, "songs")
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "error deleting songs", slog.Any("error", err))
@@ -244,6 +349,38 @@ func handleDeleteAllSongs(socket socketio.Conn) {
 		return
 	}
 
+	err = dbClient.DeleteCollection(ctx, "fingerprint_config")
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "error deleting fingerprint config", slog.Any("error", err))
+		socket.Emit("deleteAllResult", downloadStatus("error", "Failed to delete fingerprint config"))
+		return
+	}
+
+	err = dbClient.DeleteCollection(ctx, "chroma")
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "error deleting chroma", slog.Any("error", err))
+		socket.Emit("deleteAllResult", downloadStatus("error", "Failed to delete chroma"))
+		return
+	}
+
+	err = dbClient.DeleteCollection(ctx, "embeddings")
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "error deleting embeddings", slog.Any("error", err))
+		socket.Emit("deleteAllResult", downloadStatus("error", "Failed to delete embeddings"))
+		return
+	}
+
+	err = dbClient.DeleteCollection(ctx, "song_metadata")
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "error deleting song metadata", slog.Any("error", err))
+		socket.Emit("deleteAllResult", downloadStatus("error", "Failed to delete song metadata"))
+		return
+	}
+
 	// Delete all WAV files in songs directory
 	err = filepath.Walk(SONGS_DIR, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -265,7 +402,9 @@ func handleDeleteAllSongs(socket socketio.Conn) {
 
 func handleFingerprinting(socket socketio.Conn, filename string) {
 	logger := utils.GetLogger()
-	ctx := context.Background()
+	// Fingerprinting a long song can outlast the request deadline, so it
+	// only stops when the client disconnects
+	ctx := getConnection(socket).ctx
 
 	// If no filename provided, get the latest file from original_songs
 	var filePath string
@@ -351,7 +490,7 @@ func handleFingerprinting(socket socketio.Conn, filename string) {
 	socket.Emit("fingerprintStatus", downloadStatus("info", "Creating fingerprints..."))
 
 	// Process and save the song
-	err = spotify.ProcessAndSaveSong(filePath, track.Title, track.Artist, ytID)
+	err = spotify.ProcessAndSaveSong(ctx, filePath, track.Title, track.Artist, ytID)
 	if err != nil {
 		if strings.Contains(err.Error(), "already exists") || strings.Contains(err.Error(), "UNIQUE constraint") {
 			statusMsg := fmt.Sprintf("'%s' by '%s' already exists in database - skipping fingerprinting", track.Title, track.Artist)
@@ -391,3 +530,328 @@ func handleFingerprinting(socket socketio.Conn, filename string) {
 	statusMsg := fmt.Sprintf("'%s' by '%s' successfully fingerprinted and saved to database", track.Title, track.Artist)
 	socket.Emit("fingerprintStatus", downloadStatus("success", statusMsg))
 }
+
+var (
+	// streamWindowSeconds is the length of the rolling window matched
+	// during a live stream.
+	streamWindowSeconds = envFloat("STREAM_WINDOW_SECONDS", 10)
+
+	// streamRematchSeconds is the amount of new audio after which the
+	// rolling window is matched again.
+	streamRematchSeconds = envFloat("STREAM_REMATCH_SECONDS", 2)
+
+	// requestTimeoutSeconds is the deadline of the work done for one event,
+	// such as matching a recording. Fingerprinting a song has none.
+	requestTimeoutSeconds = envFloat("REQUEST_TIMEOUT_SECONDS", 60)
+)
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(utils.GetEnv(key), 64)
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// connection is the state of a socket connection, kept as its context. ctx
+// is cancelled on disconnect, which stops the work done for the connection.
+type connection struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	stream *liveStream // current live recognition, if any
+}
+
+func newConnection() *connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connection{ctx: ctx, cancel: cancel}
+}
+
+func getConnection(socket socketio.Conn) *connection {
+	conn, ok := socket.Context().(*connection)
+	if !ok {
+		conn = newConnection()
+		socket.SetContext(conn)
+	}
+	return conn
+}
+
+// requestContext returns the context of the work done for one event of
+// socket, which ends on disconnect or after requestTimeoutSeconds.
+func requestContext(socket socketio.Conn) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(getConnection(socket).ctx, requestTimeout())
+}
+
+func requestTimeout() time.Duration {
+	return time.Duration(requestTimeoutSeconds * float64(time.Second))
+}
+
+// handleDisconnect cancels the work still running for socket.
+func handleDisconnect(socket socketio.Conn) {
+	conn := getConnection(socket)
+	conn.cancel()
+	if stream, ok := takeLiveStream(socket); ok {
+		stream.stop()
+	}
+}
+
+// liveStream is the state of a live recognition, from "streamStart" to
+// "streamStop". ctx is cancelled when the stream stops or the connection
+// closes.
+type liveStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	channels   int
+	sampleRate int
+	opts       shazam.MatchOptions
+
+	buffer     *utils.RingBuffer       // last streamWindowSeconds of mono audio
+	sinceMatch int                     // samples received since the last match started
+	matching   bool                    // a rolling match is running
+	lastSongID uint32                  // song of the last partialMatch sent
+	best       map[uint32]shazam.Match // best match of each song over the rolling windows
+	stopped    bool
+}
+
+func getLiveStream(socket socketio.Conn) (*liveStream, bool) {
+	conn := getConnection(socket)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.stream, conn.stream != nil
+}
+
+// takeLiveStream detaches the live stream of socket and returns it.
+func takeLiveStream(socket socketio.Conn) (*liveStream, bool) {
+	conn := getConnection(socket)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	stream := conn.stream
+	conn.stream = nil
+	return stream, stream != nil
+}
+
+func handleStreamStart(socket socketio.Conn, startData string) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	var start models.StreamStart
+	if err := json.Unmarshal([]byte(startData), &start); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to unmarshal stream start.", slog.Any("error", err))
+		return
+	}
+
+	if start.SampleSize != 16 || start.Channels < 1 || start.Channels > 2 || start.SampleRate <= 0 {
+		err := xerrors.New(fmt.Errorf("unsupported stream format: %d channels, %d Hz, %d bits", start.Channels, start.SampleRate, start.SampleSize))
+		logger.ErrorContext(ctx, "Failed to start stream.", slog.Any("error", err))
+		return
+	}
+
+	conn := getConnection(socket)
+	streamCtx, streamCancel := context.WithCancel(conn.ctx)
+	stream := &liveStream{
+		ctx:        streamCtx,
+		cancel:     streamCancel,
+		channels:   start.Channels,
+		sampleRate: start.SampleRate,
+		opts:       recordingMatchOptions(start.SpeedTolerant),
+		buffer:     utils.NewRingBuffer(int(streamWindowSeconds * float64(start.SampleRate))),
+		best:       map[uint32]shazam.Match{},
+	}
+
+	conn.mu.Lock()
+	previous := conn.stream
+	conn.stream = stream
+	conn.mu.Unlock()
+
+	if previous != nil {
+		previous.stop()
+	}
+}
+
+func handleStreamChunk(socket socketio.Conn, chunk string) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	stream, ok := getLiveStream(socket)
+	if !ok {
+		logger.Info("received a stream chunk without streamStart")
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(chunk)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to decode stream chunk.", slog.Any("error", err))
+		return
+	}
+
+	samples, err := wav.WavBytesToSamples(data[:len(data)-len(data)%(2*stream.channels)])
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to convert stream chunk.", slog.Any("error", err))
+		return
+	}
+
+	if window, ok := stream.write(samples); ok {
+		go stream.matchWindow(socket, window)
+	}
+}
+
+func handleStreamStop(socket socketio.Conn) {
+	logger := utils.GetLogger()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
+
+	stream, ok := takeLiveStream(socket)
+	if !ok {
+		return
+	}
+
+	// The final result covers the whole stream: the last window, which may
+	// be shorter than the rematch interval, is matched and merged with the
+	// best matches found in the rolling windows before it.
+	window, partials := stream.stop()
+	var matches []shazam.Match
+	if len(window) > 0 {
+		var err error
+		matches, _, err = shazam.FindMatches(ctx, window, float64(len(window))/float64(stream.sampleRate), stream.sampleRate, stream.opts)
+		if err != nil && !errors.Is(err, shazam.ErrNoMatch) {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
+		}
+	}
+
+	matches = mergeStreamMatches(matches, partials)
+	if len(matches) == 0 {
+		socket.Emit("matches", "[]")
+		return
+	}
+
+	if len(matches) > 10 {
+		matches = matches[:10]
+	}
+	jsonData, err := json.Marshal(matches)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to marshal matches.", slog.Any("error", err))
+		return
+	}
+
+	socket.Emit("matches", string(jsonData))
+}
+
+// write downmixes interleaved samples into the rolling window. It returns a
+// copy of the window when it is due for matching.
+func (s *liveStream) write(samples []float64) ([]float64, bool) {
+	mono := make([]float64, len(samples)/s.channels)
+	for i := range mono {
+		var sum float64
+		for c := 0; c < s.channels; c++ {
+			sum += samples[i*s.channels+c]
+		}
+		mono[i] = sum / float64(s.channels)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return nil, false
+	}
+
+	s.buffer.Write(mono)
+	s.sinceMatch += len(mono)
+	if s.matching || float64(s.sinceMatch) < streamRematchSeconds*float64(s.sampleRate) {
+		return nil, false
+	}
+
+	s.matching = true
+	s.sinceMatch = 0
+	return s.buffer.Samples(), true
+}
+
+// matchWindow matches a copy of the rolling window, keeps the best match of
+// each song for the final result and emits a "partialMatch" event when a
+// new song passes the confidence threshold. The match is abandoned when the
+// stream stops.
+func (s *liveStream) matchWindow(socket socketio.Conn, window []float64) {
+	logger := utils.GetLogger()
+	ctx, cancel := context.WithTimeout(s.ctx, requestTimeout())
+	defer cancel()
+
+	matches, _, err := shazam.FindMatches(ctx, window, float64(len(window))/float64(s.sampleRate), s.sampleRate, s.opts)
+	if err != nil && !errors.Is(err, shazam.ErrNoMatch) && s.ctx.Err() == nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to match stream window.", slog.Any("error", err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.matching = false
+	if s.stopped || len(matches) == 0 {
+		return
+	}
+	for _, match := range matches {
+		if best, ok := s.best[match.SongID]; !ok || match.Score > best.Score {
+			s.best[match.SongID] = match
+		}
+	}
+	if matches[0].SongID == s.lastSongID {
+		return
+	}
+	s.lastSongID = matches[0].SongID
+
+	jsonData, err := json.Marshal(matches[0])
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to marshal match.", slog.Any("error", err))
+		return
+	}
+
+	socket.Emit("partialMatch", string(jsonData))
+}
+
+// stop ends the stream, abandoning a rolling match still running, and
+// returns the last window and the best match of each song found in the
+// rolling windows.
+func (s *liveStream) stop() ([]float64, []shazam.Match) {
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	partials := make([]shazam.Match, 0, len(s.best))
+	for _, match := range s.best {
+		partials = append(partials, match)
+	}
+	return s.buffer.Samples(), partials
+}
+
+// mergeStreamMatches merges the matches of the last window of a stream with
+// the best ones of its earlier windows, best first. A song matched by the
+// last window keeps that match, whose timestamp is the most recent.
+func mergeStreamMatches(last, partials []shazam.Match) []shazam.Match {
+	merged := append([]shazam.Match(nil), last...)
+	seen := map[uint32]bool{}
+	for _, match := range last {
+		seen[match.SongID] = true
+	}
+	for _, match := range partials {
+		if !seen[match.SongID] {
+			merged = append(merged, match)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Score > merged[j].Score
+	})
+	return merged
+}
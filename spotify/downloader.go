@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"song-recognition/db"
+	"song-recognition/models"
 	"song-recognition/shazam"
 	"song-recognition/utils"
 	"song-recognition/wav"
@@ -113,7 +114,7 @@ func dlTrack(tracks []Track, path string) (int, error) {
 			}
 
 			// check if song exists
-			keyExists, err := SongKeyExists(utils.GenerateSongKey(trackCopy.Title, trackCopy.Artist))
+			keyExists, err := SongKeyExists(ctx, utils.GenerateSongKey(trackCopy.Title, trackCopy.Artist))
 			if err != nil {
 				err := xerrors.New(err)
 				logger.ErrorContext(ctx, "error checking song existence", slog.Any("error", err))
@@ -124,7 +125,7 @@ func dlTrack(tracks []Track, path string) (int, error) {
 				return
 			}
 
-			ytID, err := getYTID(trackCopy)
+			ytID, err := getYTID(ctx, trackCopy)
 			if ytID == "" || err != nil {
 				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
@@ -142,7 +143,7 @@ func dlTrack(tracks []Track, path string) (int, error) {
 				return
 			}
 
-			err = ProcessAndSaveSong(filePath, trackCopy.Title, trackCopy.Artist, ytID)
+			err = ProcessAndSaveSong(ctx, filePath, trackCopy.Title, trackCopy.Artist, ytID)
 			if err != nil {
 				logMessage := fmt.Sprintf("Failed to process song ('%s' by '%s')", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
@@ -269,7 +270,10 @@ func addTags(file string, track Track) error {
 	return nil
 }
 
-func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string) error {
+// ProcessAndSaveSong registers a song and stores its fingerprints. It stops
+// with the error of ctx once ctx is done, leaving nothing of the song in
+// the database.
+func ProcessAndSaveSong(ctx context.Context, songFilePath, songTitle, songArtist, ytID string) error {
 	dbclient, err := db.NewDBClient()
 	if err != nil {
 		return err
@@ -281,47 +285,101 @@ func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string) error
 		return err
 	}
 
-	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	wavReader, err := wav.OpenWav(wavFilePath)
 	if err != nil {
 		return err
 	}
+	defer wavReader.Close()
 
-	samples, err := wav.WavBytesToSamples(wavInfo.Data)
+	config, err := shazam.IngestConfig(ctx, dbclient)
 	if err != nil {
-		return fmt.Errorf("error converting wav bytes to float64: %v", err)
+		return err
 	}
 
-	spectro, err := shazam.Spectrogram(samples, wavInfo.SampleRate)
+	chain, err := shazam.ParsePreprocessChain(utils.GetEnv("INGEST_PREPROCESS"))
 	if err != nil {
-		return fmt.Errorf("error creating spectrogram: %v", err)
+		return err
 	}
 
-	songID, err := dbclient.RegisterSong(songTitle, songArtist, ytID)
+	// The level is measured in a first pass, so that the fingerprints are
+	// computed on normalized audio with its silence muted.
+	loudness, err := measureLoudness(ctx, wavFilePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("error measuring loudness: %v", err)
 	}
 
-	peaks := shazam.ExtractPeaks(spectro, wavInfo.Duration)
-	fingerprints := shazam.Fingerprint(peaks, songID)
+	songID, err := dbclient.RegisterSong(ctx, songTitle, songArtist, ytID)
+	if err != nil {
+		return err
+	}
 
-	err = dbclient.StoreFingerprints(fingerprints)
+	// Fingerprints are stored as they are produced so that long files
+	// never have to be held in memory.
+	err = shazam.FingerprintPCM(ctx, wavReader, wavReader.SampleRate, songID, config, chain, loudness.Leveler(), func(fingerprints map[uint32][]models.Couple) error {
+		return dbclient.StoreFingerprints(ctx, fingerprints)
+	})
 	if err != nil {
-		dbclient.DeleteSongByID(songID)
+		// The song is removed even when ctx was cancelled
+		dbclient.DeleteSongByID(context.WithoutCancel(ctx), songID)
 		return fmt.Errorf("error to storing fingerpring: %v", err)
 	}
 
+	if err := storeAnalysis(ctx, dbclient, wavFilePath, songID, config, loudness); err != nil {
+		dbclient.DeleteSongByID(context.WithoutCancel(ctx), songID)
+		return fmt.Errorf("error storing song analysis: %v", err)
+	}
+
 	fmt.Printf("Fingerprint for %v by %v saved in DB successfully\n", songTitle, songArtist)
 	return nil
 }
 
-func getYTID(trackCopy *Track) (string, error) {
+// measureLoudness measures the level and silence of a WAV file.
+func measureLoudness(ctx context.Context, wavFilePath string) (shazam.Loudness, error) {
+	wavReader, err := wav.OpenWav(wavFilePath)
+	if err != nil {
+		return shazam.Loudness{}, err
+	}
+	defer wavReader.Close()
+
+	return shazam.MeasureLoudnessPCM(ctx, wavReader, wavReader.SampleRate)
+}
+
+// storeAnalysis computes the chroma summary of a song, used by cover search,
+// its embedding, used by similarity search, and its tempo and key, in a
+// second pass over its WAV file, leveled as for its fingerprints, and stores
+// them with its loudness.
+func storeAnalysis(ctx context.Context, dbclient db.DBClient, wavFilePath string, songID uint32, config shazam.FingerprintConfig, loudness shazam.Loudness) error {
+	wavReader, err := wav.OpenWav(wavFilePath)
+	if err != nil {
+		return err
+	}
+	defer wavReader.Close()
+
+	analysis, err := shazam.AnalyzePCM(ctx, wavReader, wavReader.SampleRate, config, loudness.Leveler())
+	if err != nil {
+		return err
+	}
+
+	if err := dbclient.StoreChroma(ctx, songID, analysis.Chroma); err != nil {
+		return err
+	}
+	if err := dbclient.StoreEmbedding(ctx, songID, analysis.Embedding); err != nil {
+		return err
+	}
+	metadata := analysis.Metadata
+	summary := loudness.Summary()
+	metadata.Loudness = &summary
+	return dbclient.SetSongMetadata(ctx, songID, metadata)
+}
+
+func getYTID(ctx context.Context, trackCopy *Track) (string, error) {
 	ytID, err := GetYoutubeId(*trackCopy)
 	if ytID == "" || err != nil {
 		return "", err
 	}
 
 	// Check if YouTube ID exists
-	ytidExists, err := YtIDExists(ytID)
+	ytidExists, err := YtIDExists(ctx, ytID)
 	if err != nil {
 		return "", fmt.Errorf("error checking YT ID existence: %v", err)
 	}
@@ -336,7 +394,7 @@ func getYTID(trackCopy *Track) (string, error) {
 			return "", err
 		}
 
-		ytidExists, err = YtIDExists(ytID)
+		ytidExists, err = YtIDExists(ctx, ytID)
 		if err != nil {
 			return "", fmt.Errorf("error checking YT ID existence: %v", err)
 		}
@@ -1,6 +1,7 @@
 package spotify
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/url"
@@ -39,14 +40,14 @@ func GetFileSize(file string) (int64, error) {
 	return size, nil
 }
 
-func SongKeyExists(key string) (bool, error) {
+func SongKeyExists(ctx context.Context, key string) (bool, error) {
 	db, err := db.NewDBClient()
 	if err != nil {
 		return false, err
 	}
 	defer db.Close()
 
-	_, songExists, err := db.GetSongByKey(key)
+	_, songExists, err := db.GetSongByKey(ctx, key)
 	if err != nil {
 		return false, err
 	}
@@ -54,14 +55,14 @@ func SongKeyExists(key string) (bool, error) {
 	return songExists, nil
 }
 
-func YtIDExists(ytID string) (bool, error) {
+func YtIDExists(ctx context.Context, ytID string) (bool, error) {
 	db, err := db.NewDBClient()
 	if err != nil {
 		return false, err
 	}
 	defer db.Close()
 
-	_, songExits, err := db.GetSongByYTID(ytID)
+	_, songExits, err := db.GetSongByYTID(ctx, ytID)
 	if err != nil {
 		return false, err
 	}
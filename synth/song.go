@@ -0,0 +1,131 @@
+package synth
+
+import (
+	"math"
+	"math/rand"
+)
+
+var (
+	majorScale = []int{0, 2, 4, 5, 7, 9, 11}
+	minorScale = []int{0, 2, 3, 5, 7, 8, 10}
+
+	// progressions are chord roots as scale degrees, counted from 0.
+	progressions = [][]int{
+		{0, 4, 5, 3}, // I V vi IV
+		{0, 5, 3, 4}, // I vi IV V
+		{5, 3, 0, 4}, // vi IV I V
+		{0, 3, 4, 3}, // I IV V IV
+	}
+)
+
+// SongOptions describes a seeded song. Zero fields are chosen from the seed.
+type SongOptions struct {
+	Tempo float64 // beats per minute
+	Root  int     // MIDI note of the key
+	Minor bool
+}
+
+// Song synthesizes seconds of a reproducible piece of music: a chord
+// progression, a bass line, a melody and percussion, in a key and at a
+// tempo chosen from seed. Different seeds give songs that do not match
+// each other, which makes them suited to seed a test library.
+func Song(seed int64, seconds float64, sampleRate int) []float64 {
+	return SongWithOptions(seed, seconds, sampleRate, SongOptions{})
+}
+
+// SongWithOptions is Song with the tempo or key fixed by opts.
+func SongWithOptions(seed int64, seconds float64, sampleRate int, opts SongOptions) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+
+	if opts.Tempo <= 0 {
+		opts.Tempo = 90 + 50*rng.Float64()
+	}
+	if opts.Root <= 0 {
+		opts.Root = 48 + rng.Intn(12)
+		opts.Minor = rng.Intn(2) == 1
+	}
+	scale := majorScale
+	if opts.Minor {
+		scale = minorScale
+	}
+	progression := progressions[rng.Intn(len(progressions))]
+
+	beat := 60 / opts.Tempo
+	length := numSamples(seconds, sampleRate)
+	chords := make([]float64, length)
+	bass := make([]float64, length)
+	melody := make([]float64, length)
+	drums := make([]float64, length)
+
+	// degreeNote returns the MIDI note of a scale degree, which may exceed
+	// the scale and wrap to the next octaves.
+	degreeNote := func(degree int) float64 {
+		octave := degree / len(scale)
+		return float64(opts.Root + 12*octave + scale[degree%len(scale)])
+	}
+
+	numBeats := int(math.Ceil(seconds / beat))
+	for b := 0; b < numBeats; b++ {
+		start := float64(b) * beat
+		degree := progression[(b/4)%len(progression)]
+
+		// A triad held over every bar
+		if b%4 == 0 {
+			var freqs []float64
+			for _, step := range []int{0, 2, 4} {
+				freqs = append(freqs, MIDIToHz(degreeNote(degree+step)+12))
+			}
+			place(chords, Chord(freqs, 4*beat, sampleRate, 0.3), start, sampleRate, 0.2)
+		}
+
+		place(bass, pluck(MIDIToHz(degreeNote(degree)-12), beat, sampleRate, 8), start, sampleRate, 0.35)
+
+		// Two melody eighths per beat, some of them rests
+		for half := 0; half < 2; half++ {
+			if rng.Float64() < 0.25 {
+				continue
+			}
+			note := degreeNote(7 + rng.Intn(len(scale)+3))
+			place(melody, pluck(MIDIToHz(note), beat, sampleRate, 6), start+float64(half)*beat/2, sampleRate, 0.3)
+		}
+
+		// Kick on every beat, hi-hats on the eighths
+		place(drums, kick(sampleRate), start, sampleRate, 0.5)
+		for half := 0; half < 2; half++ {
+			hat := WhiteNoise(0.05, sampleRate, 1, rng.Int63())
+			place(drums, decay(hat, sampleRate, 80), start+float64(half)*beat/2, sampleRate, 0.08)
+		}
+	}
+
+	return Normalize(Mix(chords, bass, melody, drums), 0.8)
+}
+
+// pluck returns a decaying note with a few harmonics.
+func pluck(freq, seconds float64, sampleRate int, decayRate float64) []float64 {
+	note := make([]float64, numSamples(seconds, sampleRate))
+	for harmonic, gain := range []float64{1, 0.5, 0.25} {
+		addScaled(note, Tone(freq*float64(harmonic+1), seconds, sampleRate, gain), 1)
+	}
+	return fade(decay(note, sampleRate, decayRate), sampleRate)
+}
+
+// kick returns a short sine sweep from 120 Hz down to 50 Hz.
+func kick(sampleRate int) []float64 {
+	return decay(Chirp(120, 50, 0.15, sampleRate, 1), sampleRate, 25)
+}
+
+// decay applies an exponential decay of rate per second to samples, in place.
+func decay(samples []float64, sampleRate int, rate float64) []float64 {
+	for i := range samples {
+		samples[i] *= math.Exp(-rate * float64(i) / float64(sampleRate))
+	}
+	return samples
+}
+
+// place adds gain times sound to track, starting at start seconds.
+func place(track, sound []float64, start float64, sampleRate int, gain float64) {
+	offset := numSamples(start, sampleRate)
+	if offset < len(track) {
+		addScaled(track[offset:], sound, gain)
+	}
+}
@@ -0,0 +1,182 @@
+package synth
+
+import (
+	"math"
+	"math/rand"
+	"song-recognition/utils"
+	"song-recognition/wav"
+)
+
+// fadeSeconds is the length of the fade in and out applied to every note,
+// so that consecutive notes do not click.
+const fadeSeconds = 0.005
+
+// Note is a tone of a sequence. A Freq of 0 is a rest.
+type Note struct {
+	Freq      float64 // Hz
+	Duration  float64 // seconds
+	Amplitude float64
+}
+
+// MIDIToHz returns the frequency of a MIDI note number, 69 being A4 at 440 Hz.
+func MIDIToHz(note float64) float64 {
+	return 440 * math.Pow(2, (note-69)/12)
+}
+
+// numSamples returns the number of samples lasting seconds at sampleRate.
+func numSamples(seconds float64, sampleRate int) int {
+	return max(0, int(math.Round(seconds*float64(sampleRate))))
+}
+
+// Silence returns seconds of silence.
+func Silence(seconds float64, sampleRate int) []float64 {
+	return make([]float64, numSamples(seconds, sampleRate))
+}
+
+// Tone returns a sine wave of freq Hz and the given peak amplitude.
+func Tone(freq, seconds float64, sampleRate int, amplitude float64) []float64 {
+	samples := make([]float64, numSamples(seconds, sampleRate))
+	for i := range samples {
+		t := float64(i) / float64(sampleRate)
+		samples[i] = amplitude * math.Sin(2*math.Pi*freq*t)
+	}
+	return samples
+}
+
+// Tones plays notes one after the other, each faded in and out.
+func Tones(notes []Note, sampleRate int) []float64 {
+	var samples []float64
+	for _, note := range notes {
+		tone := Tone(note.Freq, note.Duration, sampleRate, note.Amplitude)
+		samples = append(samples, fade(tone, sampleRate)...)
+	}
+	return samples
+}
+
+// Chirp returns a sine wave sweeping linearly from fromHz to toHz.
+func Chirp(fromHz, toHz, seconds float64, sampleRate int, amplitude float64) []float64 {
+	samples := make([]float64, numSamples(seconds, sampleRate))
+	rate := (toHz - fromHz) / seconds
+	for i := range samples {
+		t := float64(i) / float64(sampleRate)
+		samples[i] = amplitude * math.Sin(2*math.Pi*(fromHz*t+rate*t*t/2))
+	}
+	return samples
+}
+
+// Chord returns the sum of sine waves at freqs, scaled so that its peak
+// never exceeds amplitude.
+func Chord(freqs []float64, seconds float64, sampleRate int, amplitude float64) []float64 {
+	samples := make([]float64, numSamples(seconds, sampleRate))
+	if len(freqs) == 0 {
+		return samples
+	}
+
+	for _, freq := range freqs {
+		addScaled(samples, Tone(freq, seconds, sampleRate, amplitude/float64(len(freqs))), 1)
+	}
+	return samples
+}
+
+// ChordProgression plays chords one after the other, chordSeconds each.
+func ChordProgression(chords [][]float64, chordSeconds float64, sampleRate int, amplitude float64) []float64 {
+	var samples []float64
+	for _, chord := range chords {
+		samples = append(samples, fade(Chord(chord, chordSeconds, sampleRate, amplitude), sampleRate)...)
+	}
+	return samples
+}
+
+// WhiteNoise returns uniform white noise with the given peak amplitude.
+// The same seed always gives the same noise.
+func WhiteNoise(seconds float64, sampleRate int, amplitude float64, seed int64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+
+	samples := make([]float64, numSamples(seconds, sampleRate))
+	for i := range samples {
+		samples[i] = amplitude * (2*rng.Float64() - 1)
+	}
+	return samples
+}
+
+// PinkNoise returns noise whose power falls by 3 dB per octave, normalized
+// to the given peak amplitude. The same seed always gives the same noise.
+func PinkNoise(seconds float64, sampleRate int, amplitude float64, seed int64) []float64 {
+	white := WhiteNoise(seconds, sampleRate, 1, seed)
+
+	// Paul Kellett's economy filter, accurate to ±0.05 dB above 9.2 Hz at
+	// 44.1 kHz
+	var b0, b1, b2 float64
+	samples := make([]float64, len(white))
+	for i, x := range white {
+		b0 = 0.99765*b0 + x*0.0990460
+		b1 = 0.96300*b1 + x*0.2965164
+		b2 = 0.57000*b2 + x*1.0526913
+		samples[i] = b0 + b1 + b2 + x*0.1848
+	}
+
+	return Normalize(samples, amplitude)
+}
+
+// Mix sums signals, which may have different lengths, into one as long as
+// the longest.
+func Mix(signals ...[]float64) []float64 {
+	var length int
+	for _, signal := range signals {
+		length = max(length, len(signal))
+	}
+
+	mixed := make([]float64, length)
+	for _, signal := range signals {
+		addScaled(mixed, signal, 1)
+	}
+	return mixed
+}
+
+// Normalize scales samples in place so that their peak is peak, and returns them.
+func Normalize(samples []float64, peak float64) []float64 {
+	var current float64
+	for _, x := range samples {
+		current = math.Max(current, math.Abs(x))
+	}
+	if current == 0 {
+		return samples
+	}
+
+	for i := range samples {
+		samples[i] *= peak / current
+	}
+	return samples
+}
+
+// WriteWav writes samples to a mono 16-bit WAV file, clipping them to full scale.
+func WriteWav(filename string, samples []float64, sampleRate int) error {
+	clipped := make([]float64, len(samples))
+	for i, x := range samples {
+		clipped[i] = math.Max(-1, math.Min(1, x))
+	}
+
+	data, err := utils.FloatsToBytes(clipped, 16)
+	if err != nil {
+		return err
+	}
+	return wav.WriteWavFile(filename, data, sampleRate, 1, 16)
+}
+
+// fade applies a short linear fade in and out to samples, in place.
+func fade(samples []float64, sampleRate int) []float64 {
+	n := min(numSamples(fadeSeconds, sampleRate), len(samples)/2)
+	for i := 0; i < n; i++ {
+		gain := float64(i) / float64(n)
+		samples[i] *= gain
+		samples[len(samples)-1-i] *= gain
+	}
+	return samples
+}
+
+// addScaled adds gain times signal to the start of dst.
+func addScaled(dst, signal []float64, gain float64) {
+	for i := 0; i < len(dst) && i < len(signal); i++ {
+		dst[i] += gain * signal[i]
+	}
+}
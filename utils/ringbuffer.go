@@ -0,0 +1,50 @@
+package utils
+
+// RingBuffer keeps the most recent samples written to it, up to a fixed
+// capacity, overwriting the oldest ones.
+type RingBuffer struct {
+	data  []float64
+	start int // index of the oldest sample
+	size  int
+}
+
+// NewRingBuffer creates a ring buffer holding up to capacity samples.
+func NewRingBuffer(capacity int) *RingBuffer {
+	return &RingBuffer{data: make([]float64, max(capacity, 1))}
+}
+
+// Write appends samples, dropping the oldest ones when the buffer is full.
+func (rb *RingBuffer) Write(samples []float64) {
+	// Only the last len(rb.data) samples can be kept
+	if len(samples) > len(rb.data) {
+		samples = samples[len(samples)-len(rb.data):]
+	}
+
+	for _, sample := range samples {
+		end := (rb.start + rb.size) % len(rb.data)
+		rb.data[end] = sample
+		if rb.size < len(rb.data) {
+			rb.size++
+		} else {
+			rb.start = (rb.start + 1) % len(rb.data)
+		}
+	}
+}
+
+// Samples returns a copy of the buffered samples, oldest first.
+func (rb *RingBuffer) Samples() []float64 {
+	samples := make([]float64, rb.size)
+	n := copy(samples, rb.data[rb.start:min(rb.start+rb.size, len(rb.data))])
+	copy(samples[n:], rb.data[:rb.size-n])
+	return samples
+}
+
+// Len returns the number of buffered samples.
+func (rb *RingBuffer) Len() int {
+	return rb.size
+}
+
+// Reset empties the buffer.
+func (rb *RingBuffer) Reset() {
+	rb.start, rb.size = 0, 0
+}
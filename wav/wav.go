@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -200,3 +201,136 @@ func GetMetadata(filePath string) (FFmpegMetadata, error) {
 
 	return metadata, nil
 }
+
+// WavReader streams the PCM data of a 16-bit WAV file without loading it
+// into memory. Reads return the raw little-endian sample bytes.
+type WavReader struct {
+	Channels   int
+	SampleRate int
+	Duration   float64
+
+	file      *os.File
+	data      io.Reader
+	dataStart int64 // offset of the data chunk in file
+	dataSize  int64
+}
+
+// OpenWav opens a 16-bit PCM WAV file and positions the returned reader at
+// the start of its data chunk. Chunks other than "fmt " and "data" are skipped.
+func OpenWav(filename string) (*WavReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newWavReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader.file = file
+	if reader.dataStart, err = file.Seek(0, io.SeekCurrent); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func newWavReader(r io.Reader) (*WavReader, error) {
+	var riff struct {
+		ChunkID   [4]byte
+		ChunkSize uint32
+		Format    [4]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &riff); err != nil {
+		return nil, fmt.Errorf("failed to read WAV header: %v", err)
+	}
+	if string(riff.ChunkID[:]) != "RIFF" || string(riff.Format[:]) != "WAVE" {
+		return nil, errors.New("invalid WAV header format")
+	}
+
+	var format struct {
+		AudioFormat   uint16
+		NumChannels   uint16
+		SampleRate    uint32
+		BytesPerSec   uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}
+	foundFormat := false
+
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return nil, fmt.Errorf("failed to find WAV data chunk: %v", err)
+		}
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			if chunk.Size < 16 {
+				return nil, errors.New("invalid WAV format chunk size")
+			}
+			if err := binary.Read(r, binary.LittleEndian, &format); err != nil {
+				return nil, fmt.Errorf("failed to read WAV format chunk: %v", err)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(chunk.Size)-16+int64(chunk.Size%2)); err != nil {
+				return nil, fmt.Errorf("failed to read WAV format chunk: %v", err)
+			}
+			foundFormat = true
+
+		case "data":
+			if !foundFormat {
+				return nil, errors.New("invalid WAV file: data chunk before format chunk")
+			}
+			if format.AudioFormat != 1 {
+				return nil, errors.New("invalid WAV header format")
+			}
+			if format.BitsPerSample != 16 {
+				return nil, errors.New("unsupported bits per sample format")
+			}
+
+			return &WavReader{
+				Channels:   int(format.NumChannels),
+				SampleRate: int(format.SampleRate),
+				Duration:   float64(chunk.Size) / float64(int(format.NumChannels)*2*int(format.SampleRate)),
+				data:       io.LimitReader(r, int64(chunk.Size)),
+				dataSize:   int64(chunk.Size),
+			}, nil
+
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(chunk.Size)+int64(chunk.Size%2)); err != nil {
+				return nil, fmt.Errorf("failed to skip WAV chunk: %v", err)
+			}
+		}
+	}
+}
+
+// Read reads raw PCM bytes from the data chunk.
+func (w *WavReader) Read(p []byte) (int, error) {
+	return w.data.Read(p)
+}
+
+// Rewind positions the reader back at the start of the data chunk, for
+// another pass over the samples.
+func (w *WavReader) Rewind() error {
+	if w.file == nil {
+		return errors.New("WAV reader is not backed by a file")
+	}
+	if _, err := w.file.Seek(w.dataStart, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind WAV file: %v", err)
+	}
+	w.data = io.LimitReader(w.file, w.dataSize)
+	return nil
+}
+
+// Close closes the underlying file.
+func (w *WavReader) Close() error {
+	if w.file != nil {
+		return w.file.Close()
+	}
+	return nil
+}